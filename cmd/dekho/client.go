@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// credentials are what login stores for the other commands
+type credentials struct {
+	Server string `json:"server"`
+	Token  string `json:"token"`
+}
+
+// client talks to the server as the user that logged in. The server keeps
+// the login in the auth_token cookie, which is sent by hand because it is
+// marked secure and servers on a local network are often reached over
+// plain HTTP.
+type client struct {
+	server string
+	token  string
+	http   *http.Client
+}
+
+// apiError is an error answer of the server
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Status)
+}
+
+// stateDir is where the login and the uploads to resume are kept
+func stateDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("error finding config directory: %w", err)
+	}
+	return filepath.Join(dir, "dekho"), nil
+}
+
+// readState decodes a file of the state directory into value, leaving it
+// untouched when the file does not exist yet
+func readState(name string, value any) error {
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", name, err)
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("error reading %s: %w", name, err)
+	}
+	return nil
+}
+
+// writeState writes a file of the state directory that only the user can
+// read, since it may hold their login
+func writeState(name string, value any) error {
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("error creating %s: %w", dir, err)
+	}
+
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+		return fmt.Errorf("error writing %s: %w", name, err)
+	}
+	return nil
+}
+
+// newClient returns a client for the stored login
+func newClient() (*client, error) {
+	var stored credentials
+	if err := readState("credentials.json", &stored); err != nil {
+		return nil, err
+	}
+	if stored.Token == "" {
+		return nil, errors.New("not logged in, run dekho login first")
+	}
+	return &client{server: stored.Server, token: stored.Token, http: &http.Client{}}, nil
+}
+
+func (c *client) newRequest(method string, path string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequest(method, c.server+path, body)
+	if err != nil {
+		return nil, err
+	}
+	request.AddCookie(&http.Cookie{Name: "auth_token", Value: c.token})
+	return request, nil
+}
+
+// doJSON sends a request with an optional JSON body and decodes the JSON
+// answer into result, unless it is nil
+func (c *client) doJSON(method string, path string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	request, err := c.newRequest(method, path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 400 {
+		return readAPIError(response)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return fmt.Errorf("error reading answer of %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+// readAPIError turns an error answer into an *apiError. Most answers are
+// {"error": "..."}, the rest are shown as they are.
+func readAPIError(response *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+
+	var answer struct {
+		Error string `json:"error"`
+	}
+	message := strings.TrimSpace(string(data))
+	if json.Unmarshal(data, &answer) == nil && answer.Error != "" {
+		message = answer.Error
+	}
+	if message == "" {
+		message = http.StatusText(response.StatusCode)
+	}
+	return &apiError{Status: response.StatusCode, Message: message}
+}
+
+// readLine reads a line from stdin, for passwords piped in by scripts
+func readLine() (string, error) {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"video-streaming-server/types"
+)
+
+// event is a server-sent event, its data is JSON
+type event struct {
+	Name string
+	Data string
+}
+
+// eventStream is the connection to /server-events/
+type eventStream struct {
+	response *http.Response
+	scanner  *bufio.Scanner
+}
+
+// openEvents connects to the event stream. The server keeps track of
+// connections by the page they were opened from, which for the CLI is /cli.
+func openEvents(ctx context.Context, c *client) (*eventStream, error) {
+	request, err := c.newRequest(http.MethodGet, "/server-events/", nil)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Accept", "text/event-stream")
+	request.Header.Set("Referer", c.server+"/cli")
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		return nil, readAPIError(response)
+	}
+
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return &eventStream{response: response, scanner: scanner}, nil
+}
+
+// next blocks until the next event arrives
+func (s *eventStream) next() (*event, error) {
+	var current event
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		switch {
+		case line == "":
+			if current.Name != "" || current.Data != "" {
+				return &current, nil
+			}
+		case strings.HasPrefix(line, "event:"):
+			current.Name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if current.Data != "" {
+				current.Data += "\n"
+			}
+			current.Data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("the server closed the event stream")
+}
+
+func (s *eventStream) close() {
+	s.response.Body.Close()
+}
+
+func runEvents() error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	stream, err := openEvents(context.Background(), c)
+	if err != nil {
+		return err
+	}
+	defer stream.close()
+
+	for {
+		next, err := stream.next()
+		if err != nil {
+			return err
+		}
+		fmt.Println(next.Name, next.Data)
+	}
+}
+
+func runWait(args []string) error {
+	flags := flag.NewFlagSet("wait", flag.ContinueOnError)
+	timeout := flags.Duration("timeout", 0, "give up after this long, 0 waits forever")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("wait takes at least one video ID\n%s", usage)
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	return waitForVideos(c, flags.Args(), *timeout)
+}
+
+// waitForVideos follows the progress of videos until each is processed or
+// has failed. The stream is opened before the current state of the videos
+// is looked up, so no change can slip through in between.
+func waitForVideos(c *client, videoIDs []string, timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	stream, err := openEvents(ctx, c)
+	if err != nil {
+		return err
+	}
+	defer stream.close()
+
+	var videos []types.VideoResponseType
+	if err := c.doJSON(http.MethodGet, "/video/", nil, &videos); err != nil {
+		return err
+	}
+
+	waiting := make(map[string]bool)
+	for _, videoID := range videoIDs {
+		waiting[videoID] = true
+	}
+	failed := 0
+	finish := func(video types.VideoResponseType) {
+		if !waiting[video.ID] || video.Status == types.UploadPending || video.Status == types.UploadedOnServer {
+			return
+		}
+		delete(waiting, video.ID)
+		fmt.Println(video.ID, statusName(video.Status), video.FailureReason)
+		if video.Status != types.ProcessingCompleted {
+			failed++
+		}
+	}
+
+	for _, video := range videos {
+		finish(video)
+	}
+
+	for len(waiting) > 0 {
+		next, err := stream.next()
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("gave up waiting after %v", timeout)
+			}
+			return err
+		}
+
+		switch next.Name {
+		case "video_status":
+			var video types.VideoResponseType
+			if err := json.Unmarshal([]byte(next.Data), &video); err == nil {
+				finish(video)
+			}
+		case "video_progress":
+			var progress types.VideoProgressType
+			if err := json.Unmarshal([]byte(next.Data), &progress); err == nil && waiting[progress.ID] {
+				fmt.Fprintf(os.Stderr, "%s %s %d%%\n", progress.ID, progress.Stage, progress.Percent)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d videos failed", failed, len(videoIDs))
+	}
+	return nil
+}
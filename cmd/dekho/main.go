@@ -0,0 +1,62 @@
+// Command dekho uploads and manages videos on a video streaming server
+// from the command line, e.g. from lecture capture machines.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+const usage = `usage: dekho <command> [flags]
+
+commands:
+  login [--server URL] --email EMAIL     log in, the password is read from DEKHO_PASSWORD or stdin
+  logout                                 forget the stored login
+  upload [--title T] [--description D] [--chunk-size BYTES] [--wait] FILE
+                                         upload a video, resuming an upload of the same file that was cut off
+  list [--json]                          list your videos
+  edit [--title T] [--description D] ID  change the title or description of a video
+  delete ID                              delete a video
+  wait [--timeout DURATION] ID...        wait until videos are processed, fails when one of them failed
+  events                                 print the server's events as they come`
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "dekho:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no command given\n%s", usage)
+	}
+
+	switch args[0] {
+	case "login":
+		return runLogin(args[1:])
+	case "logout":
+		return runLogout()
+	case "upload":
+		return runUpload(args[1:])
+	case "list":
+		return runList(args[1:])
+	case "edit":
+		return runEdit(args[1:])
+	case "delete":
+		return runDelete(args[1:])
+	case "wait":
+		return runWait(args[1:])
+	case "events":
+		return runEvents()
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxRetries is how often a chunk is sent again after a network or server
+// error, waiting a second longer each time, like the upload page does
+const maxRetries = 5
+
+// pendingUpload is an upload that has not finished, kept so it can be
+// resumed by uploading the same file again
+type pendingUpload struct {
+	VideoID   string `json:"video_id"`
+	File      string `json:"file"`
+	ChunkSize int64  `json:"chunk_size"`
+}
+
+// upload is a file being sent in chunks, see UploadVideo on the server
+type upload struct {
+	client      *client
+	file        *os.File
+	size        int64
+	sum         string
+	videoID     string
+	title       string
+	description string
+	chunkSize   int64
+}
+
+func runUpload(args []string) error {
+	flags := flag.NewFlagSet("upload", flag.ContinueOnError)
+	title := flags.String("title", "", "title of the video, defaults to the file name")
+	description := flags.String("description", "", "description of the video")
+	chunkSize := flags.Int64("chunk-size", 1024*1024, "size of the chunks the file is sent in")
+	wait := flags.Bool("wait", false, "wait until the video is processed")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("upload takes one file\n%s", usage)
+	}
+	if *chunkSize < 1 {
+		return fmt.Errorf("--chunk-size must be at least 1\n%s", usage)
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	filePath := flags.Arg(0)
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	u := &upload{
+		client:      c,
+		file:        file,
+		size:        info.Size(),
+		title:       *title,
+		description: *description,
+		chunkSize:   *chunkSize,
+	}
+	if u.title == "" {
+		u.title = strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+	}
+
+	if u.sum, err = fileSHA256(file); err != nil {
+		return fmt.Errorf("error hashing %s: %w", filePath, err)
+	}
+
+	pending := make(map[string]pendingUpload)
+	if err := readState("uploads.json", &pending); err != nil {
+		return err
+	}
+
+	// an upload of the same content that was cut off is picked up where
+	// the server left it, with the chunk size it was started with since
+	// chunks the server has are only recognised when sent the same way
+	resumed, found := pending[u.sum]
+	if found {
+		u.videoID, u.chunkSize = resumed.VideoID, resumed.ChunkSize
+		fmt.Fprintln(os.Stderr, "resuming upload of", filePath)
+		err = u.send()
+
+		var rejected *apiError
+		if errors.As(err, &rejected) && (rejected.Status == http.StatusNotFound || rejected.Status == http.StatusGone || rejected.Status >= 500) {
+			// the server lost track of the upload, e.g. because it was
+			// cancelled or cleaned up, so it is started over
+			fmt.Fprintln(os.Stderr, "could not resume, starting over:", rejected.Message)
+			found = false
+		}
+	}
+	if !found {
+		u.videoID, u.chunkSize = uuid.NewString(), *chunkSize
+		pending[u.sum] = pendingUpload{VideoID: u.videoID, File: filePath, ChunkSize: u.chunkSize}
+		if err := writeState("uploads.json", pending); err != nil {
+			return err
+		}
+		err = u.send()
+	}
+
+	var rejected *apiError
+	if err == nil || (errors.As(err, &rejected) && rejected.Status < 500) {
+		// finished, or refused in a way sending it again does not fix
+		delete(pending, u.sum)
+		if stateErr := writeState("uploads.json", pending); stateErr != nil {
+			fmt.Fprintln(os.Stderr, "dekho:", stateErr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(u.videoID)
+	if *wait {
+		return waitForVideos(c, []string{u.videoID}, 0)
+	}
+	return nil
+}
+
+// send sends the file from where the server has it to the end. The first
+// chunk is always sent, the server answers it with how much of the file it
+// already has when the upload is resumed.
+func (u *upload) send() error {
+	chunk := make([]byte, u.chunkSize)
+	var offset int64
+	retries := 0
+	for {
+		n, err := u.file.ReadAt(chunk, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		received, err := u.sendChunk(chunk[:n], offset)
+		if err != nil {
+			var rejected *apiError
+			if (errors.As(err, &rejected) && rejected.Status < 500) || retries >= maxRetries {
+				return err
+			}
+			retries++
+			fmt.Fprintf(os.Stderr, "error sending chunk, retrying: %v\n", err)
+			time.Sleep(time.Duration(retries) * time.Second)
+			continue
+		}
+
+		retries = 0
+		offset = received
+		fmt.Fprintf(os.Stderr, "\ruploaded %d%%", offset*100/max(u.size, 1))
+		if offset >= u.size {
+			fmt.Fprintln(os.Stderr)
+			return nil
+		}
+	}
+}
+
+// sendChunk sends a chunk and returns how much of the file the server has
+func (u *upload) sendChunk(data []byte, offset int64) (int64, error) {
+	request, err := u.client.newRequest(http.MethodPost, "/video/", bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+
+	chunkSum := sha256.Sum256(data)
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("file-name", u.videoID)
+	request.Header.Set("file-size", strconv.FormatInt(u.size, 10))
+	request.Header.Set("file-sha256", u.sum)
+	request.Header.Set("file-extension", filepath.Ext(u.file.Name()))
+	request.Header.Set("first-chunk", strconv.FormatBool(offset == 0))
+	request.Header.Set("chunk-offset", strconv.FormatInt(offset, 10))
+	request.Header.Set("chunk-sha256", hex.EncodeToString(chunkSum[:]))
+	request.Header.Set("title", u.title)
+	request.Header.Set("description", u.description)
+
+	response, err := u.client.http.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	// a chunk the server did not expect is answered with where it wants
+	// the next one to start
+	if response.StatusCode < 300 || response.StatusCode == http.StatusConflict {
+		received, err := strconv.ParseInt(response.Header.Get("upload-offset"), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid upload-offset in answer: %w", err)
+		}
+		return received, nil
+	}
+	return 0, readAPIError(response)
+}
+
+func fileSHA256(file *os.File) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, 1<<62)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"video-streaming-server/types"
+)
+
+func runLogin(args []string) error {
+	flags := flag.NewFlagSet("login", flag.ContinueOnError)
+	server := flags.String("server", envOr("DEKHO_SERVER", "http://localhost:8000"), "address of the server, defaults to DEKHO_SERVER")
+	email := flags.String("email", "", "email address to log in with")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *email == "" {
+		return fmt.Errorf("--email is required\n%s", usage)
+	}
+
+	password := os.Getenv("DEKHO_PASSWORD")
+	if password == "" {
+		fmt.Fprint(os.Stderr, "password: ")
+		var err error
+		if password, err = readLine(); err != nil {
+			return fmt.Errorf("error reading password: %w", err)
+		}
+	}
+
+	body, err := json.Marshal(map[string]string{"email": *email, "password": password})
+	if err != nil {
+		return err
+	}
+
+	serverURL := strings.TrimRight(*server, "/")
+	response, err := http.Post(serverURL+"/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return readAPIError(response)
+	}
+
+	for _, cookie := range response.Cookies() {
+		if cookie.Name == "auth_token" && cookie.Value != "" {
+			if err := writeState("credentials.json", credentials{Server: serverURL, Token: cookie.Value}); err != nil {
+				return err
+			}
+			fmt.Println("logged in to", serverURL)
+			return nil
+		}
+	}
+	return errors.New("the server did not return a login token")
+}
+
+func runLogout() error {
+	return writeState("credentials.json", credentials{})
+}
+
+func runList(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the videos as JSON")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	var videos []types.VideoResponseType
+	if err := c.doJSON(http.MethodGet, "/video/", nil, &videos); err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(videos)
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tSTATUS\tTITLE")
+	for _, video := range videos {
+		status := statusName(video.Status)
+		if video.FailureReason != "" {
+			status += ": " + video.FailureReason
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\n", video.ID, status, video.Title)
+	}
+	return table.Flush()
+}
+
+func runEdit(args []string) error {
+	flags := flag.NewFlagSet("edit", flag.ContinueOnError)
+	title := flags.String("title", "", "new title")
+	description := flags.String("description", "", "new description")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("edit takes one video ID\n%s", usage)
+	}
+
+	// the server replaces both, so what is not changed is sent as it is
+	changed := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { changed[f.Name] = true })
+	if len(changed) == 0 {
+		return fmt.Errorf("nothing to change, give --title or --description\n%s", usage)
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	videoID := flags.Arg(0)
+	var video types.Video
+	if err := c.doJSON(http.MethodGet, "/video/"+videoID, nil, &video); err != nil {
+		return err
+	}
+
+	update := types.UpdateRequest{Title: video.Title, Description: video.Description}
+	if changed["title"] {
+		update.Title = *title
+	}
+	if changed["description"] {
+		update.Description = *description
+	}
+	if strings.TrimSpace(update.Title) == "" {
+		return errors.New("the title cannot be empty")
+	}
+
+	return c.doJSON(http.MethodPatch, "/video/"+videoID, update, nil)
+}
+
+func runDelete(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("delete takes one video ID\n%s", usage)
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	return c.doJSON(http.MethodDelete, "/video/"+args[0], nil, nil)
+}
+
+func statusName(status types.VideoStatus) string {
+	switch status {
+	case types.Cancelled:
+		return "cancelled"
+	case types.ProcessingFailed:
+		return "failed"
+	case types.UploadPending:
+		return "uploading"
+	case types.UploadedOnServer:
+		return "processing"
+	case types.ProcessingCompleted:
+		return "ready"
+	default:
+		return fmt.Sprintf("status %d", status)
+	}
+}
+
+func envOr(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,26 @@
+package commands
+
+import (
+	"fmt"
+)
+
+const usage = `usage: main <command> [flags]
+  storage migrate (--to-dir DIR | --to-bucket BUCKET [--to-backend appwrite|s3] [--to-prefix PREFIX])
+  uploads gc [--ttl DURATION]`
+
+// Run executes an admin command given on the command line instead of
+// starting the server
+func Run(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no command given\n%s", usage)
+	}
+
+	switch args[0] {
+	case "storage":
+		return runStorageCommand(args[1:])
+	case "uploads":
+		return runUploadsCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
@@ -0,0 +1,272 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"video-streaming-server/config"
+	"video-streaming-server/database"
+	"video-streaming-server/shared/logger"
+	"video-streaming-server/storage"
+	"video-streaming-server/types"
+	"video-streaming-server/utils"
+)
+
+func runStorageCommand(args []string) error {
+	if len(args) == 0 || args[0] != "migrate" {
+		return fmt.Errorf("unknown storage command\n%s", usage)
+	}
+
+	flags := flag.NewFlagSet("storage migrate", flag.ContinueOnError)
+	toDir := flags.String("to-dir", "", "copy the library to a directory on local disk")
+	toBucket := flags.String("to-bucket", "", "copy the library to another bucket")
+	toBackend := flags.String("to-backend", "", "backend of the target bucket, defaults to STORAGE_BACKEND")
+	toPrefix := flags.String("to-prefix", "", "key prefix inside the target bucket (s3 only)")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if (*toDir == "") == (*toBucket == "") {
+		return fmt.Errorf("exactly one of --to-dir and --to-bucket is required\n%s", usage)
+	}
+
+	target, targetName, err := targetStore(*toDir, *toBucket, *toBackend, *toPrefix)
+	if err != nil {
+		return err
+	}
+
+	source, err := storage.GetStore()
+	if err != nil {
+		return err
+	}
+
+	db, err := database.GetDBConn()
+	if err != nil {
+		return err
+	}
+
+	return migrateStorage(context.Background(), db, source, target, targetName)
+}
+
+// targetStore builds the store a library is migrated to. Buckets use the
+// credentials of the current configuration.
+func targetStore(toDir, toBucket, toBackend, toPrefix string) (storage.ObjectStore, string, error) {
+	if toDir != "" {
+		absDir, err := filepath.Abs(toDir)
+		if err != nil {
+			return nil, "", fmt.Errorf("error resolving target directory: %w", err)
+		}
+		store, err := storage.NewLocalStore(absDir)
+		return store, "local:" + absDir, err
+	}
+
+	targetConfig := *config.AppConfig
+	if toBackend != "" {
+		targetConfig.StorageBackend = toBackend
+	}
+
+	switch targetConfig.StorageBackend {
+	case "", "appwrite":
+		targetConfig.StorageBackend = "appwrite"
+		targetConfig.AppwriteBucketID = toBucket
+	case "s3":
+		targetConfig.S3Bucket = toBucket
+		targetConfig.S3Prefix = toPrefix
+	default:
+		return nil, "", fmt.Errorf("cannot migrate to a bucket of the %s backend", targetConfig.StorageBackend)
+	}
+
+	store, err := storage.New(&targetConfig)
+	return store, targetConfig.StorageBackend + ":" + toBucket + "/" + toPrefix, err
+}
+
+// migrateStorage copies every processed video to the target store. Videos
+// are recorded in storage_migrations once they are fully copied, so an
+// interrupted run picks up where it stopped.
+func migrateStorage(ctx context.Context, db *sql.DB, source storage.ObjectStore, target storage.ObjectStore, targetName string) error {
+	migrationLogger := logger.Log.With("target", targetName)
+
+	rows, err := db.Query(`
+		SELECT
+			video_id, COALESCE(storage_id, video_id), thumbnail
+		FROM
+			videos
+		WHERE
+			status=$1
+		AND
+			video_id NOT IN (SELECT video_id FROM storage_migrations WHERE target=$2)
+		ORDER BY
+			upload_initiate_time;
+	`, types.ProcessingCompleted, targetName)
+
+	if err != nil {
+		return fmt.Errorf("error querying videos to migrate: %w", err)
+	}
+
+	type pendingVideo struct {
+		id        string
+		storageID string
+		thumbnail sql.NullString
+	}
+
+	videos := make([]pendingVideo, 0)
+	for rows.Next() {
+		var video pendingVideo
+		if err := rows.Scan(&video.id, &video.storageID, &video.thumbnail); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning video row: %w", err)
+		}
+		videos = append(videos, video)
+	}
+	rows.Close()
+
+	migrationLogger.Info("migrating videos", "count", len(videos))
+
+	failed := 0
+	for i, video := range videos {
+		videoLogger := migrationLogger.With("video_id", video.id, "progress", fmt.Sprintf("%d/%d", i+1, len(videos)))
+
+		err := migrateVideo(ctx, db, source, target, targetName, video.id, video.storageID, video.thumbnail.Valid && video.thumbnail.String != "", videoLogger)
+		if err != nil {
+			videoLogger.Error("error migrating video", "error", err)
+			failed++
+			continue
+		}
+
+		videoLogger.Info("video migrated")
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d videos could not be migrated, run the command again to retry them", failed, len(videos))
+	}
+
+	migrationLogger.Info("storage migration complete", "videos", len(videos))
+	return nil
+}
+
+// migrateVideo copies the stored output a video plays, which videos with
+// the same content share, so it may have been copied already
+func migrateVideo(ctx context.Context, db *sql.DB, source storage.ObjectStore, target storage.ObjectStore, targetName string, videoID string, storageID string, hasThumbnail bool, videoLogger *slog.Logger) error {
+	keys, err := utils.VideoObjectKeys(ctx, source, storageID)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		copied, err := copyObject(ctx, source, target, key)
+		if err != nil {
+			return fmt.Errorf("error copying %s: %w", key, err)
+		}
+		videoLogger.Debug("object migrated", "key", key, "copied", copied)
+	}
+
+	if hasThumbnail {
+		_, err := copyObject(ctx, source, target, storage.ThumbnailKey(storageID))
+		if errors.Is(err, storage.ErrNotFound) {
+			videoLogger.Warn("thumbnail missing in source store, keeping the stored URL")
+			hasThumbnail = false
+		} else if err != nil {
+			return fmt.Errorf("error copying thumbnail: %w", err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if hasThumbnail {
+		_, err = tx.Exec(`UPDATE videos SET thumbnail=$1 WHERE video_id=$2;`, utils.ThumbnailURL(target, storageID), videoID)
+		if err != nil {
+			return fmt.Errorf("error updating thumbnail URL: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO
+			storage_migrations (video_id, target)
+		VALUES
+			($1, $2)
+		ON CONFLICT DO NOTHING;
+	`, videoID, targetName)
+	if err != nil {
+		return fmt.Errorf("error recording migrated video: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// copyObject copies a single object and reads it back from the target to
+// verify it. Objects a previous run already copied intact are skipped, in
+// which case false is returned.
+func copyObject(ctx context.Context, source storage.ObjectStore, target storage.ObjectStore, key string) (bool, error) {
+	sourceInfo, err := source.Stat(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	if targetInfo, err := target.Stat(ctx, key); err == nil && targetInfo.Size == sourceInfo.Size {
+		sourceSum, err := checksum(ctx, source, key)
+		if err != nil {
+			return false, err
+		}
+		if targetSum, err := checksum(ctx, target, key); err == nil && bytes.Equal(sourceSum, targetSum) {
+			return false, nil
+		}
+	} else if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return false, err
+	}
+
+	body, _, err := source.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+
+	hash := sha256.New()
+	err = target.Put(ctx, key, io.TeeReader(body, hash), sourceInfo.Size, utils.ContentTypeOf(key))
+	if err != nil {
+		return false, err
+	}
+
+	targetInfo, err := target.Stat(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("error verifying copy: %w", err)
+	}
+	if targetInfo.Size != sourceInfo.Size {
+		return false, fmt.Errorf("size mismatch after copy: source has %d bytes, target has %d", sourceInfo.Size, targetInfo.Size)
+	}
+
+	targetSum, err := checksum(ctx, target, key)
+	if err != nil {
+		return false, fmt.Errorf("error verifying copy: %w", err)
+	}
+	if !bytes.Equal(hash.Sum(nil), targetSum) {
+		return false, fmt.Errorf("checksum mismatch after copy")
+	}
+
+	return true, nil
+}
+
+func checksum(ctx context.Context, store storage.ObjectStore, key string) ([]byte, error) {
+	body, _, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", key, err)
+	}
+	return hash.Sum(nil), nil
+}
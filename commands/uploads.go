@@ -0,0 +1,52 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"video-streaming-server/config"
+	"video-streaming-server/database"
+	"video-streaming-server/jobs"
+)
+
+// runUploadsCommand runs the upload reaper once, for when the periodic one
+// is disabled or a different TTL is wanted
+func runUploadsCommand(args []string) error {
+	if len(args) == 0 || args[0] != "gc" {
+		return fmt.Errorf("unknown uploads command\n%s", usage)
+	}
+
+	flags := flag.NewFlagSet("uploads gc", flag.ContinueOnError)
+	ttl := flags.Duration("ttl", config.AppConfig.UploadGCTTL, "remove uploads untouched for this long, defaults to UPLOAD_GC_TTL")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if *ttl <= 0 {
+		return fmt.Errorf("--ttl must be positive\n%s", usage)
+	}
+
+	db, err := database.GetDBConn()
+	if err != nil {
+		return err
+	}
+
+	report, err := jobs.Reap(context.Background(), db, *ttl)
+	if err != nil {
+		return err
+	}
+
+	for _, videoID := range report.Videos {
+		fmt.Println("removed upload", videoID)
+	}
+	for _, path := range report.OrphanedPaths {
+		fmt.Println("removed orphaned path", path)
+	}
+	fmt.Printf("%d uploads and %d orphaned paths removed, %d failed\n", len(report.Videos), len(report.OrphanedPaths), report.Failed)
+
+	if report.Failed > 0 {
+		return fmt.Errorf("%d uploads could not be removed", report.Failed)
+	}
+	return nil
+}
@@ -2,13 +2,17 @@ package config
 
 import (
 	"bufio"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"log/slog"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type FileType struct {
@@ -20,8 +24,41 @@ type ConfigResponse struct {
 	SupportedFileTypes []FileType `json:"supported_file_types"`
 }
 
+// SupportedFileTypes are the containers uploads are accepted in, the
+// server checks an upload's content against them and not just its name
+var SupportedFileTypes = []FileType{
+	{FileType: "video/mp4", FileExtension: ".mp4"},
+	{FileType: "video/x-matroska", FileExtension: ".mkv"},
+	{FileType: "video/quicktime", FileExtension: ".mov"},
+}
+
+// Rendition is one rung of the adaptive bitrate ladder, bitrates are in
+// kbit/s
+type Rendition struct {
+	Name         string
+	Width        int
+	Height       int
+	VideoBitrate int
+	AudioBitrate int
+}
+
+const DefaultRenditionLadder = "1080p:1920x1080:5000:192,720p:1280x720:2800:128,480p:854x480:1400:128,360p:640x360:800:96"
+
 type Config struct {
 	RootPath               string
+	StorageBackend         string
+	StorageLocalRoot       string
+	AppwriteEndpoint       string
+	S3Endpoint             string
+	S3Region               string
+	S3Bucket               string
+	S3Prefix               string
+	S3AccessKey            string
+	S3SecretKey            string
+	S3PathStyle            bool
+	S3PresignExpiry        time.Duration
+	ObjectCacheDir         string
+	ObjectCacheSize        int64
 	AppwriteBucketID       string
 	AppwriteProjectID      string
 	AppwriteKey            string
@@ -36,6 +73,29 @@ type Config struct {
 	SSLMode                string
 	JWTSecretKey           string
 	FileSizeLimit          string
+	RenditionLadder        []Rendition
+	HLSSegmentType         string
+	DashEnabled            bool
+	HLSEncryption          bool
+	HLSKeyRotation         int
+	JobWorkers             int
+	JobLease               time.Duration
+	JobMaxAttempts         int
+	TusUploadExpiry        time.Duration
+	UploadGCTTL            time.Duration
+	UploadGCInterval       time.Duration
+	DedupScope             string
+	ImportTimeout          time.Duration
+	ImportAllowPrivate     bool
+	BatchSizeLimit         int64
+	PlaybackTokenSecret    string
+	PlaybackTokenExpiry    time.Duration
+	PlaybackTokenBindIP    bool
+	LiveEnabled            bool
+	LiveHost               string
+	LivePortMin            int
+	LivePortMax            int
+	LiveWaitTimeout        time.Duration
 	Debug                  bool
 }
 
@@ -76,6 +136,108 @@ func LoadEnvFile(filename string) error {
 	return nil
 }
 
+// ParseRenditionLadder parses a comma separated list of renditions, each
+// written as name:WIDTHxHEIGHT:videoKbps:audioKbps
+func ParseRenditionLadder(value string) ([]Rendition, error) {
+	ladder := make([]Rendition, 0)
+
+	for _, entry := range strings.Split(value, ",") {
+		fields := strings.Split(strings.TrimSpace(entry), ":")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid rendition %q, expected name:WIDTHxHEIGHT:videoKbps:audioKbps", entry)
+		}
+
+		width, height, found := strings.Cut(fields[1], "x")
+		if !found {
+			return nil, fmt.Errorf("invalid resolution %q in rendition %s", fields[1], fields[0])
+		}
+
+		if !isRenditionName(fields[0]) {
+			return nil, fmt.Errorf("invalid rendition name %q, only lowercase letters and digits are allowed", fields[0])
+		}
+
+		rendition := Rendition{Name: fields[0]}
+		var err error
+		for _, field := range []struct {
+			value  string
+			target *int
+		}{
+			{width, &rendition.Width},
+			{height, &rendition.Height},
+			{fields[2], &rendition.VideoBitrate},
+			{fields[3], &rendition.AudioBitrate},
+		} {
+			*field.target, err = strconv.Atoi(field.value)
+			if err != nil || *field.target <= 0 {
+				return nil, fmt.Errorf("invalid number %q in rendition %s", field.value, fields[0])
+			}
+		}
+
+		ladder = append(ladder, rendition)
+	}
+
+	return ladder, nil
+}
+
+// rendition names end up in segment file names and URLs
+func isRenditionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// getBoolEnv parses an optional boolean environment variable
+func getBoolEnv(key string, fallback bool) (bool, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("error parsing %s environment variable: %w", key, err)
+	}
+	return parsed, nil
+}
+
+// getIntEnv parses an optional integer environment variable that must be
+// at least 1
+func getIntEnv(key string, fallback int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %s environment variable: %w", key, err)
+	}
+	if parsed < 1 {
+		return 0, fmt.Errorf("%s must be at least 1", key)
+	}
+	return parsed, nil
+}
+
+// getDurationEnv parses an optional duration environment variable, e.g. 15m
+func getDurationEnv(key string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %s environment variable: %w", key, err)
+	}
+	return parsed, nil
+}
+
 func LoadConfig(envFile string) error {
 	if err := LoadEnvFile(envFile); err != nil {
 		return err
@@ -86,8 +248,199 @@ func LoadConfig(envFile string) error {
 		return fmt.Errorf("error parsing DEBUG environment variable: %w", err)
 	}
 
+	s3PathStyle, err := getBoolEnv("S3_PATH_STYLE", false)
+	if err != nil {
+		return err
+	}
+
+	s3PresignExpiry, err := getDurationEnv("S3_PRESIGN_EXPIRY", 0)
+	if err != nil {
+		return err
+	}
+
+	dashEnabled, err := getBoolEnv("DASH_ENABLED", false)
+	if err != nil {
+		return err
+	}
+
+	// segments are encrypted with AES-128, with a new key every
+	// HLS_KEY_ROTATION segments, or one key per video when it is 0
+	hlsEncryption, err := getBoolEnv("HLS_ENCRYPTION", false)
+	if err != nil {
+		return err
+	}
+	if hlsEncryption && dashEnabled {
+		return fmt.Errorf("DASH_ENABLED cannot be combined with HLS_ENCRYPTION, the DASH output would not be encrypted")
+	}
+
+	hlsKeyRotation := 0
+	if value := os.Getenv("HLS_KEY_ROTATION"); value != "" {
+		hlsKeyRotation, err = strconv.Atoi(value)
+		if err != nil || hlsKeyRotation < 0 {
+			return fmt.Errorf("invalid HLS_KEY_ROTATION %q, expected a number of segments", value)
+		}
+	}
+
+	jobWorkers, err := getIntEnv("JOB_WORKERS", 2)
+	if err != nil {
+		return err
+	}
+
+	jobMaxAttempts, err := getIntEnv("JOB_MAX_ATTEMPTS", 3)
+	if err != nil {
+		return err
+	}
+
+	// workers renew their lease every third of it
+	jobLease, err := getDurationEnv("JOB_LEASE", 2*time.Minute)
+	if err != nil {
+		return err
+	}
+	if jobLease < 3*time.Second {
+		return fmt.Errorf("JOB_LEASE must be at least 3s")
+	}
+
+	tusUploadExpiry, err := getDurationEnv("TUS_UPLOAD_EXPIRY", 24*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	// abandoned uploads are removed once untouched for UPLOAD_GC_TTL, the
+	// reaper is off when either is 0
+	uploadGCTTL, err := getDurationEnv("UPLOAD_GC_TTL", 72*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	uploadGCInterval, err := getDurationEnv("UPLOAD_GC_INTERVAL", time.Hour)
+	if err != nil {
+		return err
+	}
+
+	hlsSegmentType := os.Getenv("HLS_SEGMENT_TYPE")
+	switch hlsSegmentType {
+	case "":
+		hlsSegmentType = "mpegts"
+	case "mpegts", "fmp4":
+	default:
+		return fmt.Errorf("invalid HLS_SEGMENT_TYPE %q, expected mpegts or fmp4", hlsSegmentType)
+	}
+
+	importTimeout, err := getDurationEnv("IMPORT_TIMEOUT", 30*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	// imports from loopback and private addresses are only useful when
+	// testing, elsewhere they would let users reach internal services
+	importAllowPrivate, err := getBoolEnv("IMPORT_ALLOW_PRIVATE", false)
+	if err != nil {
+		return err
+	}
+
+	// remotely stored objects are kept on local disk up to this many
+	// bytes, 0 turns the cache off
+	objectCacheSize := int64(1024 * 1024 * 1024)
+	if value := os.Getenv("OBJECT_CACHE_SIZE"); value != "" {
+		objectCacheSize, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || objectCacheSize < 0 {
+			return fmt.Errorf("invalid OBJECT_CACHE_SIZE %q, expected a number of bytes", value)
+		}
+	}
+
+	// the archive of a bulk upload, the videos in it are each held to
+	// FILE_SIZE_LIMIT
+	batchSizeLimit, err := getIntEnv("BATCH_SIZE_LIMIT", 2*1024*1024*1024)
+	if err != nil {
+		return err
+	}
+
+	// playback tokens have to outlast a lecture, since players fetch the
+	// playlists of a video once and its segments for as long as it plays
+	playbackTokenExpiry, err := getDurationEnv("PLAYBACK_TOKEN_EXPIRY", 6*time.Hour)
+	if err != nil {
+		return err
+	}
+	if playbackTokenExpiry <= 0 {
+		return fmt.Errorf("PLAYBACK_TOKEN_EXPIRY must be positive")
+	}
+
+	// binding tokens to the address they were issued to stops shared links
+	// from working elsewhere, but also breaks playback on networks where
+	// the address changes, like mobile ones
+	playbackTokenBindIP, err := getBoolEnv("PLAYBACK_TOKEN_BIND_IP", false)
+	if err != nil {
+		return err
+	}
+
+	// live streams are published to an ffmpeg listening on a port of
+	// LIVE_PORTS of its own, over SRT
+	liveEnabled, err := getBoolEnv("LIVE_ENABLED", false)
+	if err != nil {
+		return err
+	}
+
+	liveHost := os.Getenv("LIVE_HOST")
+	if liveHost == "" {
+		liveHost = "localhost"
+	}
+
+	livePortMin, livePortMax := 19350, 19359
+	if value := os.Getenv("LIVE_PORTS"); value != "" {
+		first, last, _ := strings.Cut(value, "-")
+		if last == "" {
+			last = first
+		}
+		livePortMin, err = strconv.Atoi(strings.TrimSpace(first))
+		if err == nil {
+			livePortMax, err = strconv.Atoi(strings.TrimSpace(last))
+		}
+		if err != nil || livePortMin < 1 || livePortMax > 65535 || livePortMin > livePortMax {
+			return fmt.Errorf("invalid LIVE_PORTS %q, expected a port or a range like 19350-19359", value)
+		}
+	}
+
+	// how long a live stream waits for its publisher before it is given up
+	liveWaitTimeout, err := getDurationEnv("LIVE_WAIT_TIMEOUT", 15*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	// identical uploads reuse the processed output of the same user's
+	// videos, of everyone's, or are always processed again
+	dedupScope := os.Getenv("DEDUP_SCOPE")
+	switch dedupScope {
+	case "":
+		dedupScope = "user"
+	case "user", "global", "off":
+	default:
+		return fmt.Errorf("invalid DEDUP_SCOPE %q, expected user, global or off", dedupScope)
+	}
+
+	ladder := os.Getenv("TRANSCODE_LADDER")
+	if ladder == "" {
+		ladder = DefaultRenditionLadder
+	}
+	renditionLadder, err := ParseRenditionLadder(ladder)
+	if err != nil {
+		return fmt.Errorf("error parsing TRANSCODE_LADDER environment variable: %w", err)
+	}
+
 	config := &Config{
 		RootPath:               os.Getenv("ROOT_PATH"),
+		StorageBackend:         os.Getenv("STORAGE_BACKEND"),
+		StorageLocalRoot:       os.Getenv("STORAGE_LOCAL_ROOT"),
+		AppwriteEndpoint:       os.Getenv("APPWRITE_ENDPOINT"),
+		S3Endpoint:             os.Getenv("S3_ENDPOINT"),
+		S3Region:               os.Getenv("S3_REGION"),
+		S3Bucket:               os.Getenv("S3_BUCKET"),
+		S3Prefix:               os.Getenv("S3_PREFIX"),
+		S3AccessKey:            os.Getenv("S3_ACCESS_KEY"),
+		S3SecretKey:            os.Getenv("S3_SECRET_KEY"),
+		S3PathStyle:            s3PathStyle,
+		S3PresignExpiry:        s3PresignExpiry,
+		ObjectCacheDir:         os.Getenv("OBJECT_CACHE_DIR"),
+		ObjectCacheSize:        objectCacheSize,
 		AppwriteBucketID:       os.Getenv("BUCKET_ID"),
 		AppwriteProjectID:      os.Getenv("APPWRITE_PROJECT_ID"),
 		AppwriteKey:            os.Getenv("APPWRITE_KEY"),
@@ -102,6 +455,29 @@ func LoadConfig(envFile string) error {
 		SSLMode:                os.Getenv("SSL_MODE"),
 		JWTSecretKey:           os.Getenv("JWT_SECRET_KEY"),
 		FileSizeLimit:          os.Getenv("FILE_SIZE_LIMIT"),
+		RenditionLadder:        renditionLadder,
+		HLSSegmentType:         hlsSegmentType,
+		DashEnabled:            dashEnabled,
+		HLSEncryption:          hlsEncryption,
+		HLSKeyRotation:         hlsKeyRotation,
+		JobWorkers:             jobWorkers,
+		JobLease:               jobLease,
+		JobMaxAttempts:         jobMaxAttempts,
+		TusUploadExpiry:        tusUploadExpiry,
+		UploadGCTTL:            uploadGCTTL,
+		UploadGCInterval:       uploadGCInterval,
+		DedupScope:             dedupScope,
+		ImportTimeout:          importTimeout,
+		ImportAllowPrivate:     importAllowPrivate,
+		BatchSizeLimit:         int64(batchSizeLimit),
+		PlaybackTokenSecret:    os.Getenv("PLAYBACK_TOKEN_SECRET"),
+		PlaybackTokenExpiry:    playbackTokenExpiry,
+		PlaybackTokenBindIP:    playbackTokenBindIP,
+		LiveEnabled:            liveEnabled,
+		LiveHost:               liveHost,
+		LivePortMin:            livePortMin,
+		LivePortMax:            livePortMax,
+		LiveWaitTimeout:        liveWaitTimeout,
 		Debug:                  debug,
 	}
 
@@ -112,6 +488,14 @@ func LoadConfig(envFile string) error {
 		config.JWTSecretKey = os.Getenv("FILE_SIZE_LIMIT")
 	}
 
+	// playback tokens end up in URLs that get shared, so they are signed
+	// with a key of their own, which keeps them from passing as a login
+	if config.PlaybackTokenSecret == "" {
+		mac := hmac.New(sha256.New, []byte(config.JWTSecretKey))
+		mac.Write([]byte("playback tokens"))
+		config.PlaybackTokenSecret = hex.EncodeToString(mac.Sum(nil))
+	}
+
 	AppConfig = config
 	slog.Info("Configuration loaded successfully")
 	return nil
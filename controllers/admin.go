@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"video-streaming-server/repositories"
+	"video-streaming-server/shared/logger"
+	"video-streaming-server/storage"
+	"video-streaming-server/utils"
+)
+
+// adminRole is the role of users allowed to see how the server is doing
+const adminRole = "admin"
+
+// @desc Get the counters of the object cache, for admins only
+// @route GET /admin/cache
+func GetCacheStats(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if r.Method != http.MethodGet {
+		utils.SendError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+
+	user, err := utils.GetUserFromRequest(r)
+	if err != nil {
+		logger.Log.Warn("failed to get user from request", "error", err)
+		utils.SendError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	role, err := repositories.NewUserRepository(db).GetRole(user.ID)
+	if err != nil {
+		logger.Log.Error("failed to get role of user", "user_id", user.ID, "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if role != adminRole {
+		utils.SendError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(storage.GetCacheStats()); err != nil {
+		logger.Log.Error("failed to encode cache stats response", "error", err)
+	}
+}
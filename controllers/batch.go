@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"video-streaming-server/config"
+	"video-streaming-server/jobs"
+	"video-streaming-server/repositories"
+	"video-streaming-server/shared/logger"
+	. "video-streaming-server/types"
+	"video-streaming-server/utils"
+
+	"github.com/google/uuid"
+)
+
+// @desc Upload a ZIP archive of videos, with an optional metadata.json or metadata.csv
+// @route POST /video/batch
+func UploadBatch(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	user, err := utils.GetUserFromRequest(r)
+	if err != nil {
+		logger.Log.Warn("failed to get user from request", "error", err)
+		utils.SendError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	batchID := uuid.NewString()
+	archivePath := utils.BatchArchivePath(batchID)
+
+	if err := saveArchive(w, r, archivePath); err != nil {
+		os.Remove(archivePath)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			utils.SendError(w, http.StatusRequestEntityTooLarge, "The archive is larger than the limit")
+			return
+		}
+		logger.Log.Error("failed to save batch archive", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Error processing file")
+		return
+	}
+
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		os.Remove(archivePath)
+		utils.SendError(w, http.StatusUnsupportedMediaType, "The file is not a ZIP archive")
+		return
+	}
+
+	// the archive is kept for the jobs extracting the videos once they exist
+	queued := false
+	defer func() {
+		archive.Close()
+		if !queued {
+			os.Remove(archivePath)
+		}
+	}()
+
+	entries, err := utils.PlanBatch(&archive.Reader)
+	if err != nil {
+		var invalid *utils.MediaValidationError
+		if errors.As(err, &invalid) {
+			utils.SendError(w, http.StatusBadRequest, invalid.Reason)
+			return
+		}
+		logger.Log.Error("failed to read batch archive", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	var size int64
+	for i := range entries {
+		entries[i].VideoID = uuid.NewString()
+		size += entries[i].Size
+	}
+
+	if !checkUploadsQuota(w, db, user.ID, int64(len(entries)), size) {
+		return
+	}
+
+	if err := jobs.QueueBatch(db, batchID, user.ID, entries); err != nil {
+		logger.Log.Error("failed to create batch", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	queued = true
+
+	logger.Log.Info("batch upload received", "batch_id", batchID, "videos", len(entries))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(BatchResponseType{ID: batchID, Videos: entries})
+}
+
+// saveArchive writes the body of a bulk upload or HLS bundle to disk, the
+// zip format needs to be read from the end
+func saveArchive(w http.ResponseWriter, r *http.Request, archivePath string) error {
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	body := http.MaxBytesReader(w, r.Body, config.AppConfig.BatchSizeLimit)
+	if _, err := io.Copy(file, body); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// @desc Get the progress of a bulk upload
+// @route GET /video/batch/[id]
+func GetBatch(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	batchID := strings.Split(r.URL.Path[1:], "/")[2]
+
+	user, err := utils.GetUserFromRequest(r)
+	if err != nil {
+		logger.Log.Warn("failed to get user from request", "error", err)
+		utils.SendError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	progress, err := repositories.NewBatchRepository(db).GetProgress(batchID, user.ID)
+	if err != nil {
+		logger.Log.Error("failed to get batch progress", "batch_id", batchID, "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if progress == nil {
+		utils.SendError(w, http.StatusNotFound, "Batch not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(progress)
+}
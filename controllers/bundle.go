@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"video-streaming-server/config"
+	"video-streaming-server/jobs"
+	"video-streaming-server/repositories"
+	"video-streaming-server/shared/logger"
+	. "video-streaming-server/types"
+	"video-streaming-server/utils"
+
+	"github.com/google/uuid"
+)
+
+// @desc Upload a ZIP archive of an HLS playlist and its segments, stored as they are without re-encoding
+// @route POST /video/bundle
+func UploadBundle(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	// bundles are stored as they are, so their segments would be served
+	// unencrypted
+	if config.AppConfig.HLSEncryption {
+		utils.SendError(w, http.StatusServiceUnavailable, "HLS bundles cannot be imported while HLS encryption is on")
+		return
+	}
+	// nor would they get the DASH output every other video has
+	if config.AppConfig.DashEnabled {
+		utils.SendError(w, http.StatusServiceUnavailable, "HLS bundles cannot be imported while DASH output is on")
+		return
+	}
+
+	user, err := utils.GetUserFromRequest(r)
+	if err != nil {
+		logger.Log.Warn("failed to get user from request", "error", err)
+		utils.SendError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// the body is the archive, so the metadata comes in headers like that
+	// of an upload
+	title := strings.TrimSpace(r.Header.Get("title"))
+	if title == "" {
+		utils.SendError(w, http.StatusBadRequest, "A title is required")
+		return
+	}
+
+	videoID := uuid.NewString()
+	archivePath := utils.BundleArchivePath(videoID)
+
+	if err := saveArchive(w, r, archivePath); err != nil {
+		os.Remove(archivePath)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			utils.SendError(w, http.StatusRequestEntityTooLarge, "The archive is larger than the limit")
+			return
+		}
+		logger.Log.Error("failed to save bundle archive", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Error processing file")
+		return
+	}
+
+	// the archive is kept for the job once the video exists
+	queued := false
+	defer func() {
+		if !queued {
+			os.Remove(archivePath)
+		}
+	}()
+
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		utils.SendError(w, http.StatusUnsupportedMediaType, "The file is not a ZIP archive")
+		return
+	}
+	size, err := utils.CheckBundle(&archive.Reader)
+	archive.Close()
+	if err != nil {
+		var invalid *utils.MediaValidationError
+		if errors.As(err, &invalid) {
+			utils.SendError(w, http.StatusBadRequest, invalid.Reason)
+			return
+		}
+		logger.Log.Error("failed to read bundle archive", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	if !checkUploadQuota(w, db, user.ID, size) {
+		return
+	}
+
+	if err := repositories.NewBundleRepository(db).Create(videoID, user.ID, title, r.Header.Get("description")); err != nil {
+		logger.Log.Error("failed to create bundle video", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	queued = true
+	if err := jobs.Enqueue(db, videoID, BundleJob); err != nil {
+		// the reaper removes the video with its archive
+		logger.Log.Error("failed to queue bundle", "video_id", videoID, "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	logger.Log.Info("HLS bundle queued", "video_id", videoID, "size", size)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"id": videoID})
+}
@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"video-streaming-server/jobs"
+	"video-streaming-server/repositories"
+	"video-streaming-server/shared/logger"
+	. "video-streaming-server/types"
+	"video-streaming-server/utils"
+
+	"github.com/google/uuid"
+)
+
+// @desc Import a video by downloading it from a URL
+// @route POST /video/import
+func ImportVideo(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	user, err := utils.GetUserFromRequest(r)
+	if err != nil {
+		logger.Log.Warn("failed to get user from request", "error", err)
+		utils.SendError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var request ImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		utils.SendError(w, http.StatusBadRequest, "Invalid Request Body")
+		return
+	}
+
+	request.Title = strings.TrimSpace(request.Title)
+	if request.Title == "" {
+		utils.SendError(w, http.StatusBadRequest, "A title is required")
+		return
+	}
+
+	if err := utils.ValidateImportURL(request.URL); err != nil {
+		utils.SendError(w, http.StatusBadRequest, "Invalid URL, "+err.Error())
+		return
+	}
+
+	// the size is only known once the download starts, which checks it
+	// against the file size limit
+	if !checkUploadQuota(w, db, user.ID, 0) {
+		return
+	}
+
+	videoID := uuid.NewString()
+	if err := repositories.NewImportRepository(db).Create(videoID, user.ID, &request); err != nil {
+		logger.Log.Error("failed to create import", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	if err := jobs.Enqueue(db, videoID, ImportJob); err != nil {
+		logger.Log.Error("failed to queue import", "video_id", videoID, "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	logger.Log.Info("video import queued", "video_id", videoID, "url", request.URL)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"id": videoID})
+}
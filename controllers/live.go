@@ -0,0 +1,148 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"video-streaming-server/config"
+	"video-streaming-server/jobs"
+	"video-streaming-server/repositories"
+	"video-streaming-server/shared/logger"
+	. "video-streaming-server/types"
+	"video-streaming-server/utils"
+
+	"github.com/google/uuid"
+)
+
+// @desc Start a live stream, which is recorded and processed like an upload once it ends
+// @route POST /video/live
+func GoLive(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !config.AppConfig.LiveEnabled {
+		utils.SendError(w, http.StatusServiceUnavailable, "Live streaming is not enabled")
+		return
+	}
+
+	user, err := utils.GetUserFromRequest(r)
+	if err != nil {
+		logger.Log.Warn("failed to get user from request", "error", err)
+		utils.SendError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var request LiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		utils.SendError(w, http.StatusBadRequest, "Invalid Request Body")
+		return
+	}
+
+	request.Title = strings.TrimSpace(request.Title)
+	if request.Title == "" {
+		utils.SendError(w, http.StatusBadRequest, "A title is required")
+		return
+	}
+
+	// the size of the recording is only known once the stream ends
+	if !checkUploadQuota(w, db, user.ID, 0) {
+		return
+	}
+
+	videoID := uuid.NewString()
+	if err := repositories.NewLiveRepository(db).Create(videoID, user.ID, &request); err != nil {
+		logger.Log.Error("failed to create live stream", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	ingestURL, err := jobs.GoLive(db, videoID, request.Title, UserID(user.ID))
+	if err != nil {
+		if deleteErr := repositories.NewVideoRepository(db).Delete(videoID); deleteErr != nil {
+			logger.Log.Error("failed to remove live stream", "video_id", videoID, "error", deleteErr)
+		}
+		if errors.Is(err, jobs.ErrNoLivePort) {
+			utils.SendError(w, http.StatusServiceUnavailable, "Too many live streams, try again later")
+			return
+		}
+		logger.Log.Error("failed to start live stream", "video_id", videoID, "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	logger.Log.Info("live stream waiting for publisher", "video_id", videoID, "user_id", user.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(LiveResponseType{ID: videoID, IngestURL: ingestURL})
+}
+
+// @desc Stop a live stream and process its recording
+// @route POST /video/[id]/stop
+func StopLiveHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	videoId := strings.Split(r.URL.Path[1:], "/")[1]
+
+	user, err := utils.GetUserFromRequest(r)
+	if err != nil {
+		logger.Log.Error("failed to get user from request", "error", err)
+		utils.SendError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	status, err := repositories.NewLiveRepository(db).GetStatus(videoId, user.ID)
+	if err != nil {
+		logger.Log.Error("failed to query live status", "error", err, "videoId", videoId)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if status == "" {
+		utils.SendError(w, http.StatusNotFound, "Video not found")
+		return
+	}
+
+	// streams are stopped by the server ingesting them
+	if status == LiveEnded || !jobs.StopLive(videoId) {
+		utils.SendError(w, http.StatusConflict, "Video is not being streamed live")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// serveLivePlaylist sends the rolling playlist of a live stream
+func serveLivePlaylist(w http.ResponseWriter, r *http.Request, videoId string, token string) {
+	playlist, err := os.ReadFile(filepath.Join(utils.LiveDir(videoId), utils.LivePlaylist))
+	if err != nil {
+		// ffmpeg writes it once the first segment is complete
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Log.Error("failed to read live playlist", "videoId", videoId, "error", err)
+		}
+		utils.SendError(w, http.StatusNotFound, "File not found")
+		return
+	}
+
+	writePlaylist(w, r, playlist, token, liveManifestCache)
+}
+
+// serveLiveSegment sends a segment of a live stream, which is only kept
+// while the playlist lists it
+func serveLiveSegment(w http.ResponseWriter, r *http.Request, videoId string, segment string) {
+	file, err := os.Open(filepath.Join(utils.LiveDir(videoId), filepath.Base(segment)))
+	if err != nil {
+		utils.SendError(w, http.StatusNotFound, "File not found")
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		utils.SendError(w, http.StatusNotFound, "File not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", utils.ContentTypeOf(segment))
+	w.Header().Set("Cache-Control", responseCache(r, segmentCache))
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
@@ -0,0 +1,290 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"video-streaming-server/shared/logger"
+	"video-streaming-server/storage"
+	"video-streaming-server/utils"
+)
+
+// Cache-Control values of the stored objects of a video. Answers to
+// requests with the login cookie are only cached by the browser, see
+// responseCache for those with a playback token.
+const (
+	// segments are never changed once a video is processed
+	segmentCache = "private, max-age=31536000, immutable"
+	// thumbnails are replaced when a video is processed again
+	thumbnailCache = "private, max-age=86400"
+	// manifests are kept briefly and then revalidated with their ETag,
+	// which is cheap as long as they did not change
+	manifestCache = "private, max-age=60, must-revalidate"
+	// live playlists change with every segment
+	liveManifestCache = "private, no-cache"
+)
+
+// diskCacheAge is how long the object cache keeps an object served with a
+// Cache-Control before fetching it again, 0 keeps it until it is evicted
+var diskCacheAge = map[string]time.Duration{
+	segmentCache:   0,
+	thumbnailCache: time.Hour,
+	manifestCache:  time.Minute,
+}
+
+// responseCache returns the Cache-Control to answer a request with. A
+// playback token is part of the URL and grants the request by itself, so
+// answers to requests that carry one, which the handlers verified, may be
+// kept by shared caches like CDNs as well.
+func responseCache(r *http.Request, cacheControl string) string {
+	if r.URL.Query().Get("token") == "" {
+		return cacheControl
+	}
+	return strings.Replace(cacheControl, "private", "public", 1)
+}
+
+// serveObject streams a stored object to the response, answering
+// conditional and range requests. Seekable bodies, like those of objects
+// kept on local disk, are left to http.ServeContent. Remote stores are
+// asked for the object's metadata first when the request is conditional
+// or for a range, so neither needs the whole object to be downloaded,
+// unless the object cache is on, which keeps whole objects on local disk.
+func serveObject(w http.ResponseWriter, r *http.Request, key string, contentType string, cacheControl string) {
+	store, err := storage.GetStore()
+	if err != nil {
+		logger.Log.Error("failed to get object store", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	cache := storage.GetCache()
+	ranger, canRange := store.(storage.RangeGetter)
+	if cache == nil && canRange && (r.Header.Get("Range") != "" || r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "") {
+		info, err := store.Stat(r.Context(), key)
+		if err != nil {
+			sendObjectError(w, key, err)
+			return
+		}
+
+		etag := setObjectHeaders(w, info, contentType, responseCache(r, cacheControl))
+		w.Header().Set("Accept-Ranges", "bytes")
+		if notModified(r, etag, info.LastModified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		offset, length, ok := requestedRange(r, etag, info.Size)
+		if !ok {
+			w.Header().Del("Cache-Control")
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+			utils.SendError(w, http.StatusRequestedRangeNotSatisfiable, "Requested range not satisfiable")
+			return
+		}
+		if length >= 0 {
+			body, err := ranger.GetRange(r.Context(), key, offset, length)
+			if err != nil {
+				sendObjectError(w, key, err)
+				return
+			}
+			defer body.Close()
+
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, info.Size))
+			w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+			w.WriteHeader(http.StatusPartialContent)
+			copyObject(w, body, key)
+			return
+		}
+	}
+
+	body, info, err := getObject(r, store, cache, key, cacheControl)
+	if err != nil {
+		sendObjectError(w, key, err)
+		return
+	}
+	defer body.Close()
+
+	etag := setObjectHeaders(w, info, contentType, responseCache(r, cacheControl))
+
+	if content, ok := body.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, path.Base(key), info.LastModified, content)
+		return
+	}
+
+	if notModified(r, etag, info.LastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if canRange {
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+	if info.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	copyObject(w, body, key)
+}
+
+// servePlaylist sends an HLS playlist with a playback token added to its
+// URIs. The answer differs with every token, so it has no validators.
+func servePlaylist(w http.ResponseWriter, r *http.Request, key string, token string) {
+	store, err := storage.GetStore()
+	if err != nil {
+		logger.Log.Error("failed to get object store", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	body, _, err := getObject(r, store, storage.GetCache(), key, manifestCache)
+	if err != nil {
+		sendObjectError(w, key, err)
+		return
+	}
+	defer body.Close()
+
+	playlist, err := io.ReadAll(body)
+	if err != nil {
+		logger.Log.Error("failed to read playlist", "key", key, "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	writePlaylist(w, r, playlist, token, manifestCache)
+}
+
+func writePlaylist(w http.ResponseWriter, r *http.Request, playlist []byte, token string, cacheControl string) {
+	playlist = utils.SignPlaylist(playlist, token)
+
+	w.Header().Set("Content-Type", "application/x-mpegURL")
+	w.Header().Set("Cache-Control", responseCache(r, cacheControl))
+	w.Header().Set("Content-Length", strconv.Itoa(len(playlist)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(playlist)
+}
+
+// getObject fetches an object through the object cache when it is on
+func getObject(r *http.Request, store storage.ObjectStore, cache *storage.DiskCache, key string, cacheControl string) (io.ReadCloser, *storage.ObjectInfo, error) {
+	if cache != nil {
+		return cache.Get(r.Context(), store, key, diskCacheAge[cacheControl])
+	}
+	return store.Get(r.Context(), key)
+}
+
+func sendObjectError(w http.ResponseWriter, key string, err error) {
+	if errors.Is(err, storage.ErrNotFound) {
+		logger.Log.Error("object not found", "key", key)
+		utils.SendError(w, http.StatusNotFound, "File not found")
+		return
+	}
+	logger.Log.Error("failed to fetch object", "key", key, "error", err)
+	utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+}
+
+// copyObject streams a body to the response. The status is sent by then,
+// so a failure can only be logged.
+func copyObject(w http.ResponseWriter, body io.Reader, key string) {
+	if _, err := io.Copy(w, body); err != nil {
+		logger.Log.Warn("failed to send object", "key", key, "error", err)
+	}
+}
+
+// setObjectHeaders sets the headers every answer for an object carries
+// and returns its ETag, which is made up from its size and modification
+// time for stores that do not have one
+func setObjectHeaders(w http.ResponseWriter, info *storage.ObjectInfo, contentType string, cacheControl string) string {
+	etag := info.ETag
+	if etag == "" && !info.LastModified.IsZero() {
+		etag = fmt.Sprintf("%x-%x", info.LastModified.UnixNano(), info.Size)
+	}
+	if etag != "" && !strings.HasPrefix(etag, `"`) && !strings.HasPrefix(etag, `W/"`) {
+		etag = `"` + etag + `"`
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", cacheControl)
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !info.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	}
+	return etag
+}
+
+// notModified tells whether the copy the client has is still current.
+// If-Modified-Since is only looked at without If-None-Match.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || lastModified.IsZero() {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
+// requestedRange returns the single byte range a request asks for, with a
+// length of -1 when the whole object is to be sent: without a valid Range
+// header, with several ranges, or when If-Range names another version.
+// It returns false for a range that lies outside of the object.
+func requestedRange(r *http.Request, etag string, size int64) (int64, int64, bool) {
+	header := r.Header.Get("Range")
+	if header == "" || size < 0 {
+		return 0, -1, true
+	}
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && (ifRange != etag || strings.HasPrefix(etag, "W/")) {
+		return 0, -1, true
+	}
+
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, -1, true
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, -1, true
+	}
+
+	if first == "" {
+		// the last n bytes
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix < 0 {
+			return 0, -1, true
+		}
+		if suffix == 0 || size == 0 {
+			return 0, 0, false
+		}
+		suffix = min(suffix, size)
+		return size - suffix, suffix, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, -1, true
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, -1, true
+		}
+	}
+	if start >= size {
+		return 0, 0, false
+	}
+	return start, min(end, size-1) - start + 1, true
+}
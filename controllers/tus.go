@@ -0,0 +1,352 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"video-streaming-server/config"
+	"video-streaming-server/jobs"
+	"video-streaming-server/repositories"
+	"video-streaming-server/shared/logger"
+	. "video-streaming-server/types"
+	"video-streaming-server/utils"
+
+	"github.com/google/uuid"
+)
+
+// tus 1.0, https://tus.io/protocols/resumable-upload
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+)
+
+// uploadLocks serializes the requests writing to an upload, so two of
+// them never write to the same file
+var uploadLocks sync.Map
+
+// @desc Resumable upload endpoint implementing the tus protocol
+// @route OPTIONS, POST /uploads/ and HEAD, PATCH, DELETE /uploads/[id]
+func TusHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", config.AppConfig.FileSizeLimit)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		utils.SendError(w, http.StatusPreconditionFailed, "Unsupported tus version")
+		return
+	}
+
+	user, err := utils.GetUserFromRequest(r)
+	if err != nil {
+		logger.Log.Warn("failed to get user from request", "error", err)
+		utils.SendError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	repository := repositories.NewTusUploadRepository(db)
+	uploadID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/uploads"), "/")
+
+	if uploadID == "" {
+		if r.Method != http.MethodPost {
+			utils.SendError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+			return
+		}
+		createTusUpload(w, r, db, repository, user)
+		return
+	}
+
+	if !utils.IsVideoID(uploadID) {
+		utils.SendError(w, http.StatusNotFound, "Upload not found")
+		return
+	}
+
+	upload, err := repository.Get(uploadID, user.ID)
+	if err != nil {
+		logger.Log.Error("failed to get upload", "upload_id", uploadID, "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if upload == nil {
+		utils.SendError(w, http.StatusNotFound, "Upload not found")
+		return
+	}
+
+	if upload.Offset < upload.Length && time.Now().UTC().After(upload.ExpiresAt) {
+		utils.SendError(w, http.StatusGone, "Upload expired")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		if upload.Metadata != "" {
+			w.Header().Set("Upload-Metadata", upload.Metadata)
+		}
+		setUploadExpires(w, upload)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		appendTusUpload(w, r, db, repository, upload)
+	case http.MethodDelete:
+		terminateTusUpload(w, repository, upload)
+	default:
+		utils.SendError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+	}
+}
+
+func createTusUpload(w http.ResponseWriter, r *http.Request, db *sql.DB, repository repositories.TusUploadRepository, user *User) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		utils.SendError(w, http.StatusBadRequest, "Deferred upload length is not supported")
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		utils.SendError(w, http.StatusBadRequest, "Invalid Upload-Length")
+		return
+	}
+
+	sizeLimit, _ := strconv.ParseInt(config.AppConfig.FileSizeLimit, 10, 64)
+	if length > sizeLimit {
+		utils.SendError(w, http.StatusRequestEntityTooLarge, "Upload is larger than the file size limit")
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		utils.SendError(w, http.StatusBadRequest, "Invalid Upload-Metadata")
+		return
+	}
+
+	title := metadata["title"]
+	if title == "" {
+		title = metadata["filename"]
+	}
+	if title == "" {
+		utils.SendError(w, http.StatusBadRequest, "A title or filename is required in Upload-Metadata")
+		return
+	}
+
+	if !checkUploadQuota(w, db, user.ID, length) {
+		return
+	}
+
+	upload := &TusUpload{
+		ID:        uuid.NewString(),
+		UserID:    user.ID,
+		Length:    length,
+		Metadata:  r.Header.Get("Upload-Metadata"),
+		ExpiresAt: time.Now().UTC().Add(config.AppConfig.TusUploadExpiry),
+	}
+
+	file, err := os.Create(utils.PartialVideoPath(upload.ID))
+	if err != nil {
+		logger.Log.Error("failed to create file", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Error processing file")
+		return
+	}
+	file.Close()
+
+	if err := repository.Create(upload, title, metadata["description"]); err != nil {
+		os.Remove(utils.PartialVideoPath(upload.ID))
+		logger.Log.Error("failed to create upload", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	logger.Log.Info("tus upload created", "upload_id", upload.ID, "length", length)
+
+	w.Header().Set("Location", "/uploads/"+upload.ID)
+	setUploadExpires(w, upload)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func appendTusUpload(w http.ResponseWriter, r *http.Request, db *sql.DB, repository repositories.TusUploadRepository, upload *TusUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		utils.SendError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		utils.SendError(w, http.StatusBadRequest, "Invalid Upload-Offset")
+		return
+	}
+
+	lock, _ := uploadLocks.LoadOrStore(upload.ID, &sync.Mutex{})
+	if !lock.(*sync.Mutex).TryLock() {
+		utils.SendError(w, http.StatusConflict, "Another request is writing to this upload")
+		return
+	}
+	defer lock.(*sync.Mutex).Unlock()
+
+	// the request holding the lock before may have moved the offset since
+	// it was read
+	upload, err = repository.Get(upload.ID, upload.UserID)
+	if err != nil || upload == nil {
+		logger.Log.Error("failed to reload upload", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	if offset != upload.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		utils.SendError(w, http.StatusConflict, "Upload-Offset does not match the current offset")
+		return
+	}
+
+	if upload.Offset == upload.Length {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	file, err := os.OpenFile(utils.PartialVideoPath(upload.ID), os.O_WRONLY, 0)
+	if err != nil {
+		logger.Log.Error("failed to open upload file", "upload_id", upload.ID, "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	defer file.Close()
+
+	// whatever made it to disk counts, even when the client goes away
+	// halfway, so it can resume from there
+	written, copyErr := io.Copy(io.NewOffsetWriter(file, upload.Offset), io.LimitReader(r.Body, upload.Length-upload.Offset))
+	sniffed := upload.Offset >= utils.SniffLength
+	upload.Offset += written
+	upload.ExpiresAt = time.Now().UTC().Add(config.AppConfig.TusUploadExpiry)
+
+	if err := repository.UpdateOffset(upload.ID, upload.Offset, upload.ExpiresAt); err != nil {
+		logger.Log.Error("failed to update upload offset", "upload_id", upload.ID, "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	// filename is the original name of the file in most tus clients
+	metadata, _ := parseUploadMetadata(upload.Metadata)
+
+	if !sniffed && (upload.Offset >= utils.SniffLength || upload.Offset == upload.Length) {
+		if err := utils.SniffUpload(upload.ID, metadata["filename"]); err != nil {
+			var invalid *utils.MediaValidationError
+			if !errors.As(err, &invalid) {
+				logger.Log.Error("failed to check upload", "upload_id", upload.ID, "error", err)
+				utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+				return
+			}
+
+			logger.Log.Warn("upload is not a supported video", "upload_id", upload.ID)
+			uploadLocks.Delete(upload.ID)
+			if err := repository.Delete(upload.ID); err != nil {
+				logger.Log.Error("failed to delete upload", "upload_id", upload.ID, "error", err)
+			}
+			os.Remove(utils.PartialVideoPath(upload.ID))
+			utils.SendError(w, http.StatusUnsupportedMediaType, invalid.Reason)
+			return
+		}
+	}
+
+	if copyErr != nil {
+		logger.Log.Warn("upload interrupted", "upload_id", upload.ID, "offset", upload.Offset, "error", copyErr)
+		utils.SendError(w, http.StatusBadRequest, "Error reading request body")
+		return
+	}
+
+	if upload.Offset == upload.Length {
+		logger.Log.Info("tus upload complete", "upload_id", upload.ID)
+		uploadLocks.Delete(upload.ID)
+
+		if _, err := utils.FinishUpload(context.WithoutCancel(r.Context()), upload.ID, metadata["filename"]); err != nil {
+			var invalid *utils.MediaValidationError
+			if !errors.As(err, &invalid) {
+				logger.Log.Error("failed to check upload", "upload_id", upload.ID, "error", err)
+				rejectUpload(w, db, upload.ID, http.StatusInternalServerError, uploadCheckFailed)
+				return
+			}
+
+			logger.Log.Warn("upload is not a valid video", "upload_id", upload.ID, "reason", invalid.Reason)
+			rejectUpload(w, db, upload.ID, http.StatusUnprocessableEntity, invalid.Reason)
+			return
+		}
+
+		if err := utils.UpdateVideoStatus(db, upload.ID, UploadedOnServer); err != nil {
+			logger.Log.Error("failed to update video status", "error", err)
+			utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+
+		if err := jobs.Enqueue(db, upload.ID, TranscodeJob); err != nil {
+			logger.Log.Error("failed to queue video for processing", "error", err)
+			utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	setUploadExpires(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func terminateTusUpload(w http.ResponseWriter, repository repositories.TusUploadRepository, upload *TusUpload) {
+	if upload.Offset == upload.Length {
+		utils.SendError(w, http.StatusConflict, "Upload is complete, cancel its processing instead")
+		return
+	}
+
+	if err := repository.Delete(upload.ID); err != nil {
+		logger.Log.Error("failed to delete upload", "upload_id", upload.ID, "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	if err := os.Remove(utils.PartialVideoPath(upload.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Log.Warn("failed to remove upload file", "upload_id", upload.ID, "error", err)
+	}
+	uploadLocks.Delete(upload.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func setUploadExpires(w http.ResponseWriter, upload *TusUpload) {
+	if upload.Offset < upload.Length {
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header, a comma separated
+// list of keys each followed by an optional base64 encoded value
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
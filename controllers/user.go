@@ -150,3 +150,32 @@ func LoginUser(w http.ResponseWriter, r *http.Request, userService services.User
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"message": "Logged in successfully"}`))
 }
+
+// @desc Get the storage used by the current user and their limits
+// @route GET /me/usage
+func GetUsage(w http.ResponseWriter, r *http.Request, quotaService services.QuotaService) {
+	if r.Method != http.MethodGet {
+		utils.SendError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+
+	user, err := utils.GetUserFromRequest(r)
+	if err != nil {
+		logger.Log.Warn("failed to get user from request", "error", err)
+		utils.SendError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	usage, err := quotaService.GetUsage(user.ID)
+	if err != nil {
+		logger.Log.Error("failed to get usage", "user_id", user.ID, "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(usage); err != nil {
+		logger.Log.Error("failed to encode usage response", "error", err)
+	}
+}
@@ -1,18 +1,29 @@
 package controllers
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"hash"
 	"io"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 	"video-streaming-server/config"
+	"video-streaming-server/jobs"
+	"video-streaming-server/repositories"
+	"video-streaming-server/services"
 	"video-streaming-server/shared/logger"
+	"video-streaming-server/storage"
 	. "video-streaming-server/types"
 	"video-streaming-server/utils"
+
+	"github.com/lib/pq"
 )
 
 // @desc Create new video resource
@@ -24,13 +35,19 @@ func UploadVideo(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	user, err := utils.GetUserFromRequest(r)
 	title := r.Header.Get("title")
 
-	userID := UserID(user.ID)
-
 	if err != nil {
 		logger.Log.Warn("failed to get user from request", "error", err)
 		utils.SendError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
+
+	// the name is used in file paths, so it has to be an ID like the
+	// server gives videos
+	if !utils.IsVideoID(fileName) {
+		utils.SendError(w, http.StatusBadRequest, "Invalid file-name header, expected a UUID")
+		return
+	}
+
 	sizeLimit, _ := strconv.Atoi(config.AppConfig.FileSizeLimit)
 
 	if fileSize > sizeLimit {
@@ -39,97 +56,340 @@ func UploadVideo(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
-	serverFileName := fileName + ".mp4"
+	chunkOffset, err := strconv.ParseInt(r.Header.Get("chunk-offset"), 10, 64)
+	if err != nil || chunkOffset < 0 {
+		utils.SendError(w, http.StatusBadRequest, "Invalid chunk-offset header")
+		return
+	}
 
-	if isFirstChunk == "true" {
-		description := r.Header.Get("description")
+	chunkSum := strings.ToLower(r.Header.Get("chunk-sha256"))
+	if !isSHA256(chunkSum) {
+		utils.SendError(w, http.StatusBadRequest, "Invalid chunk-sha256 header")
+		return
+	}
 
-		insertStatement, err := db.Prepare(`
-			INSERT INTO 
-				videos
-					(
-						video_id,
-						title,
-						description,
-						upload_initiate_time,
-						status,
-						delete_flag,
-						user_id
-					) 
-				VALUES 
-					($1,$2,$3,$4,$5,$6,$7)
-		`)
+	d, err := io.ReadAll(r.Body)
+	if err != nil {
+		utils.SendError(w, http.StatusBadRequest, "Error reading chunk")
+		return
+	}
 
-		if err != nil {
-			logger.Log.Error("failed to prepare insert statement", "error", err)
-			utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+	sum := sha256.Sum256(d)
+	if hex.EncodeToString(sum[:]) != chunkSum {
+		utils.SendError(w, http.StatusBadRequest, "Chunk checksum mismatch")
+		return
+	}
+
+	sessionRepository := repositories.NewUploadSessionRepository(db)
+	session, err := sessionRepository.Get(fileName, user.ID)
+	if err != nil {
+		logger.Log.Error("failed to get upload session", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	if session == nil {
+		if isFirstChunk != "true" {
+			utils.SendError(w, http.StatusNotFound, "Upload session not found")
 			return
 		}
 
-		_, err = insertStatement.Exec(fileName, title, description, time.Now(), 0, 0, user.ID)
+		session = &UploadSession{
+			VideoID:      fileName,
+			UserID:       user.ID,
+			ExpectedSize: int64(fileSize),
+			FileSHA256:   strings.ToLower(r.Header.Get("file-sha256")),
+		}
+		if !isSHA256(session.FileSHA256) {
+			utils.SendError(w, http.StatusBadRequest, "Invalid file-sha256 header")
+			return
+		}
 
-		if err != nil {
-			logger.Log.Error("failed to execute insert statement", "error", err)
-			utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		if _, err := utils.SourceExtension(d, r.Header.Get("file-extension")); err != nil {
+			utils.SendError(w, http.StatusUnsupportedMediaType, err.Error())
 			return
 		}
-	}
 
-	d, _ := io.ReadAll(r.Body)
+		if !checkUploadQuota(w, db, user.ID, session.ExpectedSize) {
+			return
+		}
 
-	var tmpFile *os.File
+		if err := sessionRepository.Create(session, title, r.Header.Get("description")); err != nil {
+			logger.Log.Error("failed to create upload session", "error", err)
+			utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
 
-	if isFirstChunk == "true" {
-		tmpFile, err = os.Create("./video/" + serverFileName)
+		file, err := os.Create(utils.PartialVideoPath(fileName))
 		if err != nil {
 			logger.Log.Error("failed to create file", "error", err)
 			utils.SendError(w, http.StatusInternalServerError, "Error processing file")
 			return
 		}
-	} else {
-		tmpFile, err = os.OpenFile("./video/"+serverFileName, os.O_APPEND|os.O_WRONLY, os.ModeAppend)
+		file.Close()
+	}
+
+	chunk := &UploadChunk{Offset: chunkOffset, Size: int64(len(d)), SHA256: chunkSum}
+
+	lock, _ := uploadLocks.LoadOrStore(fileName, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	// reload now that no other chunk of this upload is being written
+	session, err = sessionRepository.Get(fileName, user.ID)
+	if err != nil || session == nil {
+		logger.Log.Error("failed to reload upload session", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	if chunkOffset < session.ReceivedSize {
+		// a retry of a chunk that was stored already is answered as if it
+		// had just been stored
+		stored, err := sessionRepository.GetChunk(fileName, chunkOffset)
 		if err != nil {
-			logger.Log.Error("failed to open file for appending", "error", err)
+			logger.Log.Error("failed to get upload chunk", "error", err)
 			utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
 			return
 		}
+		if stored == nil || stored.Size != chunk.Size || stored.SHA256 != chunk.SHA256 {
+			w.Header().Set("upload-offset", strconv.FormatInt(session.ReceivedSize, 10))
+			utils.SendError(w, http.StatusConflict, "Chunk overlaps data that was already received")
+			return
+		}
+		sendUploadProgress(w, session)
+		return
 	}
 
-	_, err = tmpFile.Write(d)
+	if chunkOffset > session.ReceivedSize {
+		w.Header().Set("upload-offset", strconv.FormatInt(session.ReceivedSize, 10))
+		utils.SendError(w, http.StatusConflict, "Chunk is out of order")
+		return
+	}
 
+	if session.ReceivedSize+chunk.Size > session.ExpectedSize {
+		utils.SendError(w, http.StatusBadRequest, "Chunk goes past the end of the file")
+		return
+	}
+
+	// the file is hashed as it is received, so the last chunk does not have
+	// to read all of it again. Sessions started before the hash was kept
+	// are hashed once they are complete.
+	var fileHash hash.Hash
+	var hashState []byte
+	if session.ReceivedSize == 0 || len(session.HashState) > 0 {
+		fileHash, err = utils.ResumeSHA256(session.HashState)
+		if err == nil {
+			fileHash.Write(d)
+			hashState, err = utils.SHA256State(fileHash)
+		}
+		if err != nil {
+			logger.Log.Error("failed to hash upload chunk", "error", err)
+			utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+	}
+
+	tmpFile, err := os.OpenFile(utils.PartialVideoPath(fileName), os.O_WRONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		// the upload was cancelled and its file discarded
+		utils.SendError(w, http.StatusGone, "Upload was cancelled")
+		return
+	}
 	if err != nil {
-		logger.Log.Error("failed to write to file", "error", err)
+		logger.Log.Error("failed to open file for writing", "error", err)
 		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
 		return
 	}
 
-	fileInfo, err := tmpFile.Stat()
+	defer tmpFile.Close()
+
+	_, err = tmpFile.WriteAt(d, chunkOffset)
 
 	if err != nil {
-		logger.Log.Error("failed to get file info", "error", err)
+		logger.Log.Error("failed to write to file", "error", err)
 		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
 		return
 	}
 
-	if fileInfo.Size() == int64(fileSize) {
-		w.WriteHeader(http.StatusCreated)
-		w.Write([]byte("Video received completely and is now being processed."))
+	recorded, err := sessionRepository.RecordChunk(fileName, chunk, hashState)
+	if err != nil || !recorded {
+		logger.Log.Error("failed to record upload chunk", "error", err, "recorded", recorded)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	session.ReceivedSize += chunk.Size
+
+	if session.ReceivedSize < session.ExpectedSize {
+		sendUploadProgress(w, session)
+		return
+	}
 
-		err := utils.UpdateVideoStatus(db, fileName, UploadedOnServer)
+	uploadLocks.Delete(fileName)
+
+	var fileSum string
+	if fileHash != nil {
+		fileSum = hex.EncodeToString(fileHash.Sum(nil))
+	} else {
+		fileSum, err = utils.FileSHA256(utils.PartialVideoPath(fileName))
 		if err != nil {
-			logger.Log.Error("failed to update video status", "error", err)
+			logger.Log.Error("failed to hash uploaded file", "error", err)
 			utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
 			return
 		}
+	}
+
+	if fileSum != session.FileSHA256 {
+		logger.Log.Warn("uploaded file does not match its checksum", "video_id", fileName)
+		rejectUpload(w, db, fileName, http.StatusUnprocessableEntity, "File checksum mismatch, please upload the video again")
+		return
+	}
+
+	// the client going away now must not leave a complete upload behind
+	// that is never checked
+	if _, err := utils.FinishUpload(context.WithoutCancel(r.Context()), fileName, r.Header.Get("file-extension")); err != nil {
+		var invalid *utils.MediaValidationError
+		if errors.As(err, &invalid) {
+			logger.Log.Warn("uploaded file is not a valid video", "video_id", fileName, "reason", invalid.Reason)
+			rejectUpload(w, db, fileName, http.StatusUnprocessableEntity, invalid.Reason)
+			return
+		}
+		logger.Log.Error("failed to check uploaded file", "video_id", fileName, "error", err)
+		rejectUpload(w, db, fileName, http.StatusInternalServerError, uploadCheckFailed)
+		return
+	}
+
+	// processing looks for identical videos by this hash, it is only
+	// computed again when it could not be kept
+	if err := repositories.NewVideoRepository(db).SetContentHash(fileName, fileSum); err != nil {
+		logger.Log.Warn("failed to record content hash", "video_id", fileName, "error", err)
+	}
+
+	err = utils.UpdateVideoStatus(db, fileName, UploadedOnServer)
+	if err != nil {
+		logger.Log.Error("failed to update video status", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	if err := jobs.Enqueue(db, fileName, TranscodeJob); err != nil {
+		logger.Log.Error("failed to queue video for processing", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	sendUploadProgress(w, session)
+}
+
+// checkUploadQuota answers an upload its owner has no room for and returns
+// false
+func checkUploadQuota(w http.ResponseWriter, db *sql.DB, userID string, size int64) bool {
+	return checkUploadsQuota(w, db, userID, 1, size)
+}
+
+// checkUploadsQuota is checkUploadQuota for count videos taking up size
+// bytes together
+func checkUploadsQuota(w http.ResponseWriter, db *sql.DB, userID string, count int64, size int64) bool {
+	quotaService := services.NewQuotaService(repositories.NewQuotaRepository(db))
+	err := quotaService.CheckUploads(userID, count, size)
+	if err == nil {
+		return true
+	}
+
+	var exceeded *services.QuotaExceededError
+	if errors.As(err, &exceeded) {
+		logger.Log.Info("upload over quota", "user_id", userID, "reason", exceeded.Reason)
+		utils.SendError(w, http.StatusForbidden, exceeded.Reason)
+		return false
+	}
+
+	logger.Log.Error("failed to check upload quota", "user_id", userID, "error", err)
+	utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+	return false
+}
+
+const uploadCheckFailed = "The upload could not be checked, please upload the video again"
 
-		go utils.PostUploadProcessFile(serverFileName, fileName, title, tmpFile, db, userID)
+// rejectUpload fails a video whose upload turned out to be unusable and
+// removes the file
+func rejectUpload(w http.ResponseWriter, db *sql.DB, videoID string, status int, reason string) {
+	if err := utils.FailVideo(db, videoID, reason); err != nil {
+		logger.Log.Error("failed to update video status", "error", err)
+	}
+	os.Remove(utils.PartialVideoPath(videoID))
+	utils.SendError(w, status, reason)
+}
 
+// sendUploadProgress answers a stored chunk with how much of the file the
+// server has
+func sendUploadProgress(w http.ResponseWriter, session *UploadSession) {
+	w.Header().Set("upload-offset", strconv.FormatInt(session.ReceivedSize, 10))
+	if session.ReceivedSize == session.ExpectedSize {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("Video received completely and is now being processed."))
 	} else {
 		w.WriteHeader(http.StatusPartialContent)
 		w.Write([]byte("Receiving chunks of the video."))
 	}
 }
 
+func isSHA256(sum string) bool {
+	decoded, err := hex.DecodeString(sum)
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// @desc Cancel the upload or processing of a video
+// @route POST /video/[id]/cancel
+func CancelHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	videoId := strings.Split(r.URL.Path[1:], "/")[1]
+
+	user, err := utils.GetUserFromRequest(r)
+	if err != nil {
+		logger.Log.Error("failed to get user from request", "error", err)
+		utils.SendError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var title string
+	var status VideoStatus
+	err = db.QueryRow(`
+		SELECT
+			title, status
+		FROM
+			videos
+		WHERE
+			video_id=$1
+		AND
+			user_id=$2
+		AND
+			delete_flag=0;
+	`, videoId, user.ID).Scan(&title, &status)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			utils.SendError(w, http.StatusNotFound, "Video not found")
+			return
+		}
+		logger.Log.Error("failed to query video", "error", err, "videoId", videoId)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	if status != UploadPending && status != UploadedOnServer {
+		utils.SendError(w, http.StatusConflict, "Video is not being uploaded or processed")
+		return
+	}
+
+	if err := jobs.Cancel(db, videoId, title, UserID(user.ID)); err != nil {
+		logger.Log.Error("failed to cancel video processing", "error", err, "videoId", videoId)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+}
+
 // @desc Get All Videos
 // @route GET /video
 func GetVideos(w http.ResponseWriter, r *http.Request, db *sql.DB) {
@@ -147,13 +407,16 @@ func GetVideos(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 			title,
 			description,
 			thumbnail,
-			status
+			status,
+			failure_reason,
+			tags,
+			live_status
 		FROM
 			videos
 		WHERE
 			delete_flag=0
 		AND
-			status <> 0
+			(status <> 0 OR batch_id IS NOT NULL OR live_status IS NOT NULL OR video_id IN (SELECT video_id FROM video_imports) OR video_id IN (SELECT video_id FROM processing_jobs WHERE kind = $2))
 		AND
 			user_id=$1
 		ORDER BY
@@ -166,7 +429,7 @@ func GetVideos(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
-	rows, err := getUserVideosQuery.Query(user.ID)
+	rows, err := getUserVideosQuery.Query(user.ID, BundleJob)
 
 	if err != nil {
 		logger.Log.Error("failed to execute query", "error", err)
@@ -184,8 +447,11 @@ func GetVideos(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		var description string
 		var thumbnail sql.NullString
 		var status VideoStatus
+		var failureReason sql.NullString
+		var tags []string
+		var liveStatus sql.NullString
 
-		err := rows.Scan(&id, &title, &description, &thumbnail, &status)
+		err := rows.Scan(&id, &title, &description, &thumbnail, &status, &failureReason, pq.Array(&tags), &liveStatus)
 
 		if err != nil {
 			logger.Log.Error("failed to scan row", "error", err)
@@ -199,11 +465,14 @@ func GetVideos(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		}
 
 		record := VideoResponseType{
-			ID:          id,
-			Title:       title,
-			Description: description,
-			Thumbnail:   thumbValue,
-			Status:      status,
+			ID:            id,
+			Title:         title,
+			Description:   description,
+			Thumbnail:     thumbValue,
+			Status:        status,
+			FailureReason: failureReason.String,
+			Tags:          tags,
+			LiveStatus:    LiveStatus(liveStatus.String),
 		}
 
 		records = append(records, record)
@@ -237,7 +506,7 @@ func GetVideo(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 
 	detailsQuery, err := db.Prepare(`
 		SELECT
-			title, description
+			title, description, tags
 		FROM
 			videos
 		WHERE
@@ -255,7 +524,8 @@ func GetVideo(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	defer detailsQuery.Close()
 
 	var title, description string
-	err = detailsQuery.QueryRow(videoId, user.ID).Scan(&title, &description)
+	var tags []string
+	err = detailsQuery.QueryRow(videoId, user.ID).Scan(&title, &description, pq.Array(&tags))
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -272,6 +542,7 @@ func GetVideo(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		ID:          videoId,
 		Title:       title,
 		Description: description,
+		Tags:        tags,
 	}
 	videoDetailsJSON, err := json.Marshal(videoDetails)
 
@@ -291,68 +562,257 @@ func GetVideo(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 func ManifestFileHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	videoId := strings.Split(r.URL.Path[1:], "/")[1]
 
-	file, err := utils.GetManifestFile(w, videoId)
+	storageID, token, ok := playbackToken(w, r, db, videoId)
+	if !ok {
+		return
+	}
 
-	if err != nil {
-		logger.Log.Error("failed to retrieve manifest file", "videoId", videoId, "error", err)
-		utils.SendError(w, http.StatusInternalServerError, "Error retrieving video")
-	} else {
-		w.Header().Set("Content-Type", "application/x-mpegURL")
-		w.WriteHeader(http.StatusOK)
-		w.Write(file)
+	// live streams have a single rendition, whose rolling playlist takes
+	// the place of the master playlist
+	if jobs.IsLive(videoId) {
+		serveLivePlaylist(w, r, videoId, token)
+		return
 	}
+
+	servePlaylist(w, r, storage.ManifestKey(storageID), token)
 }
 
-// @desc Get TS File
-// @route GET /video/[id]/stream/[id].ts
-func TSFileHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	videoName := strings.Split(r.URL.Path[1:], "/")[3]
-	videoComps := strings.Split(videoName, ".")
-	segment := videoComps[0]
-	fileId := utils.GetFileId(segment)
+// @desc Get Media Playlist of a Rendition
+// @route GET /video/[id]/stream/[name].m3u8
+func PlaylistFileHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	pathComps := strings.Split(r.URL.Path[1:], "/")
+	videoId := pathComps[1]
+	playlist := strings.TrimSuffix(pathComps[3], "/")
 
-	getSegmentFile := "https://cloud.appwrite.io/v1/storage/buckets/" + config.AppConfig.AppwriteBucketID + "/files/" + fileId + "/view"
+	storageID, token, ok := playbackToken(w, r, db, videoId)
+	if !ok {
+		return
+	}
 
-	request, err := http.NewRequest(http.MethodGet, getSegmentFile, nil)
+	if jobs.IsLive(videoId) {
+		serveLivePlaylist(w, r, videoId, token)
+		return
+	}
 
-	if err != nil {
-		logger.Log.Error("failed to get user from request", "segment", segment, "error", err)
-		utils.SendError(w, http.StatusUnauthorized, "Unauthorized")
+	servePlaylist(w, r, storage.ObjectKey(storageID, playlist), token)
+}
+
+// @desc Get Segment File (.ts, or .m4s and the .mp4 init segment in fMP4 mode)
+// @route GET /video/[id]/stream/[name]
+func SegmentFileHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	pathComps := strings.Split(r.URL.Path[1:], "/")
+	videoId := pathComps[1]
+	segment := strings.TrimSuffix(pathComps[3], "/")
+
+	if jobs.IsLive(videoId) {
+		if token := r.URL.Query().Get("token"); token != "" {
+			if _, ok := verifyPlaybackToken(w, r, token, videoId); !ok {
+				return
+			}
+		}
+		serveLiveSegment(w, r, videoId, segment)
 		return
 	}
 
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("X-Appwrite-Response-Format", config.AppConfig.AppwriteResponseFormat)
-	request.Header.Set("X-Appwrite-Project", config.AppConfig.AppwriteProjectID)
-	request.Header.Set("X-Appwrite-Key", config.AppConfig.AppwriteKey)
+	// the playback token says where the video is stored, so segments are
+	// served without going to the database
+	var storageID string
+	if token := r.URL.Query().Get("token"); token != "" {
+		claims, ok := verifyPlaybackToken(w, r, token, videoId)
+		if !ok {
+			return
+		}
+		storageID = claims.StorageID
+	} else {
+		storageID = storageIDOf(db, videoId)
+	}
+
+	key := storage.ObjectKey(storageID, segment)
+	if redirectToPresignedURL(w, r, key) {
+		return
+	}
 
-	client := &http.Client{}
+	serveObject(w, r, key, utils.ContentTypeOf(segment), segmentCache)
+}
 
-	response, err := client.Do(request)
-	if err != nil {
-		logger.Log.Error("failed to fetch segment file", "segment", segment, "error", err)
-		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+// @desc Get DASH Manifest
+// @route GET /video/[id]/dash/manifest.mpd
+func DashManifestHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	videoId := strings.Split(r.URL.Path[1:], "/")[1]
+
+	serveObject(w, r, storage.DashManifestKey(storageIDOf(db, videoId)), "application/dash+xml", manifestCache)
+}
+
+// @desc Get DASH Segment
+// @route GET /video/[id]/dash/[name].m4s
+func DashSegmentHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	pathComps := strings.Split(r.URL.Path[1:], "/")
+	videoId := pathComps[1]
+	segment := strings.TrimSuffix(pathComps[3], "/")
+
+	key := storage.ObjectKey(storageIDOf(db, videoId), segment)
+	if redirectToPresignedURL(w, r, key) {
 		return
 	}
-	defer response.Body.Close()
 
-	if response.StatusCode == 404 {
-		logger.Log.Error("segment file not found", "segment", segment)
-		utils.SendError(w, http.StatusNotFound, "Segment file not found")
+	serveObject(w, r, key, "video/iso.segment", segmentCache)
+}
+
+// @desc Get Thumbnail
+// @route GET /video/[id]/thumbnail
+func ThumbnailHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	videoId := strings.Split(r.URL.Path[1:], "/")[1]
+
+	key := storage.ThumbnailKey(storageIDOf(db, videoId))
+	if redirectToPresignedURL(w, r, key) {
 		return
 	}
 
-	bodyBytes, err := io.ReadAll(response.Body)
+	serveObject(w, r, key, "image/png", thumbnailCache)
+}
+
+// @desc Get an Encryption Key of the Segments of a Video
+// @route GET /video/[id]/key?n=[number]
+func KeyHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	videoId := strings.Split(r.URL.Path[1:], "/")[1]
+
+	index := 0
+	if n := r.URL.Query().Get("n"); n != "" {
+		parsed, err := strconv.Atoi(n)
+		if err != nil || parsed < 0 {
+			utils.SendError(w, http.StatusBadRequest, "Invalid key number")
+			return
+		}
+		index = parsed
+	}
 
+	// keys only go to the owner of the video, who either sends the login
+	// cookie or a playback token issued to them
+	var userID string
+	if token := r.URL.Query().Get("token"); token != "" {
+		claims, ok := verifyPlaybackToken(w, r, token, videoId)
+		if !ok {
+			return
+		}
+		userID = claims.UserID
+	} else {
+		user, err := utils.GetUserFromRequest(r)
+		if err != nil || user == nil {
+			logger.Log.Error("failed to get user from request", "error", err)
+			utils.SendError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		userID = user.ID
+	}
+
+	key, err := repositories.NewKeyRepository(db).Find(videoId, userID, index)
 	if err != nil {
-		logger.Log.Error("failed to read segment file", "segment", segment, "error", err)
-		utils.SendError(w, http.StatusInternalServerError, "Error reading segment file")
+		logger.Log.Error("failed to look up encryption key", "videoId", videoId, "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if key == nil {
+		logger.Log.Warn("refused encryption key", "videoId", videoId, "userId", userID, "key", index)
+		utils.SendError(w, http.StatusNotFound, "Key not found")
 		return
 	}
 
-	w.Header().Set("Content-Type", "video/MP2T")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "private, no-store")
 	w.WriteHeader(http.StatusOK)
-	w.Write(bodyBytes)
+	w.Write(key)
+}
+
+// storageIDOf returns the ID the stored output of a video is kept under,
+// which differs from the video's own for videos sharing the output of an
+// identical one
+func storageIDOf(db *sql.DB, videoId string) string {
+	storageID, err := repositories.NewVideoRepository(db).StorageID(videoId)
+	if err != nil {
+		logger.Log.Error("failed to look up storage ID", "videoId", videoId, "error", err)
+	}
+	if storageID == "" {
+		return videoId
+	}
+	return storageID
+}
+
+// playbackToken returns where a video is stored and the token to sign the
+// URIs of its playlists with. Requests that carry a token keep using it,
+// so a shared link does not outlive it, the owner of the video gets a new
+// one.
+func playbackToken(w http.ResponseWriter, r *http.Request, db *sql.DB, videoId string) (string, string, bool) {
+	if token := r.URL.Query().Get("token"); token != "" {
+		claims, ok := verifyPlaybackToken(w, r, token, videoId)
+		if !ok {
+			return "", "", false
+		}
+		return claims.StorageID, token, true
+	}
+
+	user, err := utils.GetUserFromRequest(r)
+	if err != nil || user == nil {
+		logger.Log.Error("failed to get user from request", "error", err)
+		utils.SendError(w, http.StatusUnauthorized, "Unauthorized")
+		return "", "", false
+	}
+
+	storageID, err := repositories.NewVideoRepository(db).OwnedStorageID(videoId, user.ID)
+	if err != nil {
+		logger.Log.Error("failed to look up storage ID", "videoId", videoId, "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return "", "", false
+	}
+	if storageID == "" {
+		utils.SendError(w, http.StatusNotFound, "Video not found")
+		return "", "", false
+	}
+
+	token, err := utils.GeneratePlaybackToken(r, videoId, storageID, user.ID)
+	if err != nil {
+		logger.Log.Error("failed to generate playback token", "videoId", videoId, "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return "", "", false
+	}
+	return storageID, token, true
+}
+
+func verifyPlaybackToken(w http.ResponseWriter, r *http.Request, token string, videoId string) (*utils.PlaybackClaims, bool) {
+	claims, err := utils.VerifyPlaybackToken(r, token, videoId)
+	if err != nil {
+		logger.Log.Warn("rejected playback token", "videoId", videoId, "error", err)
+		utils.SendError(w, http.StatusForbidden, "Invalid or expired playback token")
+		return nil, false
+	}
+	return claims, true
+}
+
+// redirectToPresignedURL sends the client straight to the store when it
+// supports presigned URLs and S3_PRESIGN_EXPIRY is set, so the object
+// does not have to pass through the server.
+func redirectToPresignedURL(w http.ResponseWriter, r *http.Request, key string) bool {
+	if config.AppConfig.S3PresignExpiry <= 0 {
+		return false
+	}
+
+	store, err := storage.GetStore()
+	if err != nil {
+		return false
+	}
+
+	presigner, ok := store.(storage.Presigner)
+	if !ok {
+		return false
+	}
+
+	presignedURL, err := presigner.PresignGet(key, config.AppConfig.S3PresignExpiry)
+	if err != nil {
+		logger.Log.Error("failed to presign object URL", "key", key, "error", err)
+		return false
+	}
+
+	http.Redirect(w, r, presignedURL, http.StatusFound)
+	return true
 }
 
 // @desc Update Video Details
@@ -426,13 +886,21 @@ func UpdateHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 func DeleteHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	videoId := r.URL.Path[len("/video/"):]
 
+	user, err := utils.GetUserFromRequest(r)
+	if err != nil {
+		logger.Log.Error("failed to get user from request", "error", err)
+		utils.SendError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// only the owner may delete a video, or stop its live stream
 	updateStatement, err := db.Prepare(`
 		UPDATE
 			videos
 		SET
 			delete_flag=$1
 			WHERE
-			video_id=$2;
+			video_id=$2 AND user_id=$3;
 	`)
 
 	if err != nil {
@@ -441,7 +909,7 @@ func DeleteHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
-	_, err = updateStatement.Exec(1, videoId)
+	result, err := updateStatement.Exec(1, videoId, user.ID)
 
 	if err != nil {
 		logger.Log.Error("failed to execute update statement", "error", err)
@@ -449,8 +917,16 @@ func DeleteHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		utils.SendError(w, http.StatusNotFound, "Video not found")
+		return
+	}
+
+	// the recording of a live stream is dropped once it stops
+	jobs.StopLive(videoId)
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
 
-	go utils.DeleteVideo(w, r, db, videoId)
+	go utils.DeleteVideo(db, videoId)
 }
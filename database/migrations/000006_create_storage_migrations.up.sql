@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS storage_migrations (
+    video_id TEXT NOT NULL,
+    target TEXT NOT NULL,
+    completed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (video_id, target)
+);
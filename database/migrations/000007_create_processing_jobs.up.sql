@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS processing_jobs (
+    id BIGSERIAL PRIMARY KEY,
+    video_id TEXT NOT NULL,
+    kind TEXT NOT NULL DEFAULT 'transcode',
+    state TEXT NOT NULL DEFAULT 'queued' CHECK (state IN ('queued', 'running', 'completed', 'failed')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    max_attempts INTEGER NOT NULL DEFAULT 3,
+    last_error TEXT,
+    lease_expires_at TIMESTAMP,
+    run_after TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (video_id) REFERENCES videos(video_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS processing_jobs_claim_idx ON processing_jobs (state, run_after);
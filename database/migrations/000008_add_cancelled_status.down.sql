@@ -0,0 +1,17 @@
+UPDATE videos SET status = -1 WHERE status = -2;
+
+ALTER TABLE videos
+DROP CONSTRAINT IF EXISTS videos_status_check;
+
+ALTER TABLE videos
+ADD CONSTRAINT videos_status_check
+CHECK (status IN (-1, 0, 1, 2));
+
+UPDATE processing_jobs SET state = 'failed' WHERE state = 'cancelled';
+
+ALTER TABLE processing_jobs
+DROP CONSTRAINT IF EXISTS processing_jobs_state_check;
+
+ALTER TABLE processing_jobs
+ADD CONSTRAINT processing_jobs_state_check
+CHECK (state IN ('queued', 'running', 'completed', 'failed'));
@@ -0,0 +1,13 @@
+ALTER TABLE videos
+DROP CONSTRAINT IF EXISTS videos_status_check;
+
+ALTER TABLE videos
+ADD CONSTRAINT videos_status_check
+CHECK (status IN (-2, -1, 0, 1, 2));
+
+ALTER TABLE processing_jobs
+DROP CONSTRAINT IF EXISTS processing_jobs_state_check;
+
+ALTER TABLE processing_jobs
+ADD CONSTRAINT processing_jobs_state_check
+CHECK (state IN ('queued', 'running', 'completed', 'failed', 'cancelled'));
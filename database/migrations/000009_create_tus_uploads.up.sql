@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS tus_uploads (
+    video_id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    upload_length BIGINT NOT NULL,
+    upload_offset BIGINT NOT NULL DEFAULT 0,
+    metadata TEXT,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (video_id) REFERENCES videos(video_id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
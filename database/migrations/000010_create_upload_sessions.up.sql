@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS upload_sessions (
+    video_id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    expected_size BIGINT NOT NULL,
+    received_size BIGINT NOT NULL DEFAULT 0,
+    file_sha256 TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (video_id) REFERENCES videos(video_id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS upload_chunks (
+    video_id TEXT NOT NULL,
+    chunk_offset BIGINT NOT NULL,
+    size BIGINT NOT NULL,
+    sha256 TEXT NOT NULL,
+    received_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (video_id, chunk_offset),
+    FOREIGN KEY (video_id) REFERENCES upload_sessions(video_id) ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+ALTER TABLE videos
+ADD COLUMN failure_reason TEXT;
@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS user_quotas;
+DROP TABLE IF EXISTS role_quotas;
+
+ALTER TABLE videos
+DROP COLUMN IF EXISTS duration_seconds,
+DROP COLUMN IF EXISTS output_bytes;
+
+ALTER TABLE users
+DROP COLUMN IF EXISTS role;
@@ -0,0 +1,27 @@
+ALTER TABLE users
+ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user';
+
+ALTER TABLE videos
+ADD COLUMN IF NOT EXISTS output_bytes BIGINT,
+ADD COLUMN IF NOT EXISTS duration_seconds DOUBLE PRECISION;
+
+-- a NULL limit is unlimited
+CREATE TABLE IF NOT EXISTS role_quotas (
+    role TEXT PRIMARY KEY,
+    max_bytes BIGINT,
+    max_videos INTEGER,
+    max_minutes INTEGER
+);
+
+-- limits set on a user take precedence over those of their role
+CREATE TABLE IF NOT EXISTS user_quotas (
+    user_id TEXT PRIMARY KEY,
+    max_bytes BIGINT,
+    max_videos INTEGER,
+    max_minutes INTEGER,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+INSERT INTO role_quotas (role, max_bytes, max_videos, max_minutes)
+VALUES ('user', 10737418240, 100, 600), ('admin', NULL, NULL, NULL)
+ON CONFLICT (role) DO NOTHING;
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS videos_content_sha256_idx;
+
+DROP TABLE IF EXISTS video_storage;
+
+ALTER TABLE videos
+DROP COLUMN IF EXISTS storage_id,
+DROP COLUMN IF EXISTS content_sha256;
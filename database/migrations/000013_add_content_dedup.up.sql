@@ -0,0 +1,18 @@
+ALTER TABLE videos
+ADD COLUMN IF NOT EXISTS content_sha256 TEXT,
+ADD COLUMN IF NOT EXISTS storage_id TEXT;
+
+-- the processed output in the store, keyed by the ID of the video that
+-- produced it, and how many videos play it
+CREATE TABLE IF NOT EXISTS video_storage (
+    storage_id TEXT PRIMARY KEY,
+    ref_count INTEGER NOT NULL DEFAULT 1 CHECK (ref_count >= 0)
+);
+
+INSERT INTO video_storage (storage_id, ref_count)
+SELECT video_id, 1 FROM videos WHERE status = 2
+ON CONFLICT (storage_id) DO NOTHING;
+
+UPDATE videos SET storage_id = video_id WHERE status = 2 AND storage_id IS NULL;
+
+CREATE INDEX IF NOT EXISTS videos_content_sha256_idx ON videos (content_sha256);
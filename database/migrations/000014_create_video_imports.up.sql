@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS video_imports (
+    video_id TEXT PRIMARY KEY,
+    source_url TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (video_id) REFERENCES videos(video_id) ON DELETE CASCADE
+);
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS videos_batch_id_idx;
+
+ALTER TABLE videos
+DROP COLUMN IF EXISTS source_bytes,
+DROP COLUMN IF EXISTS tags,
+DROP COLUMN IF EXISTS batch_id;
+
+DROP TABLE IF EXISTS upload_batches;
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS upload_batches (
+    batch_id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- source_bytes is the size of a video extracted from a batch, which counts
+-- against the quota of its owner until it is processed
+ALTER TABLE videos
+ADD COLUMN IF NOT EXISTS batch_id TEXT REFERENCES upload_batches(batch_id) ON DELETE SET NULL,
+ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}',
+ADD COLUMN IF NOT EXISTS source_bytes BIGINT;
+
+CREATE INDEX IF NOT EXISTS videos_batch_id_idx ON videos(batch_id);
@@ -0,0 +1,9 @@
+-- the AES-128 keys the segments of a processed output are encrypted with,
+-- numbered in the order they are used when keys are rotated
+CREATE TABLE IF NOT EXISTS video_keys (
+    storage_id TEXT NOT NULL REFERENCES video_storage(storage_id) ON DELETE CASCADE,
+    key_index INTEGER NOT NULL,
+    key BYTEA NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (storage_id, key_index)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE videos
+DROP COLUMN IF EXISTS live_seen_at,
+DROP COLUMN IF EXISTS live_status;
@@ -0,0 +1,7 @@
+-- set for videos streamed live: waiting for the publisher to connect, live,
+-- or ended, after which the recording is processed like an upload.
+-- live_seen_at is kept current by the server ingesting the stream, so the
+-- streams of a server that went away can be told apart.
+ALTER TABLE videos
+ADD COLUMN IF NOT EXISTS live_status TEXT CHECK (live_status IN ('waiting', 'live', 'ended')),
+ADD COLUMN IF NOT EXISTS live_seen_at TIMESTAMP;
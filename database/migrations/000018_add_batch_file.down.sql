@@ -0,0 +1,2 @@
+ALTER TABLE videos
+DROP COLUMN IF EXISTS batch_file;
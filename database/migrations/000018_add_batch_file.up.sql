@@ -0,0 +1,4 @@
+-- batch_file is the path of a video in the archive of its bulk upload,
+-- which the extract job takes it out of
+ALTER TABLE videos
+ADD COLUMN IF NOT EXISTS batch_file TEXT;
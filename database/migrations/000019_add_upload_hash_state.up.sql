@@ -0,0 +1,4 @@
+-- hash_state is the SHA-256 of the chunks received so far, saved after
+-- every chunk, so the file does not have to be read again to check it
+ALTER TABLE upload_sessions
+ADD COLUMN IF NOT EXISTS hash_state BYTEA;
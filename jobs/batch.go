@@ -0,0 +1,63 @@
+package jobs
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"video-streaming-server/config"
+	"video-streaming-server/repositories"
+	"video-streaming-server/shared"
+	"video-streaming-server/shared/logger"
+	"video-streaming-server/types"
+	"video-streaming-server/utils"
+)
+
+// QueueBatch creates the videos of a bulk upload with a job each that
+// takes it out of the archive and then queues it for processing. Videos
+// that are not fit for processing fail on their own without holding up
+// the rest, the archive is removed once none are left to extract.
+func QueueBatch(db *sql.DB, batchID string, userID string, entries []types.BatchEntry) error {
+	repository := repositories.NewBatchRepository(db)
+	if err := repository.Create(batchID, userID, entries, config.AppConfig.JobMaxAttempts); err != nil {
+		return fmt.Errorf("error queueing batch %s: %w", batchID, err)
+	}
+
+	wakeWorker()
+	return nil
+}
+
+// reportBatchProgress sends the progress of the bulk upload a video came
+// with, if any, to its owner, and removes its archive once every video
+// is out of it
+func reportBatchProgress(db *sql.DB, videoID string, userID types.UserID) {
+	repository := repositories.NewBatchRepository(db)
+
+	batchID, err := repository.FindByVideo(videoID)
+	if err != nil {
+		logger.Log.Error("error looking up batch of video", "video_id", videoID, "error", err)
+		return
+	}
+	if batchID == "" {
+		return
+	}
+
+	progress, err := repository.GetProgress(batchID, string(userID))
+	if err != nil {
+		logger.Log.Error("error getting batch progress", "batch_id", batchID, "error", err)
+		return
+	}
+	if progress == nil {
+		return
+	}
+	shared.SendEventToUser(userID, "batch_progress", progress)
+
+	if progress.Extracting == 0 {
+		err := os.Remove(utils.BatchArchivePath(batchID))
+		if err == nil {
+			logger.Log.Info("batch extracted", "batch_id", batchID, "videos", progress.Total)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			logger.Log.Error("error removing batch archive", "batch_id", batchID, "error", err)
+		}
+	}
+}
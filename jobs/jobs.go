@@ -0,0 +1,339 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"video-streaming-server/config"
+	"video-streaming-server/repositories"
+	"video-streaming-server/shared"
+	"video-streaming-server/shared/logger"
+	"video-streaming-server/storage"
+	"video-streaming-server/types"
+	"video-streaming-server/utils"
+)
+
+var (
+	errJobCancelled = errors.New("job cancelled")
+	errLeaseLost    = errors.New("job lease lost")
+)
+
+// running holds a way to stop every job this server is working on, by
+// video ID
+var running = struct {
+	sync.Mutex
+	cancels map[string]context.CancelCauseFunc
+}{cancels: make(map[string]context.CancelCauseFunc)}
+
+// workers poll for jobs at this interval when nobody wakes them up, which
+// is how jobs queued by other server instances or waiting for a retry are
+// picked up
+const pollInterval = 5 * time.Second
+
+// processingFailed is the reason shown for a video whose job ran out of
+// attempts, the errors themselves are only logged
+const processingFailed = "The video could not be processed"
+
+// wake is signalled when a job is queued so an idle worker claims it right
+// away
+var wake = make(chan struct{}, 1)
+
+// Enqueue queues a job for a video and wakes up an idle worker
+func Enqueue(db *sql.DB, videoID string, kind types.JobKind) error {
+	repository := repositories.NewJobRepository(db)
+	if err := repository.Enqueue(videoID, kind, config.AppConfig.JobMaxAttempts); err != nil {
+		return fmt.Errorf("error queueing %s job for video %s: %w", kind, videoID, err)
+	}
+
+	wakeWorker()
+	return nil
+}
+
+func wakeWorker() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start queues the uploads a previous run left unprocessed and launches
+// JOB_WORKERS workers. Jobs that were running when a server went away are
+// claimed again once their lease expires.
+func Start(ctx context.Context, db *sql.DB) error {
+	repository := repositories.NewJobRepository(db)
+
+	orphaned, err := repository.EnqueueOrphanedUploads(config.AppConfig.JobMaxAttempts)
+	if err != nil {
+		return fmt.Errorf("error queueing orphaned uploads: %w", err)
+	}
+	if orphaned > 0 {
+		logger.Log.Info("queued orphaned uploads", "count", orphaned)
+	}
+
+	for i := 0; i < config.AppConfig.JobWorkers; i++ {
+		go work(ctx, repository, db, i)
+	}
+
+	logger.Log.Info("job workers started", "workers", config.AppConfig.JobWorkers)
+	return nil
+}
+
+func work(ctx context.Context, repository repositories.JobRepository, db *sql.DB, worker int) {
+	workerLogger := logger.Log.With("worker", worker)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		// drain the queue before going back to sleep
+		for {
+			job, err := repository.Claim(config.AppConfig.JobLease)
+			if err != nil {
+				workerLogger.Error("error claiming job", "error", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			run(ctx, repository, db, job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func run(ctx context.Context, repository repositories.JobRepository, db *sql.DB, job *types.Job) {
+	jobLogger := logger.Log.With("job_id", job.ID, "video_id", job.VideoID, "kind", job.Kind, "attempt", job.Attempts)
+
+	var err error
+	if job.Attempts > job.MaxAttempts {
+		// only expired leases are claimed past the last attempt, the
+		// server running it must have died every time
+		err = fmt.Errorf("job lease expired on its last attempt")
+	} else {
+		jobLogger.Info("running job")
+		err = runWithLease(ctx, repository, db, job)
+	}
+
+	if errors.Is(err, errJobCancelled) {
+		jobLogger.Info("job cancelled")
+		discard(db, job.VideoID, job.VideoTitle, job.UserID)
+		return
+	}
+
+	if errors.Is(err, errLeaseLost) {
+		// whoever holds the lease now owns the job
+		jobLogger.Warn("job abandoned after losing its lease")
+		return
+	}
+
+	if err == nil {
+		completed, err := repository.Complete(job)
+		if err != nil {
+			jobLogger.Error("error marking job completed", "error", err)
+		} else if !completed {
+			released(repository, db, job)
+			return
+		}
+		jobLogger.Info("job completed")
+		reportBatchProgress(db, job.VideoID, job.UserID)
+		return
+	}
+
+	jobLogger.Error("job failed", "error", err)
+
+	// videos that are not fit for processing fail right away, with the
+	// reason shown to their owner
+	reason := processingFailed
+	var invalid *utils.MediaValidationError
+	permanent := errors.As(err, &invalid)
+	if permanent {
+		reason = invalid.Reason
+	}
+
+	failed, failErr := repository.Fail(job, err, retryDelay(job.Attempts), permanent)
+	if errors.Is(failErr, sql.ErrNoRows) {
+		released(repository, db, job)
+		return
+	}
+	if failErr != nil {
+		jobLogger.Error("error recording job failure", "error", failErr)
+		return
+	}
+	if !failed {
+		jobLogger.Info("job will be retried")
+		return
+	}
+
+	if err := utils.FailVideo(db, job.VideoID, reason); err != nil {
+		jobLogger.Error("error updating upload status for video in DB", "error", err)
+	}
+	shared.SendEventToUser(job.UserID, "video_status", types.VideoResponseType{
+		ID:            job.VideoID,
+		Title:         job.VideoTitle,
+		Status:        types.ProcessingFailed,
+		FailureReason: reason,
+	})
+	reportBatchProgress(db, job.VideoID, job.UserID)
+}
+
+// released handles a job that finished after this worker stopped holding
+// it. A cancel may have been acknowledged while the job was past its last
+// check, so the video could have been completed since, its files are
+// discarded here. A job whose lease was lost belongs to whoever claimed it.
+func released(repository repositories.JobRepository, db *sql.DB, job *types.Job) {
+	jobLogger := logger.Log.With("job_id", job.ID, "video_id", job.VideoID, "kind", job.Kind, "attempt", job.Attempts)
+
+	cancelled, err := repository.IsCancelled(job)
+	if err != nil {
+		jobLogger.Error("error checking whether job was cancelled", "error", err)
+		return
+	}
+	if !cancelled {
+		jobLogger.Warn("job finished after losing its lease")
+		return
+	}
+
+	jobLogger.Info("job cancelled while finishing")
+	discard(db, job.VideoID, job.VideoTitle, job.UserID)
+}
+
+// runWithLease runs a job while renewing its lease in the background. The
+// job is stopped when the lease is lost, since another worker may have
+// claimed it by then, or when it was cancelled, which servers other than
+// the one it runs on can only tell by the lease renewal failing.
+func runWithLease(ctx context.Context, repository repositories.JobRepository, db *sql.DB, job *types.Job) error {
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	running.Lock()
+	running.cancels[job.VideoID] = cancel
+	running.Unlock()
+	defer func() {
+		running.Lock()
+		delete(running.cancels, job.VideoID)
+		running.Unlock()
+	}()
+
+	lease := config.AppConfig.JobLease
+	go func() {
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-jobCtx.Done():
+				return
+			case <-ticker.C:
+				held, err := repository.ExtendLease(job, lease)
+				if err != nil {
+					logger.Log.Error("error extending job lease", "job_id", job.ID, "error", err)
+				} else if !held {
+					if cancelled, err := repository.IsCancelled(job); err == nil && cancelled {
+						cancel(errJobCancelled)
+					} else {
+						logger.Log.Warn("job lease lost, stopping job", "job_id", job.ID)
+						cancel(errLeaseLost)
+					}
+					return
+				}
+			}
+		}
+	}()
+
+	var err error
+	switch job.Kind {
+	case types.TranscodeJob:
+		err = utils.PostUploadProcessFile(jobCtx, db, job.VideoID, job.VideoTitle, job.UserID)
+	case types.ImportJob:
+		// the download is its own job so a failed transcode does not
+		// download the video again
+		err = utils.ImportVideo(jobCtx, db, job.VideoID, job.UserID)
+		if err == nil {
+			err = Enqueue(db, job.VideoID, types.TranscodeJob)
+		}
+	case types.ExtractJob:
+		var extracted bool
+		extracted, err = utils.ExtractBatchVideo(jobCtx, db, job.VideoID, job.UserID)
+		if err == nil && extracted {
+			err = Enqueue(db, job.VideoID, types.TranscodeJob)
+		}
+	case types.BundleJob:
+		err = utils.ImportBundle(jobCtx, db, job.VideoID, job.VideoTitle, job.UserID)
+	default:
+		err = fmt.Errorf("unknown job kind %s", job.Kind)
+	}
+
+	if cause := context.Cause(jobCtx); err != nil && (cause == errJobCancelled || cause == errLeaseLost) {
+		return cause
+	}
+	return err
+}
+
+// Cancel stops the processing of a video. A job running on this server is
+// stopped right away and one running on another server once it fails to
+// renew its lease, the worker running it then cleans up. Otherwise the
+// files are discarded here.
+func Cancel(db *sql.DB, videoID string, videoTitle string, userID types.UserID) error {
+	if IsLive(videoID) {
+		// marked cancelled first, so the recording is dropped rather than
+		// queued once the stream stops
+		if err := utils.UpdateVideoStatus(db, videoID, types.Cancelled); err != nil {
+			return fmt.Errorf("error cancelling live stream of video %s: %w", videoID, err)
+		}
+		StopLive(videoID)
+	}
+
+	repository := repositories.NewJobRepository(db)
+
+	state, leaseExpired, err := repository.Cancel(videoID)
+	if err != nil {
+		return fmt.Errorf("error cancelling jobs of video %s: %w", videoID, err)
+	}
+
+	if state == types.JobRunning && !leaseExpired {
+		running.Lock()
+		cancel, ok := running.cancels[videoID]
+		running.Unlock()
+		if ok {
+			cancel(errJobCancelled)
+		}
+		return nil
+	}
+
+	go discard(db, videoID, videoTitle, userID)
+	return nil
+}
+
+// discard removes the files of a cancelled video and lets its owner know
+func discard(db *sql.DB, videoID string, videoTitle string, userID types.UserID) {
+	discardLogger := logger.Log.With("video_id", videoID)
+
+	store, err := storage.GetStore()
+	if err != nil {
+		discardLogger.Error("error getting object store", "error", err)
+	} else if err := utils.DiscardVideoFiles(context.Background(), store, videoID); err != nil {
+		discardLogger.Error("error discarding files of cancelled video", "error", err)
+	}
+
+	if err := utils.UpdateVideoStatus(db, videoID, types.Cancelled); err != nil {
+		discardLogger.Error("error updating upload status for video in DB", "error", err)
+	}
+	shared.SendEventToUser(userID, "video_status", types.VideoResponseType{
+		ID:     videoID,
+		Title:  videoTitle,
+		Status: types.Cancelled,
+	})
+	reportBatchProgress(db, videoID, userID)
+}
+
+// retryDelay backs off exponentially between attempts, starting at 30s
+func retryDelay(attempts int) time.Duration {
+	return time.Duration(30<<(attempts-1)) * time.Second
+}
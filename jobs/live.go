@@ -0,0 +1,282 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"video-streaming-server/config"
+	"video-streaming-server/repositories"
+	"video-streaming-server/shared"
+	"video-streaming-server/shared/logger"
+	"video-streaming-server/types"
+	"video-streaming-server/utils"
+)
+
+// ErrNoLivePort is returned when every port of LIVE_PORTS is taken
+var ErrNoLivePort = errors.New("no free live ingest port")
+
+// liveHeartbeat is how often a server records that it is still ingesting
+// its live streams, those nobody reported on for three times as long are
+// failed
+const liveHeartbeat = 30 * time.Second
+
+const liveInterrupted = "The live stream was interrupted"
+
+// liveStream is a live stream this server is ingesting
+type liveStream struct {
+	videoID string
+	title   string
+	userID  types.UserID
+	port    int
+	stop    context.CancelFunc
+}
+
+// live holds the live streams this server is ingesting, by video ID
+var live = struct {
+	sync.Mutex
+	streams map[string]*liveStream
+}{streams: make(map[string]*liveStream)}
+
+// StartLive keeps the live streams of this server marked as being ingested
+// and fails those of servers that went away
+func StartLive(ctx context.Context, db *sql.DB) {
+	repository := repositories.NewLiveRepository(db)
+
+	go func() {
+		ticker := time.NewTicker(liveHeartbeat)
+		defer ticker.Stop()
+
+		for {
+			if videoIDs := liveVideoIDs(); len(videoIDs) > 0 {
+				alive, err := repository.Touch(videoIDs)
+				if err != nil {
+					logger.Log.Error("error recording live streams as alive", "error", err)
+				} else {
+					stopCancelledLive(videoIDs, alive)
+				}
+			}
+
+			failed, err := repository.FailAbandoned(3*liveHeartbeat, liveInterrupted)
+			if err != nil {
+				logger.Log.Error("error failing abandoned live streams", "error", err)
+			} else if failed > 0 {
+				logger.Log.Info("failed abandoned live streams", "count", failed)
+			}
+
+			if !config.AppConfig.LiveEnabled {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// GoLive starts listening for the publisher of a live stream on a free
+// port of LIVE_PORTS and returns the URL to publish it to
+func GoLive(db *sql.DB, videoID string, title string, userID types.UserID) (string, error) {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("error generating stream key: %w", err)
+	}
+	key := hex.EncodeToString(secret)
+
+	live.Lock()
+	port := freeLivePort()
+	if port == 0 {
+		live.Unlock()
+		return "", ErrNoLivePort
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	stream := &liveStream{videoID: videoID, title: title, userID: userID, port: port, stop: stop}
+	live.streams[videoID] = stream
+	live.Unlock()
+
+	listenURL, publishURL := utils.LiveIngestURLs(port, key)
+	go ingest(ctx, db, stream, listenURL)
+	return publishURL, nil
+}
+
+// StopLive ends the live stream of a video, and reports whether this
+// server was ingesting it. The recording is processed as usual, unless
+// the video was cancelled or deleted.
+func StopLive(videoID string) bool {
+	live.Lock()
+	defer live.Unlock()
+
+	stream, ok := live.streams[videoID]
+	if ok {
+		stream.stop()
+	}
+	return ok
+}
+
+// IsLive reports whether this server is ingesting a live stream of the
+// video, whose playlist and segments are then kept in utils.LiveDir
+func IsLive(videoID string) bool {
+	live.Lock()
+	defer live.Unlock()
+
+	_, ok := live.streams[videoID]
+	return ok
+}
+
+func liveVideoIDs() []string {
+	live.Lock()
+	defer live.Unlock()
+
+	videoIDs := make([]string, 0, len(live.streams))
+	for videoID := range live.streams {
+		videoIDs = append(videoIDs, videoID)
+	}
+	return videoIDs
+}
+
+// stopCancelledLive stops the streams of videos that were cancelled or
+// deleted, possibly through another server
+func stopCancelledLive(videoIDs []string, alive []string) {
+	isAlive := make(map[string]bool, len(alive))
+	for _, videoID := range alive {
+		isAlive[videoID] = true
+	}
+
+	for _, videoID := range videoIDs {
+		if !isAlive[videoID] {
+			logger.Log.Info("stopping live stream of cancelled video", "video_id", videoID)
+			StopLive(videoID)
+		}
+	}
+}
+
+// freeLivePort returns a port of LIVE_PORTS no stream uses and nothing
+// else listens on, or 0. The caller holds the lock.
+func freeLivePort() int {
+	used := make(map[int]bool)
+	for _, stream := range live.streams {
+		used[stream.port] = true
+	}
+
+	for port := config.AppConfig.LivePortMin; port <= config.AppConfig.LivePortMax; port++ {
+		if used[port] {
+			continue
+		}
+
+		// SRT runs over UDP
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(config.AppConfig.Addr, strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		return port
+	}
+	return 0
+}
+
+// ingest runs ffmpeg for a live stream until the publisher disconnects or
+// the stream is stopped, then queues the recording for processing. Streams
+// that are not published within LIVE_WAIT_TIMEOUT are given up.
+func ingest(ctx context.Context, db *sql.DB, stream *liveStream, listenURL string) {
+	liveLogger := logger.Log.With("video_id", stream.videoID, "port", stream.port)
+	repository := repositories.NewLiveRepository(db)
+
+	defer func() {
+		stream.stop()
+		live.Lock()
+		delete(live.streams, stream.videoID)
+		live.Unlock()
+
+		if err := os.RemoveAll(utils.LiveDir(stream.videoID)); err != nil {
+			liveLogger.Error("error removing live directory", "error", err)
+		}
+	}()
+
+	liveLogger.Info("waiting for live stream")
+	waiting := time.AfterFunc(config.AppConfig.LiveWaitTimeout, stream.stop)
+
+	started := false
+	err := utils.RunLiveIngest(ctx, stream.videoID, listenURL, func() {
+		waiting.Stop()
+		started = true
+		liveLogger.Info("live stream started")
+
+		if err := repository.SetStatus(stream.videoID, types.LiveOn); err != nil {
+			liveLogger.Error("error updating live status for video in DB", "error", err)
+		}
+		shared.SendEventToUser(stream.userID, "video_status", types.VideoResponseType{
+			ID:         stream.videoID,
+			Title:      stream.title,
+			Status:     types.UploadPending,
+			LiveStatus: types.LiveOn,
+		})
+	})
+	waiting.Stop()
+	if err != nil {
+		liveLogger.Error("error ingesting live stream", "error", err)
+	}
+
+	reason := ""
+	switch {
+	case !started && err != nil:
+		reason = "The live stream could not be received"
+	case !started:
+		reason = "The live stream was not published"
+	default:
+		liveLogger.Info("live stream ended")
+		// the recording is processed like an upload
+		if _, err := utils.FinishUpload(context.Background(), stream.videoID, "live.mkv"); err != nil {
+			liveLogger.Error("error checking live stream recording", "error", err)
+			reason = processingFailed
+			var invalid *utils.MediaValidationError
+			if errors.As(err, &invalid) {
+				reason = invalid.Reason
+			}
+		}
+	}
+
+	ended, err := repository.End(stream.videoID, reason)
+	if err != nil {
+		liveLogger.Error("error updating live status for video in DB", "error", err)
+		return
+	}
+	if !ended || reason != "" {
+		// cancelled or deleted while it was live, or nothing to process
+		os.Remove(utils.PartialVideoPath(stream.videoID))
+		if sourcePath, err := utils.FindSourceVideo(stream.videoID); err == nil {
+			os.Remove(sourcePath)
+		}
+	}
+	if !ended {
+		return
+	}
+
+	status := types.UploadedOnServer
+	if reason != "" {
+		status = types.ProcessingFailed
+	}
+	shared.SendEventToUser(stream.userID, "video_status", types.VideoResponseType{
+		ID:            stream.videoID,
+		Title:         stream.title,
+		Status:        status,
+		FailureReason: reason,
+		LiveStatus:    types.LiveEnded,
+	})
+
+	if status == types.UploadedOnServer {
+		if err := Enqueue(db, stream.videoID, types.TranscodeJob); err != nil {
+			// the job is queued when the server starts again
+			liveLogger.Error("error queueing live stream recording", "error", err)
+		}
+	}
+}
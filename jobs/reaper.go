@@ -0,0 +1,171 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"video-streaming-server/config"
+	"video-streaming-server/repositories"
+	"video-streaming-server/shared/logger"
+	"video-streaming-server/storage"
+	"video-streaming-server/utils"
+)
+
+// ReapReport lists what a run of the reaper cleaned up
+type ReapReport struct {
+	// Videos are the IDs of the stale uploads that were removed
+	Videos []string
+	// OrphanedPaths are local files and directories no video owns
+	OrphanedPaths []string
+	// Failed counts the uploads that could not be cleaned, they are tried
+	// again on the next run unless their row was deleted already
+	Failed int
+}
+
+// StartReaper removes abandoned uploads every UPLOAD_GC_INTERVAL. It does
+// nothing when the interval or UPLOAD_GC_TTL is zero.
+func StartReaper(ctx context.Context, db *sql.DB) {
+	interval, ttl := config.AppConfig.UploadGCInterval, config.AppConfig.UploadGCTTL
+	if interval <= 0 || ttl <= 0 {
+		logger.Log.Info("upload reaper disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			report, err := Reap(ctx, db, ttl)
+			if err != nil {
+				logger.Log.Error("error reaping abandoned uploads", "error", err)
+			} else if len(report.Videos) > 0 || len(report.OrphanedPaths) > 0 || report.Failed > 0 {
+				logger.Log.Info("reaped abandoned uploads",
+					"videos", len(report.Videos), "orphaned_paths", len(report.OrphanedPaths), "failed", report.Failed)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	logger.Log.Info("upload reaper started", "interval", interval, "ttl", ttl)
+}
+
+// Reap deletes the uploads that were never processed and saw no activity
+// for ttl, with their files and database rows, and then whatever is left
+// in the local working directories without a video to go with it.
+func Reap(ctx context.Context, db *sql.DB, ttl time.Duration) (*ReapReport, error) {
+	repository := repositories.NewVideoRepository(db)
+	report := &ReapReport{}
+
+	store, err := storage.GetStore()
+	if err != nil {
+		return nil, err
+	}
+
+	videos, err := repository.ListStaleUploads(ttl)
+	if err != nil {
+		return nil, fmt.Errorf("error listing stale uploads: %w", err)
+	}
+
+	for _, video := range videos {
+		reapLogger := logger.Log.With("video_id", video.ID, "status", video.Status)
+
+		if err := utils.RemoveLocalFiles(video.ID); err != nil {
+			reapLogger.Error("error removing files of stale upload", "error", err)
+			report.Failed++
+			continue
+		}
+
+		// a video that got as far as storing output, or pointing at that
+		// of an identical video, gives up its reference like on delete
+		storageID, last, err := repository.ReleaseStorage(video.ID)
+		if err != nil {
+			reapLogger.Error("error deleting stale upload", "error", err)
+			report.Failed++
+			continue
+		}
+		if storageID == "" {
+			continue
+		}
+
+		if last {
+			if err := utils.DiscardVideoFiles(ctx, store, storageID); err != nil {
+				reapLogger.Error("error removing stored output of stale upload", "storage_id", storageID, "error", err)
+				report.Failed++
+				continue
+			}
+		}
+
+		reapLogger.Info("removed stale upload", "title", video.Title)
+		report.Videos = append(report.Videos, video.ID)
+	}
+
+	for _, dir := range []string{"video", "segments", "thumbnails"} {
+		orphaned, err := reapOrphanedPaths(repository, repositories.NewBatchRepository(db), dir, ttl)
+		if err != nil {
+			return report, err
+		}
+		report.OrphanedPaths = append(report.OrphanedPaths, orphaned...)
+	}
+
+	return report, nil
+}
+
+// reapOrphanedPaths removes the entries of a working directory, named
+// after a video ID, that have not been touched for ttl and whose video
+// does not exist anymore. Archives of bulk uploads, named after the batch
+// ID, are kept while videos are waiting to be extracted from them.
+func reapOrphanedPaths(repository repositories.VideoRepository, batches repositories.BatchRepository, dir string, ttl time.Duration) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s directory: %w", dir, err)
+	}
+
+	removed := make([]string, 0)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < ttl {
+			continue
+		}
+
+		videoID := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		exists, err := repository.Exists(videoID)
+		if err != nil {
+			return removed, fmt.Errorf("error looking up video %s: %w", videoID, err)
+		}
+		if exists {
+			continue
+		}
+		if entry.Name() == filepath.Base(utils.BatchArchivePath(videoID)) {
+			extracting, err := batches.IsExtracting(videoID)
+			if err != nil {
+				return removed, fmt.Errorf("error looking up batch %s: %w", videoID, err)
+			}
+			if extracting {
+				continue
+			}
+		}
+
+		entryPath := filepath.Join(dir, entry.Name())
+		if err := os.RemoveAll(entryPath); err != nil {
+			logger.Log.Error("error removing orphaned path", "path", entryPath, "error", err)
+			continue
+		}
+		logger.Log.Info("removed orphaned path", "path", entryPath)
+		removed = append(removed, entryPath)
+	}
+	return removed, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"encoding/json"
 	"fmt"
@@ -10,15 +11,18 @@ import (
 	"os"
 	"regexp"
 	"time"
+	"video-streaming-server/commands"
 	"video-streaming-server/config"
 	"video-streaming-server/controllers"
 	"video-streaming-server/database"
+	"video-streaming-server/jobs"
 	mw "video-streaming-server/middleware"
 	"video-streaming-server/repositories"
 	"video-streaming-server/services"
 	"video-streaming-server/shared"
 	"video-streaming-server/shared/logger"
 	"video-streaming-server/sse"
+	"video-streaming-server/storage"
 	"video-streaming-server/types"
 	"video-streaming-server/utils"
 )
@@ -27,7 +31,16 @@ import (
 /video/ - Get All Videos
 /video/[id] - Get A Video
 /video/[id]/stream - Get The Manifest File For The Video
-/video/[id]/stream/[filename] - Get The Segment of Video
+/video/[id]/stream/[filename].m3u8 - Get The Media Playlist of a Rendition
+/video/[id]/stream/[filename].(ts|m4s|mp4) - Get The Segment (or fMP4 Init Segment) of Video
+/video/[id]/dash/manifest.mpd - Get The DASH Manifest For The Video
+/video/[id]/dash/[filename].m4s - Get The DASH Segment of Video
+/video/[id]/thumbnail - Get The Thumbnail of Video
+/video/[id]/cancel - Cancel The Upload or Processing of Video
+/video/live - Start a Live Stream
+/video/[id]/stop - Stop The Live Stream of Video
+/video/batch/[id] - Get The Progress of a Bulk Upload
+/video/bundle - Import a Pre-packaged HLS Bundle
 */
 
 func videoHandler(w http.ResponseWriter, r *http.Request) {
@@ -42,16 +55,42 @@ func videoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if method == http.MethodPost {
-		controllers.UploadVideo(w, r, db)
+		if matched, err := regexp.MatchString("^/video/import/?$", path); err == nil && matched {
+			controllers.ImportVideo(w, r, db)
+		} else if matched, err := regexp.MatchString("^/video/batch/?$", path); err == nil && matched {
+			controllers.UploadBatch(w, r, db)
+		} else if matched, err := regexp.MatchString("^/video/bundle/?$", path); err == nil && matched {
+			controllers.UploadBundle(w, r, db)
+		} else if matched, err := regexp.MatchString("^/video/live/?$", path); err == nil && matched {
+			controllers.GoLive(w, r, db)
+		} else if matched, err := regexp.MatchString("^/video/[a-zA-B0-9-]+/cancel/?$", path); err == nil && matched {
+			controllers.CancelHandler(w, r, db)
+		} else if matched, err := regexp.MatchString("^/video/[a-zA-B0-9-]+/stop/?$", path); err == nil && matched {
+			controllers.StopLiveHandler(w, r, db)
+		} else {
+			controllers.UploadVideo(w, r, db)
+		}
 	} else if method == http.MethodGet {
 		if path == "/video/" {
 			controllers.GetVideos(w, r, db)
+		} else if matched, err := regexp.MatchString("^/video/batch/[a-zA-B0-9-]+/?$", path); err == nil && matched {
+			controllers.GetBatch(w, r, db)
 		} else if matched, err := regexp.MatchString("^/video/[a-zA-B0-9-]+/?$", path); err == nil && matched {
 			controllers.GetVideo(w, r, db)
 		} else if matched, err := regexp.MatchString("^/video/[a-zA-B0-9-]+/stream/?$", path); err == nil && matched {
 			controllers.ManifestFileHandler(w, r, db)
-		} else if matched, err := regexp.MatchString("^/video/[a-zA-B0-9-]+/stream/[a-zA-B0-9_-]+.ts/?$", r.URL.Path); err == nil && matched {
-			controllers.TSFileHandler(w, r, db)
+		} else if matched, err := regexp.MatchString("^/video/[a-zA-B0-9-]+/stream/[a-zA-B0-9_-]+.m3u8/?$", path); err == nil && matched {
+			controllers.PlaylistFileHandler(w, r, db)
+		} else if matched, err := regexp.MatchString("^/video/[a-zA-B0-9-]+/stream/[a-zA-B0-9_-]+.(ts|m4s|mp4)/?$", r.URL.Path); err == nil && matched {
+			controllers.SegmentFileHandler(w, r, db)
+		} else if matched, err := regexp.MatchString("^/video/[a-zA-B0-9-]+/dash/manifest.mpd$", path); err == nil && matched {
+			controllers.DashManifestHandler(w, r, db)
+		} else if matched, err := regexp.MatchString("^/video/[a-zA-B0-9-]+/dash/[a-zA-B0-9_-]+.m4s$", path); err == nil && matched {
+			controllers.DashSegmentHandler(w, r, db)
+		} else if matched, err := regexp.MatchString("^/video/[a-zA-B0-9-]+/thumbnail/?$", path); err == nil && matched {
+			controllers.ThumbnailHandler(w, r, db)
+		} else if matched, err := regexp.MatchString("^/video/[a-zA-B0-9-]+/key/?$", path); err == nil && matched {
+			controllers.KeyHandler(w, r, db)
 		} else {
 			response := fmt.Sprintf("Error: handler for %s not found", html.EscapeString(r.URL.Path))
 			http.Error(w, response, http.StatusNotFound)
@@ -67,6 +106,44 @@ func videoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func uploadsHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := database.GetDBConn()
+
+	if err != nil {
+		logger.Log.Error("failed to get database connection", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	controllers.TusHandler(w, r, db)
+}
+
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := database.GetDBConn()
+
+	if err != nil {
+		logger.Log.Error("failed to get database connection", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	quotaRepository := repositories.NewQuotaRepository(db)
+	quotaService := services.NewQuotaService(quotaRepository)
+	controllers.GetUsage(w, r, quotaService)
+}
+
+func adminCacheHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := database.GetDBConn()
+
+	if err != nil {
+		logger.Log.Error("failed to get database connection", "error", err)
+		utils.SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	controllers.GetCacheStats(w, r, db)
+}
+
 func homePageHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.URL.Path != "/" {
@@ -176,15 +253,9 @@ func configHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	supportedFileTypes := []config.FileType{
-		{FileType: "video/mp4", FileExtension: ".mp4"},
-		{FileType: "video/x-matroska", FileExtension: ".mkv"},
-		{FileType: "video/quicktime", FileExtension: ".mov"},
-	}
-
 	response := config.ConfigResponse{
 		FileSizeLimit:      fileSizeLimit,
-		SupportedFileTypes: supportedFileTypes,
+		SupportedFileTypes: config.SupportedFileTypes,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -298,7 +369,10 @@ func setUpRoutes() {
 	http.HandleFunc("/list", utils.Chain(listPageHandler, mw.Logging, mw.AuthRequired))
 	http.HandleFunc("/watch", utils.Chain(watchPageHandler, mw.Logging, mw.AuthRequired))
 	http.HandleFunc("/config", configHandler)
-	http.HandleFunc("/video/", utils.Chain(videoHandler, mw.Logging, mw.AuthRequired))
+	http.HandleFunc("/video/", utils.Chain(videoHandler, mw.Logging, mw.AuthRequiredUnlessSigned))
+	http.HandleFunc("/uploads/", utils.Chain(uploadsHandler, mw.Logging, mw.APIAuthRequired))
+	http.HandleFunc("/me/usage", utils.Chain(usageHandler, mw.Logging, mw.AuthRequired))
+	http.HandleFunc("/admin/cache", utils.Chain(adminCacheHandler, mw.Logging, mw.AuthRequired))
 	http.HandleFunc("/server-events/", utils.Chain(serverSentEventsHandler, mw.Logging, mw.AuthRequired))
 
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
@@ -313,13 +387,40 @@ func main() {
 	}
 
 	logger.Init(config.AppConfig.Debug)
+
+	if len(os.Args) > 1 {
+		if err := commands.Run(os.Args[1:]); err != nil {
+			logger.Log.Error("command failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if _, err := storage.GetStore(); err != nil {
+		logger.Log.Error("failed to initialize object store", "error", err)
+		os.Exit(1)
+	}
+
+	db, err := database.GetDBConn()
+	if err != nil {
+		logger.Log.Error("failed to connect to database", "error", err)
+		os.Exit(1)
+	}
+
+	if err := jobs.Start(context.Background(), db); err != nil {
+		logger.Log.Error("failed to start job workers", "error", err)
+		os.Exit(1)
+	}
+	jobs.StartReaper(context.Background(), db)
+	jobs.StartLive(context.Background(), db)
+
 	setUpRoutes()
 	logger.Log.Info(
 		"Dekho server is listening on",
 		"address", config.AppConfig.Addr,
 		"port", config.AppConfig.Port,
 	)
-	err := http.ListenAndServe(fmt.Sprintf("%s:%s", config.AppConfig.Addr, config.AppConfig.Port), nil)
+	err = http.ListenAndServe(fmt.Sprintf("%s:%s", config.AppConfig.Addr, config.AppConfig.Port), nil)
 	if err != nil {
 		slog.Error("server failed to start", "error", err)
 		os.Exit(1)
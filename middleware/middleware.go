@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"net/http"
+	"regexp"
 	"video-streaming-server/shared/logger"
 	"video-streaming-server/utils"
 )
@@ -25,6 +26,51 @@ func AuthRequired(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// APIAuthRequired is AuthRequired for endpoints used by clients other
+// than the browser pages, which answer 401 rather than redirecting to the
+// login page. OPTIONS requests, like CORS preflights and tus discovery,
+// carry no credentials and are let through.
+func APIAuthRequired(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie("auth_token")
+		if err != nil {
+			utils.SendError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		token, err := utils.VerifyToken(cookie.Value)
+		if err != nil || !token.Valid {
+			utils.SendError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// streamPath matches the playlists, segments and encryption keys of a
+// video, which players may fetch with a playback token instead of the
+// login cookie. DASH and thumbnails are not signed and need the cookie.
+var streamPath = regexp.MustCompile("^/video/[a-zA-B0-9-]+/(stream(/|$)|key/?$)")
+
+// AuthRequiredUnlessSigned is AuthRequired for everything but requests for
+// a stream that carry a playback token, which the handlers verify
+func AuthRequiredUnlessSigned(next http.HandlerFunc) http.HandlerFunc {
+	authRequired := AuthRequired(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && streamPath.MatchString(r.URL.Path) && r.URL.Query().Get("token") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		authRequired.ServeHTTP(w, r)
+	}
+}
+
 func Logging(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		u, _ := utils.GetUserFromRequest(r)
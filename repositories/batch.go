@@ -0,0 +1,171 @@
+package repositories
+
+import (
+	"database/sql"
+	"time"
+	"video-streaming-server/types"
+
+	"github.com/lib/pq"
+)
+
+type BatchRepository interface {
+	Create(batchID string, userID string, entries []types.BatchEntry, maxAttempts int) error
+	GetEntry(videoID string) (string, *types.BatchEntry, error)
+	MarkExtracted(videoID string) (bool, error)
+	FindByVideo(videoID string) (string, error)
+	IsExtracting(batchID string) (bool, error)
+	GetProgress(batchID string, userID string) (*types.BatchProgressType, error)
+}
+
+type batchRepository struct {
+	db *sql.DB
+}
+
+func NewBatchRepository(db *sql.DB) BatchRepository {
+	return &batchRepository{db: db}
+}
+
+// Create inserts a bulk upload together with a video for each of its
+// entries and the job that extracts it. The videos are a millisecond apart
+// so they are listed, and extracted, in the order of the archive.
+func (r *batchRepository) Create(batchID string, userID string, entries []types.BatchEntry, maxAttempts int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO upload_batches (batch_id, user_id)
+		VALUES ($1, $2)
+	`, batchID, userID)
+	if err != nil {
+		return err
+	}
+
+	initiated := time.Now()
+	for i, entry := range entries {
+		_, err = tx.Exec(`
+			INSERT INTO videos (video_id, title, description, upload_initiate_time, status, delete_flag, user_id, batch_id, batch_file, tags, source_bytes)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		`, entry.VideoID, entry.Title, entry.Description, initiated.Add(time.Duration(i)*time.Millisecond),
+			types.UploadPending, 0, userID, batchID, entry.File, pq.Array(entry.Tags), entry.Size)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO processing_jobs (video_id, kind, max_attempts)
+			VALUES ($1, $2, $3)
+		`, entry.VideoID, types.ExtractJob, maxAttempts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetEntry returns the bulk upload a video came with and where it is in
+// its archive, or an empty batch ID for videos uploaded on their own
+func (r *batchRepository) GetEntry(videoID string) (string, *types.BatchEntry, error) {
+	var batchID, file sql.NullString
+	var size sql.NullInt64
+	entry := types.BatchEntry{VideoID: videoID}
+	err := r.db.QueryRow(`
+		SELECT batch_id, batch_file, title, source_bytes FROM videos WHERE video_id = $1
+	`, videoID).Scan(&batchID, &file, &entry.Title, &size)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil, nil
+		}
+		return "", nil, err
+	}
+	if !batchID.Valid || !file.Valid {
+		return "", nil, nil
+	}
+
+	entry.File = file.String
+	entry.Size = size.Int64
+	return batchID.String, &entry, nil
+}
+
+// MarkExtracted marks a video of a bulk upload uploaded once it has been
+// taken out of the archive. It returns false when the video was cancelled
+// or deleted in the meantime.
+func (r *batchRepository) MarkExtracted(videoID string) (bool, error) {
+	result, err := r.db.Exec(`
+		UPDATE videos SET status = $1
+		WHERE video_id = $2 AND status = $3 AND delete_flag = 0
+	`, types.UploadedOnServer, videoID, types.UploadPending)
+
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// FindByVideo returns the bulk upload a video came with, which is empty
+// for videos uploaded on their own
+func (r *batchRepository) FindByVideo(videoID string) (string, error) {
+	var batchID sql.NullString
+	err := r.db.QueryRow(`
+		SELECT batch_id FROM videos WHERE video_id = $1
+	`, videoID).Scan(&batchID)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	return batchID.String, nil
+}
+
+// IsExtracting reports whether videos of a bulk upload are still waiting
+// to be taken out of its archive
+func (r *batchRepository) IsExtracting(batchID string) (bool, error) {
+	var extracting bool
+	err := r.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM videos
+			WHERE batch_id = $1 AND status = $2 AND delete_flag = 0
+		)
+	`, batchID, types.UploadPending).Scan(&extracting)
+
+	return extracting, err
+}
+
+// GetProgress counts the videos of a bulk upload by how far they got,
+// deleted videos are left out
+func (r *batchRepository) GetProgress(batchID string, userID string) (*types.BatchProgressType, error) {
+	progress := types.BatchProgressType{ID: batchID}
+	err := r.db.QueryRow(`
+		SELECT
+			COUNT(videos.video_id),
+			COUNT(videos.video_id) FILTER (WHERE videos.status = $3),
+			COUNT(videos.video_id) FILTER (WHERE videos.status = $4),
+			COUNT(videos.video_id) FILTER (WHERE videos.status = $5),
+			COUNT(videos.video_id) FILTER (WHERE videos.status < $3)
+		FROM upload_batches
+		LEFT JOIN videos ON videos.batch_id = upload_batches.batch_id AND videos.delete_flag = 0
+		WHERE upload_batches.batch_id = $1 AND upload_batches.user_id = $2
+		GROUP BY upload_batches.batch_id
+	`, batchID, userID, types.UploadPending, types.UploadedOnServer, types.ProcessingCompleted).Scan(
+		&progress.Total, &progress.Extracting, &progress.Processing, &progress.Completed, &progress.Failed,
+	)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if progress.Total > 0 {
+		progress.Percent = (progress.Completed + progress.Failed) * 100 / progress.Total
+	}
+	return &progress, nil
+}
@@ -0,0 +1,30 @@
+package repositories
+
+import (
+	"database/sql"
+	"time"
+	"video-streaming-server/types"
+)
+
+type BundleRepository interface {
+	Create(videoID string, userID string, title string, description string) error
+}
+
+type bundleRepository struct {
+	db *sql.DB
+}
+
+func NewBundleRepository(db *sql.DB) BundleRepository {
+	return &bundleRepository{db: db}
+}
+
+// Create inserts the video an HLS bundle is imported as, it stays pending
+// until the bundle job stores it
+func (r *bundleRepository) Create(videoID string, userID string, title string, description string) error {
+	_, err := r.db.Exec(`
+		INSERT INTO videos (video_id, title, description, upload_initiate_time, status, delete_flag, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, videoID, title, description, time.Now(), types.UploadPending, 0, userID)
+
+	return err
+}
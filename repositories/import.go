@@ -0,0 +1,63 @@
+package repositories
+
+import (
+	"database/sql"
+	"time"
+	"video-streaming-server/types"
+)
+
+type ImportRepository interface {
+	Create(videoID string, userID string, request *types.ImportRequest) error
+	GetSourceURL(videoID string) (string, error)
+}
+
+type importRepository struct {
+	db *sql.DB
+}
+
+func NewImportRepository(db *sql.DB) ImportRepository {
+	return &importRepository{db: db}
+}
+
+// Create inserts the video an import creates together with the URL it is
+// downloaded from
+func (r *importRepository) Create(videoID string, userID string, request *types.ImportRequest) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO videos (video_id, title, description, upload_initiate_time, status, delete_flag, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, videoID, request.Title, request.Description, time.Now(), types.UploadPending, 0, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO video_imports (video_id, source_url)
+		VALUES ($1, $2)
+	`, videoID, request.URL)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *importRepository) GetSourceURL(videoID string) (string, error) {
+	var sourceURL string
+	err := r.db.QueryRow(`
+		SELECT source_url FROM video_imports WHERE video_id = $1
+	`, videoID).Scan(&sourceURL)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	return sourceURL, nil
+}
@@ -0,0 +1,187 @@
+package repositories
+
+import (
+	"database/sql"
+	"time"
+	"video-streaming-server/types"
+)
+
+type JobRepository interface {
+	Enqueue(videoID string, kind types.JobKind, maxAttempts int) error
+	EnqueueOrphanedUploads(maxAttempts int) (int64, error)
+	Claim(lease time.Duration) (*types.Job, error)
+	ExtendLease(job *types.Job, lease time.Duration) (bool, error)
+	Complete(job *types.Job) (bool, error)
+	Fail(job *types.Job, cause error, retryAfter time.Duration, permanent bool) (bool, error)
+	Cancel(videoID string) (types.JobState, bool, error)
+	IsCancelled(job *types.Job) (bool, error)
+}
+
+type jobRepository struct {
+	db *sql.DB
+}
+
+func NewJobRepository(db *sql.DB) JobRepository {
+	return &jobRepository{db: db}
+}
+
+func (r *jobRepository) Enqueue(videoID string, kind types.JobKind, maxAttempts int) error {
+	_, err := r.db.Exec(`
+		INSERT INTO processing_jobs (video_id, kind, max_attempts)
+		VALUES ($1, $2, $3)
+	`, videoID, kind, maxAttempts)
+
+	return err
+}
+
+// EnqueueOrphanedUploads queues a transcode for every video that was
+// uploaded completely but has no job yet, e.g. because the server stopped
+// between receiving the last chunk and queueing it.
+func (r *jobRepository) EnqueueOrphanedUploads(maxAttempts int) (int64, error) {
+	result, err := r.db.Exec(`
+		INSERT INTO processing_jobs (video_id, kind, max_attempts)
+		SELECT video_id, $1, $2
+		FROM videos
+		WHERE status = $3
+		AND NOT EXISTS (
+			SELECT 1 FROM processing_jobs
+			WHERE processing_jobs.video_id = videos.video_id
+			AND processing_jobs.state IN ($4, $5)
+		)
+	`, types.TranscodeJob, maxAttempts, types.UploadedOnServer, types.JobQueued, types.JobRunning)
+
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Claim leases the oldest runnable job, which is either queued or was
+// running on a worker whose lease expired. SKIP LOCKED keeps concurrent
+// workers from waiting on, or claiming, the same row. It returns nil when
+// there is nothing to do.
+func (r *jobRepository) Claim(lease time.Duration) (*types.Job, error) {
+	var job types.Job
+	err := r.db.QueryRow(`
+		WITH claimed AS (
+			UPDATE processing_jobs
+			SET state = $1, attempts = attempts + 1, lease_expires_at = NOW() + make_interval(secs => $2), updated_at = NOW()
+			WHERE id = (
+				SELECT id FROM processing_jobs
+				WHERE (state = $3 AND run_after <= NOW())
+				OR (state = $1 AND lease_expires_at < NOW())
+				ORDER BY id
+				LIMIT 1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, video_id, kind, state, attempts, max_attempts, last_error
+		)
+		SELECT claimed.id, claimed.video_id, claimed.kind, claimed.state, claimed.attempts, claimed.max_attempts, claimed.last_error,
+			videos.title, COALESCE(videos.user_id, '')
+		FROM claimed JOIN videos ON videos.video_id = claimed.video_id
+	`, types.JobRunning, lease.Seconds(), types.JobQueued).Scan(
+		&job.ID, &job.VideoID, &job.Kind, &job.State, &job.Attempts, &job.MaxAttempts, &job.LastError,
+		&job.VideoTitle, &job.UserID,
+	)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ExtendLease pushes the lease of a running job forward. The attempt
+// number fences off workers that lost their lease, false is returned when
+// the job was claimed by someone else in the meantime.
+func (r *jobRepository) ExtendLease(job *types.Job, lease time.Duration) (bool, error) {
+	result, err := r.db.Exec(`
+		UPDATE processing_jobs
+		SET lease_expires_at = NOW() + make_interval(secs => $1), updated_at = NOW()
+		WHERE id = $2 AND attempts = $3 AND state = $4
+	`, lease.Seconds(), job.ID, job.Attempts, types.JobRunning)
+
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// Complete marks a job done. It returns false when the worker did not
+// hold it anymore, because it was cancelled or its lease was lost.
+func (r *jobRepository) Complete(job *types.Job) (bool, error) {
+	result, err := r.db.Exec(`
+		UPDATE processing_jobs
+		SET state = $1, lease_expires_at = NULL, last_error = NULL, updated_at = NOW()
+		WHERE id = $2 AND attempts = $3 AND state = $4
+	`, types.JobCompleted, job.ID, job.Attempts, types.JobRunning)
+
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// Fail records the error of an attempt and puts the job back in the queue
+// until it runs out of attempts, unless the error is permanent. It returns
+// true when the job has failed for good, and sql.ErrNoRows when the
+// worker did not hold it anymore.
+func (r *jobRepository) Fail(job *types.Job, cause error, retryAfter time.Duration, permanent bool) (bool, error) {
+	var state types.JobState
+	err := r.db.QueryRow(`
+		UPDATE processing_jobs
+		SET state = CASE WHEN attempts < max_attempts AND NOT $8 THEN $1 ELSE $2 END,
+			last_error = $3, lease_expires_at = NULL, run_after = NOW() + make_interval(secs => $4), updated_at = NOW()
+		WHERE id = $5 AND attempts = $6 AND state = $7
+		RETURNING state
+	`, types.JobQueued, types.JobFailed, cause.Error(), retryAfter.Seconds(), job.ID, job.Attempts, types.JobRunning, permanent).Scan(&state)
+
+	if err != nil {
+		return false, err
+	}
+	return state == types.JobFailed, nil
+}
+
+// Cancel cancels the pending job of a video. It returns the state the job
+// was in, which is empty when the video had no pending job, and whether a
+// running job had lost its lease, i.e. nobody is working on it anymore.
+func (r *jobRepository) Cancel(videoID string) (types.JobState, bool, error) {
+	var state types.JobState
+	var leaseExpired bool
+	err := r.db.QueryRow(`
+		UPDATE processing_jobs
+		SET state = $1, lease_expires_at = NULL, updated_at = NOW()
+		FROM (
+			SELECT id, state, COALESCE(lease_expires_at < NOW(), false) AS lease_expired
+			FROM processing_jobs
+			WHERE video_id = $2 AND state IN ($3, $4)
+			FOR UPDATE
+		) pending
+		WHERE processing_jobs.id = pending.id
+		RETURNING pending.state, pending.lease_expired
+	`, types.JobCancelled, videoID, types.JobQueued, types.JobRunning).Scan(&state, &leaseExpired)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return state, leaseExpired, nil
+}
+
+func (r *jobRepository) IsCancelled(job *types.Job) (bool, error) {
+	var state types.JobState
+	err := r.db.QueryRow(`
+		SELECT state FROM processing_jobs WHERE id = $1
+	`, job.ID).Scan(&state)
+
+	if err != nil {
+		return false, err
+	}
+	return state == types.JobCancelled, nil
+}
@@ -0,0 +1,65 @@
+package repositories
+
+import (
+	"database/sql"
+	"video-streaming-server/types"
+)
+
+type KeyRepository interface {
+	Save(storageID string, keys [][]byte) error
+	Find(videoID string, userID string, index int) ([]byte, error)
+}
+
+type keyRepository struct {
+	db *sql.DB
+}
+
+func NewKeyRepository(db *sql.DB) KeyRepository {
+	return &keyRepository{db: db}
+}
+
+// Save stores the encryption keys of a processed output, replacing those
+// of an earlier attempt at processing it
+func (r *keyRepository) Save(storageID string, keys [][]byte) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM video_keys WHERE storage_id = $1`, storageID); err != nil {
+		return err
+	}
+
+	for index, key := range keys {
+		_, err := tx.Exec(`
+			INSERT INTO video_keys (storage_id, key_index, key) VALUES ($1, $2, $3)
+		`, storageID, index, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Find returns a key of a processed video for its owner, and nil when the
+// video is not theirs or has no such key
+func (r *keyRepository) Find(videoID string, userID string, index int) ([]byte, error) {
+	var key []byte
+	err := r.db.QueryRow(`
+		SELECT video_keys.key
+		FROM videos
+		JOIN video_keys ON video_keys.storage_id = COALESCE(videos.storage_id, videos.video_id)
+		WHERE videos.video_id = $1 AND videos.user_id = $2 AND videos.status = $3 AND videos.delete_flag = 0
+		AND video_keys.key_index = $4
+	`, videoID, userID, types.ProcessingCompleted, index).Scan(&key)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,132 @@
+package repositories
+
+import (
+	"database/sql"
+	"time"
+	"video-streaming-server/types"
+
+	"github.com/lib/pq"
+)
+
+type LiveRepository interface {
+	Create(videoID string, userID string, request *types.LiveRequest) error
+	GetStatus(videoID string, userID string) (types.LiveStatus, error)
+	SetStatus(videoID string, status types.LiveStatus) error
+	Touch(videoIDs []string) ([]string, error)
+	End(videoID string, reason string) (bool, error)
+	FailAbandoned(olderThan time.Duration, reason string) (int64, error)
+}
+
+type liveRepository struct {
+	db *sql.DB
+}
+
+func NewLiveRepository(db *sql.DB) LiveRepository {
+	return &liveRepository{db: db}
+}
+
+// Create inserts a video that waits for its live stream to be published
+func (r *liveRepository) Create(videoID string, userID string, request *types.LiveRequest) error {
+	now := time.Now()
+	_, err := r.db.Exec(`
+		INSERT INTO videos (video_id, title, description, upload_initiate_time, status, delete_flag, user_id, live_status, live_seen_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $4)
+	`, videoID, request.Title, request.Description, now, types.UploadPending, 0, userID, types.LiveWaiting)
+
+	return err
+}
+
+// GetStatus returns the live status of a video of the user, which is empty
+// when the video is not theirs or was not streamed live
+func (r *liveRepository) GetStatus(videoID string, userID string) (types.LiveStatus, error) {
+	var status sql.NullString
+	err := r.db.QueryRow(`
+		SELECT live_status FROM videos
+		WHERE video_id = $1 AND user_id = $2 AND delete_flag = 0
+	`, videoID, userID).Scan(&status)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	return types.LiveStatus(status.String), nil
+}
+
+func (r *liveRepository) SetStatus(videoID string, status types.LiveStatus) error {
+	_, err := r.db.Exec(`
+		UPDATE videos SET live_status = $1, live_seen_at = $2 WHERE video_id = $3
+	`, status, time.Now(), videoID)
+
+	return err
+}
+
+// Touch records that the live streams of these videos are still being
+// ingested and returns those of them that still should be, the others were
+// cancelled or deleted meanwhile
+func (r *liveRepository) Touch(videoIDs []string) ([]string, error) {
+	rows, err := r.db.Query(`
+		UPDATE videos SET live_seen_at = $1
+		WHERE video_id = ANY($2) AND status = $3 AND delete_flag = 0
+		RETURNING video_id
+	`, time.Now(), pq.Array(videoIDs), types.UploadPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alive := make([]string, 0, len(videoIDs))
+	for rows.Next() {
+		var videoID string
+		if err := rows.Scan(&videoID); err != nil {
+			return nil, err
+		}
+		alive = append(alive, videoID)
+	}
+	return alive, rows.Err()
+}
+
+// End marks a live stream as ended, and its recording as uploaded or, when
+// a reason is given, the video as failed, unless the video was cancelled or
+// deleted while it was live. It returns whether the status was updated.
+func (r *liveRepository) End(videoID string, reason string) (bool, error) {
+	status := types.UploadedOnServer
+	if reason != "" {
+		status = types.ProcessingFailed
+	}
+
+	result, err := r.db.Exec(`
+		UPDATE videos SET live_status = $1, status = $2, failure_reason = NULLIF($3, '')
+		WHERE video_id = $4 AND status = $5 AND delete_flag = 0
+	`, types.LiveEnded, status, reason, videoID, types.UploadPending)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 1 {
+		return affected == 1, err
+	}
+
+	// the stream is over either way
+	_, err = r.db.Exec(`
+		UPDATE videos SET live_status = $1 WHERE video_id = $2
+	`, types.LiveEnded, videoID)
+	return false, err
+}
+
+// FailAbandoned fails the live streams no server has reported on for the
+// given time, because the server ingesting them went away, and returns how
+// many there were
+func (r *liveRepository) FailAbandoned(olderThan time.Duration, reason string) (int64, error) {
+	result, err := r.db.Exec(`
+		UPDATE videos SET live_status = $1, status = $2, failure_reason = $3
+		WHERE live_status IN ($4, $5) AND status = $6
+		AND live_seen_at < NOW() - make_interval(secs => $7)
+	`, types.LiveEnded, types.ProcessingFailed, reason, types.LiveWaiting, types.LiveOn, types.UploadPending, olderThan.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
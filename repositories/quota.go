@@ -0,0 +1,81 @@
+package repositories
+
+import (
+	"database/sql"
+	"video-streaming-server/types"
+)
+
+type QuotaRepository interface {
+	GetQuota(userID string) (string, *types.Quota, error)
+	GetUsage(userID string) (*types.Usage, error)
+}
+
+type quotaRepository struct {
+	db *sql.DB
+}
+
+func NewQuotaRepository(db *sql.DB) QuotaRepository {
+	return &quotaRepository{db: db}
+}
+
+// GetQuota returns the role of a user and the limits that apply to them
+func (r *quotaRepository) GetQuota(userID string) (string, *types.Quota, error) {
+	var role string
+	var maxBytes, maxVideos, maxMinutes sql.NullInt64
+	err := r.db.QueryRow(`
+		SELECT
+			users.role,
+			COALESCE(user_quotas.max_bytes, role_quotas.max_bytes),
+			COALESCE(user_quotas.max_videos, role_quotas.max_videos),
+			COALESCE(user_quotas.max_minutes, role_quotas.max_minutes)
+		FROM users
+		LEFT JOIN role_quotas ON role_quotas.role = users.role
+		LEFT JOIN user_quotas ON user_quotas.user_id = users.id
+		WHERE users.id = $1
+	`, userID).Scan(&role, &maxBytes, &maxVideos, &maxMinutes)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil, nil
+		}
+		return "", nil, err
+	}
+
+	return role, &types.Quota{
+		MaxBytes:   nullableLimit(maxBytes),
+		MaxVideos:  nullableLimit(maxVideos),
+		MaxMinutes: nullableLimit(maxMinutes),
+	}, nil
+}
+
+// GetUsage adds up the videos of a user. Uploads that are not processed
+// yet count with the size announced when they started, or their size in
+// the archive of a bulk upload, failed and cancelled ones do not count.
+func (r *quotaRepository) GetUsage(userID string) (*types.Usage, error) {
+	var usage types.Usage
+	err := r.db.QueryRow(`
+		SELECT
+			COALESCE(SUM(videos.output_bytes) FILTER (WHERE videos.status = $2), 0),
+			COALESCE(SUM(COALESCE(upload_sessions.expected_size, tus_uploads.upload_length, videos.source_bytes)) FILTER (WHERE videos.status IN ($3, $4)), 0),
+			COUNT(*),
+			COALESCE(SUM(videos.duration_seconds), 0) / 60
+		FROM videos
+		LEFT JOIN upload_sessions ON upload_sessions.video_id = videos.video_id
+		LEFT JOIN tus_uploads ON tus_uploads.video_id = videos.video_id
+		WHERE videos.user_id = $1
+		AND videos.delete_flag = 0
+		AND videos.status >= $3
+	`, userID, types.ProcessingCompleted, types.UploadPending, types.UploadedOnServer).Scan(&usage.Bytes, &usage.PendingBytes, &usage.Videos, &usage.Minutes)
+
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+func nullableLimit(limit sql.NullInt64) *int64 {
+	if !limit.Valid {
+		return nil
+	}
+	return &limit.Int64
+}
@@ -0,0 +1,85 @@
+package repositories
+
+import (
+	"database/sql"
+	"time"
+	"video-streaming-server/types"
+)
+
+type TusUploadRepository interface {
+	Create(upload *types.TusUpload, title string, description string) error
+	Get(id string, userID string) (*types.TusUpload, error)
+	UpdateOffset(id string, offset int64, expiresAt time.Time) error
+	Delete(id string) error
+}
+
+type tusUploadRepository struct {
+	db *sql.DB
+}
+
+func NewTusUploadRepository(db *sql.DB) TusUploadRepository {
+	return &tusUploadRepository{db: db}
+}
+
+// Create inserts the video an upload creates together with the upload, so
+// the upload shows up as pending in the video list right away
+func (r *tusUploadRepository) Create(upload *types.TusUpload, title string, description string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO videos (video_id, title, description, upload_initiate_time, status, delete_flag, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, upload.ID, title, description, time.Now(), types.UploadPending, 0, upload.UserID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO tus_uploads (video_id, user_id, upload_length, upload_offset, metadata, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, upload.ID, upload.UserID, upload.Length, upload.Offset, upload.Metadata, upload.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *tusUploadRepository) Get(id string, userID string) (*types.TusUpload, error) {
+	var upload types.TusUpload
+	var metadata sql.NullString
+	err := r.db.QueryRow(`
+		SELECT video_id, user_id, upload_length, upload_offset, metadata, expires_at
+		FROM tus_uploads WHERE video_id = $1 AND user_id = $2
+	`, id, userID).Scan(&upload.ID, &upload.UserID, &upload.Length, &upload.Offset, &metadata, &upload.ExpiresAt)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	upload.Metadata = metadata.String
+	return &upload, nil
+}
+
+func (r *tusUploadRepository) UpdateOffset(id string, offset int64, expiresAt time.Time) error {
+	_, err := r.db.Exec(`
+		UPDATE tus_uploads SET upload_offset = $1, expires_at = $2 WHERE video_id = $3
+	`, offset, expiresAt, id)
+
+	return err
+}
+
+// Delete removes an unfinished upload along with the video it created
+func (r *tusUploadRepository) Delete(id string) error {
+	_, err := r.db.Exec(`
+		DELETE FROM videos WHERE video_id = $1 AND status = $2
+	`, id, types.UploadPending)
+
+	return err
+}
@@ -0,0 +1,115 @@
+package repositories
+
+import (
+	"database/sql"
+	"time"
+	"video-streaming-server/types"
+)
+
+type UploadSessionRepository interface {
+	Create(session *types.UploadSession, title string, description string) error
+	Get(videoID string, userID string) (*types.UploadSession, error)
+	GetChunk(videoID string, offset int64) (*types.UploadChunk, error)
+	RecordChunk(videoID string, chunk *types.UploadChunk, hashState []byte) (bool, error)
+}
+
+type uploadSessionRepository struct {
+	db *sql.DB
+}
+
+func NewUploadSessionRepository(db *sql.DB) UploadSessionRepository {
+	return &uploadSessionRepository{db: db}
+}
+
+// Create inserts the video being uploaded together with its session
+func (r *uploadSessionRepository) Create(session *types.UploadSession, title string, description string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO videos (video_id, title, description, upload_initiate_time, status, delete_flag, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, session.VideoID, title, description, time.Now(), types.UploadPending, 0, session.UserID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO upload_sessions (video_id, user_id, expected_size, file_sha256)
+		VALUES ($1, $2, $3, $4)
+	`, session.VideoID, session.UserID, session.ExpectedSize, session.FileSHA256)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *uploadSessionRepository) Get(videoID string, userID string) (*types.UploadSession, error) {
+	var session types.UploadSession
+	err := r.db.QueryRow(`
+		SELECT video_id, user_id, expected_size, received_size, file_sha256, hash_state
+		FROM upload_sessions WHERE video_id = $1 AND user_id = $2
+	`, videoID, userID).Scan(&session.VideoID, &session.UserID, &session.ExpectedSize, &session.ReceivedSize, &session.FileSHA256, &session.HashState)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (r *uploadSessionRepository) GetChunk(videoID string, offset int64) (*types.UploadChunk, error) {
+	var chunk types.UploadChunk
+	err := r.db.QueryRow(`
+		SELECT chunk_offset, size, sha256
+		FROM upload_chunks WHERE video_id = $1 AND chunk_offset = $2
+	`, videoID, offset).Scan(&chunk.Offset, &chunk.Size, &chunk.SHA256)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &chunk, nil
+}
+
+// RecordChunk stores a chunk that was written at the end of the file and
+// moves the received size past it, along with the hash of the file up to
+// there. It returns false, recording nothing, when the session is not at
+// the chunk's offset anymore.
+func (r *uploadSessionRepository) RecordChunk(videoID string, chunk *types.UploadChunk, hashState []byte) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE upload_sessions
+		SET received_size = received_size + $1, hash_state = $4, updated_at = NOW()
+		WHERE video_id = $2 AND received_size = $3
+	`, chunk.Size, videoID, chunk.Offset, hashState)
+	if err != nil {
+		return false, err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected != 1 {
+		return false, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO upload_chunks (video_id, chunk_offset, size, sha256)
+		VALUES ($1, $2, $3, $4)
+	`, videoID, chunk.Offset, chunk.Size, chunk.SHA256)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
@@ -11,6 +11,7 @@ type UserRepository interface {
 	GetUserByEmail(email string) (*types.User, error)
 	GetUserByUsername(username string) (*types.User, error)
 	GetUserByID(id string) (*types.User, error)
+	GetRole(id string) (string, error)
 }
 
 type userRepository struct {
@@ -78,3 +79,20 @@ func (r *userRepository) GetUserByID(id string) (*types.User, error) {
 	}
 	return &user, nil
 }
+
+// GetRole returns the role of a user, which is empty for users that do not
+// exist
+func (r *userRepository) GetRole(id string) (string, error) {
+	var role string
+	err := r.db.QueryRow(`
+		SELECT role FROM users WHERE id = $1
+	`, id).Scan(&role)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	return role, nil
+}
@@ -0,0 +1,309 @@
+package repositories
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+	"video-streaming-server/types"
+)
+
+type VideoRepository interface {
+	ListStaleUploads(olderThan time.Duration) ([]types.Video, error)
+	Exists(videoID string) (bool, error)
+	Delete(videoID string) error
+	StorageID(videoID string) (string, error)
+	OwnedStorageID(videoID string, userID string) (string, error)
+	SetContentHash(videoID string, sum string) error
+	ContentHash(videoID string) (string, error)
+	FindProcessed(sum string, userID string, excludeVideoID string) (*types.StoredContent, error)
+	ReuseStorage(videoID string, content *types.StoredContent) (bool, error)
+	SharedStorage(videoID string) (*types.StoredContent, error)
+	RecordOutput(videoID string, outputBytes int64, durationSeconds float64) error
+	ReleaseStorage(videoID string) (string, bool, error)
+}
+
+type videoRepository struct {
+	db *sql.DB
+}
+
+func NewVideoRepository(db *sql.DB) VideoRepository {
+	return &videoRepository{db: db}
+}
+
+// ListStaleUploads returns the videos that were never processed, because
+// their upload stopped halfway or failed, or processing failed or was
+// cancelled, and that have seen no activity for the given time. Uploads
+// made with tus are only stale once they expired, live streams once no
+// server reports on them.
+func (r *videoRepository) ListStaleUploads(olderThan time.Duration) ([]types.Video, error) {
+	rows, err := r.db.Query(`
+		SELECT videos.video_id, videos.title, videos.status
+		FROM videos
+		LEFT JOIN upload_sessions ON upload_sessions.video_id = videos.video_id
+		LEFT JOIN tus_uploads ON tus_uploads.video_id = videos.video_id
+		WHERE videos.status IN ($1, $2, $3)
+		AND GREATEST(videos.upload_initiate_time, upload_sessions.updated_at, videos.live_seen_at) < NOW() - make_interval(secs => $4)
+		AND (tus_uploads.expires_at IS NULL OR tus_uploads.expires_at < NOW())
+		AND NOT EXISTS (
+			SELECT 1 FROM processing_jobs
+			WHERE processing_jobs.video_id = videos.video_id
+			AND processing_jobs.state IN ($5, $6)
+		)
+	`, types.UploadPending, types.ProcessingFailed, types.Cancelled, olderThan.Seconds(), types.JobQueued, types.JobRunning)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := make([]types.Video, 0)
+	for rows.Next() {
+		var video types.Video
+		if err := rows.Scan(&video.ID, &video.Title, &video.Status); err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+	return videos, rows.Err()
+}
+
+func (r *videoRepository) Exists(videoID string) (bool, error) {
+	var exists bool
+	err := r.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM videos WHERE video_id = $1)
+	`, videoID).Scan(&exists)
+
+	return exists, err
+}
+
+func (r *videoRepository) Delete(videoID string) error {
+	_, err := r.db.Exec(`
+		DELETE FROM videos WHERE video_id = $1
+	`, videoID)
+
+	return err
+}
+
+// StorageID returns the key prefix of the stored output a video plays,
+// which is the video's own ID unless it shares the output of another
+func (r *videoRepository) StorageID(videoID string) (string, error) {
+	var storageID string
+	err := r.db.QueryRow(`
+		SELECT COALESCE(storage_id, video_id) FROM videos WHERE video_id = $1
+	`, videoID).Scan(&storageID)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	return storageID, nil
+}
+
+// OwnedStorageID is StorageID for a video of the given user, it is empty
+// when the video is someone else's or does not exist
+func (r *videoRepository) OwnedStorageID(videoID string, userID string) (string, error) {
+	var storageID string
+	err := r.db.QueryRow(`
+		SELECT COALESCE(storage_id, video_id) FROM videos
+		WHERE video_id = $1 AND user_id = $2 AND delete_flag = 0
+	`, videoID, userID).Scan(&storageID)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	return storageID, nil
+}
+
+func (r *videoRepository) SetContentHash(videoID string, sum string) error {
+	_, err := r.db.Exec(`
+		UPDATE videos SET content_sha256 = $1 WHERE video_id = $2
+	`, sum, videoID)
+
+	return err
+}
+
+// ContentHash returns the SHA-256 of the upload of a video, which is empty
+// until it has been recorded
+func (r *videoRepository) ContentHash(videoID string) (string, error) {
+	var sum sql.NullString
+	err := r.db.QueryRow(`
+		SELECT content_sha256 FROM videos WHERE video_id = $1
+	`, videoID).Scan(&sum)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	return sum.String, nil
+}
+
+// FindProcessed looks for a processed video with the given content, of
+// the given user or of anyone when userID is empty
+func (r *videoRepository) FindProcessed(sum string, userID string, excludeVideoID string) (*types.StoredContent, error) {
+	var content types.StoredContent
+	err := r.db.QueryRow(`
+		SELECT videos.storage_id, videos.thumbnail, COALESCE(videos.output_bytes, 0), COALESCE(videos.duration_seconds, 0)
+		FROM videos
+		JOIN video_storage ON video_storage.storage_id = videos.storage_id
+		WHERE videos.content_sha256 = $1
+		AND videos.status = $2
+		AND videos.delete_flag = 0
+		AND videos.video_id <> $3
+		AND ($4 = '' OR videos.user_id = $4)
+		AND video_storage.ref_count > 0
+		LIMIT 1
+	`, sum, types.ProcessingCompleted, excludeVideoID, userID).Scan(&content.StorageID, &content.Thumbnail, &content.OutputBytes, &content.DurationSeconds)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &content, nil
+}
+
+// ReuseStorage points a video at stored output it shares with another
+// video. It returns false when that output was released in the meantime,
+// or the video already has output of its own from an earlier attempt.
+func (r *videoRepository) ReuseStorage(videoID string, content *types.StoredContent) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE videos
+		SET storage_id = $1, thumbnail = $2, output_bytes = $3, duration_seconds = $4
+		WHERE video_id = $5 AND storage_id IS NULL
+	`, content.StorageID, content.Thumbnail, content.OutputBytes, content.DurationSeconds, videoID)
+	if err != nil {
+		return false, err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected != 1 {
+		return false, err
+	}
+
+	result, err = tx.Exec(`
+		UPDATE video_storage SET ref_count = ref_count + 1
+		WHERE storage_id = $1 AND ref_count > 0
+	`, content.StorageID)
+	if err != nil {
+		return false, err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected != 1 {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// SharedStorage returns the stored output of another video a video plays,
+// which an earlier attempt at processing it may have pointed it at, or nil
+func (r *videoRepository) SharedStorage(videoID string) (*types.StoredContent, error) {
+	var content types.StoredContent
+	err := r.db.QueryRow(`
+		SELECT storage_id, thumbnail, COALESCE(output_bytes, 0), COALESCE(duration_seconds, 0)
+		FROM videos
+		WHERE video_id = $1 AND storage_id IS NOT NULL AND storage_id <> video_id
+	`, videoID).Scan(&content.StorageID, &content.Thumbnail, &content.OutputBytes, &content.DurationSeconds)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &content, nil
+}
+
+// RecordOutput stores the size and length of what processing a video
+// produced, which the video holds the first reference to. Videos sharing
+// the output of another are left alone, so that reference is not lost.
+func (r *videoRepository) RecordOutput(videoID string, outputBytes int64, durationSeconds float64) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO video_storage (storage_id, ref_count) VALUES ($1, 1)
+		ON CONFLICT (storage_id) DO NOTHING
+	`, videoID)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`
+		UPDATE videos
+		SET storage_id = $1, output_bytes = $2, duration_seconds = $3
+		WHERE video_id = $1 AND (storage_id IS NULL OR storage_id = $1)
+	`, videoID, outputBytes, durationSeconds)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected != 1 {
+		return fmt.Errorf("video %s does not exist or shares the output of another", videoID)
+	}
+
+	return tx.Commit()
+}
+
+// ReleaseStorage deletes a video and drops its reference to its stored
+// output. It returns the storage ID of that output and whether this was
+// the last reference, in which case the caller deletes it from the store.
+func (r *videoRepository) ReleaseStorage(videoID string) (string, bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Rollback()
+
+	var storageID sql.NullString
+	err = tx.QueryRow(`
+		DELETE FROM videos WHERE video_id = $1 RETURNING storage_id
+	`, videoID).Scan(&storageID)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	// a video that was never processed has nothing shared in the store
+	if !storageID.Valid {
+		return videoID, true, tx.Commit()
+	}
+
+	var refCount int
+	err = tx.QueryRow(`
+		UPDATE video_storage SET ref_count = ref_count - 1
+		WHERE storage_id = $1
+		RETURNING ref_count
+	`, storageID.String).Scan(&refCount)
+	if err == sql.ErrNoRows {
+		return storageID.String, true, tx.Commit()
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	if refCount == 0 {
+		if _, err := tx.Exec(`DELETE FROM video_storage WHERE storage_id = $1`, storageID.String); err != nil {
+			return "", false, err
+		}
+	}
+
+	return storageID.String, refCount == 0, tx.Commit()
+}
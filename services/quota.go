@@ -0,0 +1,74 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"video-streaming-server/repositories"
+	"video-streaming-server/types"
+)
+
+// QuotaExceededError is returned for uploads that would take a user past
+// one of their limits. Its reason is shown to the user as is.
+type QuotaExceededError struct {
+	Reason string
+}
+
+func (e *QuotaExceededError) Error() string {
+	return e.Reason
+}
+
+type QuotaService interface {
+	CheckUploads(userID string, count int64, size int64) error
+	GetUsage(userID string) (*types.UsageResponseType, error)
+}
+
+type quotaService struct {
+	repository repositories.QuotaRepository
+}
+
+func NewQuotaService(repository repositories.QuotaRepository) QuotaService {
+	return &quotaService{repository: repository}
+}
+
+func (s *quotaService) GetUsage(userID string) (*types.UsageResponseType, error) {
+	role, quota, err := s.repository.GetQuota(userID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting quota: %w", err)
+	}
+	if quota == nil {
+		return nil, errors.New("user not found")
+	}
+
+	usage, err := s.repository.GetUsage(userID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting usage: %w", err)
+	}
+
+	return &types.UsageResponseType{Role: role, Usage: *usage, Limits: *quota}, nil
+}
+
+// CheckUploads returns a *QuotaExceededError when a user may not start
+// count more uploads taking up size bytes together, like the videos of a
+// bulk upload. The length of a video is only known once it is processed,
+// so the minutes limit only stops uploads once it has been reached.
+func (s *quotaService) CheckUploads(userID string, count int64, size int64) error {
+	report, err := s.GetUsage(userID)
+	if err != nil {
+		return err
+	}
+	usage, limits := report.Usage, report.Limits
+
+	if limits.MaxVideos != nil && usage.Videos+count > *limits.MaxVideos {
+		return &QuotaExceededError{Reason: fmt.Sprintf("You can store at most %d videos", *limits.MaxVideos)}
+	}
+
+	if limits.MaxBytes != nil && usage.Bytes+usage.PendingBytes+size > *limits.MaxBytes {
+		return &QuotaExceededError{Reason: fmt.Sprintf("This upload would exceed your storage quota of %d MB", *limits.MaxBytes/(1024*1024))}
+	}
+
+	if limits.MaxMinutes != nil && usage.Minutes >= float64(*limits.MaxMinutes) {
+		return &QuotaExceededError{Reason: fmt.Sprintf("You have used up your quota of %d minutes of video", *limits.MaxMinutes)}
+	}
+
+	return nil
+}
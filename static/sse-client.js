@@ -33,6 +33,9 @@ eventSource.addEventListener("video_status", (event) => {
         // Update the 'status' attribute of the video-item.
         // This will trigger the attributeChangedCallback in videoItem.js,
         // which then updates the UI to show the correct processing state (loader, failed, or completed).
+        if (data.failure_reason) {
+          videoItemElement.setAttribute("failure-reason", data.failure_reason);
+        }
         videoItemElement.setAttribute("status", videoStatus);
         videoItemElement.setAttribute("thumbnail", thumbnail);
 
@@ -42,7 +45,10 @@ eventSource.addEventListener("video_status", (event) => {
           toaster.success(videoTitle, "Processing completed.");
         } else if (videoStatus === -1) {
           // ProcessingFailed
-          toaster.error(videoTitle, "Processing failed.");
+          toaster.error(videoTitle, data.failure_reason || "Processing failed.");
+        } else if (videoStatus === -2) {
+          // Cancelled
+          toaster.error(videoTitle, "Processing cancelled.");
         }
       } else {
         console.warn(
@@ -56,3 +62,25 @@ eventSource.addEventListener("video_status", (event) => {
     console.error("Error parsing SSE data or updating UI:", e);
   }
 });
+
+eventSource.addEventListener("video_progress", (event) => {
+  try {
+    const { id: videoId, stage, percent, eta_seconds: etaSeconds } = JSON.parse(event.data);
+
+    const videoContainer = document.querySelector("video-container");
+    const videoItemElement = videoContainer?.shadowRoot?.querySelector(`video-item[video-id="${videoId}"]`);
+    if (!videoItemElement) {
+      return;
+    }
+
+    let progress = `${stage.charAt(0).toUpperCase()}${stage.slice(1)} ${percent}%`;
+    if (etaSeconds > 0) {
+      const minutes = Math.floor(etaSeconds / 60);
+      const seconds = etaSeconds % 60;
+      progress += minutes > 0 ? ` (${minutes}m ${seconds}s left)` : ` (${seconds}s left)`;
+    }
+    videoItemElement.setAttribute("progress", progress);
+  } catch (e) {
+    console.error("Error parsing progress event:", e);
+  }
+});
@@ -22,6 +22,12 @@ function handleBeforeUnload(event) {
   }
 }
 
+function toHex(buffer) {
+  return Array.from(new Uint8Array(buffer))
+    .map((byte) => byte.toString(16).padStart(2, "0"))
+    .join("");
+}
+
 function checkFileType(file) {
   const supportedTypes = JSON.parse(localStorage.getItem("SUPPORTED_FILE_TYPES"));
 
@@ -95,56 +101,80 @@ fileForm.addEventListener("submit", async (e) => {
   uploadVideoButton.disabled = true;
 
   fileReader.onload = async (ev) => {
-    const CHUNK_SIZE = 50000;
-    const chunkCount = parseInt(ev.target.result.byteLength / CHUNK_SIZE);
-    console.log(chunkCount);
+    const CHUNK_SIZE = 1024 * 1024;
+    const MAX_RETRIES = 5;
+    const fileBuffer = ev.target.result;
+    const fileSize = fileBuffer.byteLength;
+
+    const fileSha256 = toHex(await crypto.subtle.digest("SHA-256", fileBuffer));
+    const extensionIndex = theFile.name.lastIndexOf(".");
+    const fileExtension = extensionIndex > 0 ? theFile.name.slice(extensionIndex) : "";
     console.log("Read successfully");
 
     import("https://jspm.dev/uuid").then(async (uuid) => {
       const uuidv4 = uuid.v4;
       const fileName = uuidv4();
       console.log(fileName);
+
+      // the server answers every chunk with how much of the file it has,
+      // which is where the next chunk starts
       let sent = 0;
-      let chunkID;
-      for (chunkID = 0; chunkID < chunkCount + 1; chunkID++) {
-        console.log(chunkID);
-        let chunk;
-        if (chunkID == chunkCount) {
-          chunk = ev.target.result.slice(chunkID * CHUNK_SIZE);
-        } else {
-          chunk = ev.target.result.slice(chunkID * CHUNK_SIZE, chunkID * CHUNK_SIZE + CHUNK_SIZE);
+      let retries = 0;
+      let failed = false;
+      while (sent < fileSize) {
+        const chunk = fileBuffer.slice(sent, sent + CHUNK_SIZE);
+        const chunkSha256 = toHex(await crypto.subtle.digest("SHA-256", chunk));
+
+        let response;
+        try {
+          // reason for await is we want to wait for server's response and not flood the backend with all requests.
+          response = await fetch(`${window.ENV.API_URL}/video/`, {
+            method: "POST",
+            headers: {
+              "content-type": "application/octet-stream",
+              "file-name": fileName,
+              "file-size": fileSize,
+              "file-sha256": fileSha256,
+              "file-extension": fileExtension,
+              "first-chunk": sent === 0,
+              "chunk-offset": sent,
+              "chunk-sha256": chunkSha256,
+              title: title,
+              description: description,
+            },
+            body: chunk,
+          });
+        } catch (error) {
+          console.error("Error sending chunk:", error);
         }
-        console.log("Chunk byteLength: ", chunk.byteLength);
-        sent += chunk.byteLength;
-        firstChunk = false;
-        if (chunkID == 0) {
-          firstChunk = true;
+
+        if (response && (response.ok || response.status === 409)) {
+          retries = 0;
+          sent = parseInt(response.headers.get("upload-offset"));
+        } else if (response && response.status < 500) {
+          const { error } = await response.json();
+          divOutput.textContent = `Upload failed: ${error}`;
+          failed = true;
+          break;
+        } else if (++retries > MAX_RETRIES) {
+          divOutput.textContent = "Upload failed, please try again.";
+          failed = true;
+          break;
+        } else {
+          await new Promise((resolve) => setTimeout(resolve, 1000 * retries));
+          continue;
         }
-        // reason for await is we want to wait for server's response and not flood the backend with all requests.
-        const response = await fetch(`${window.ENV.API_URL}/video/`, {
-          method: "POST",
-          headers: {
-            "content-type": "application/octet-stream",
-            "content-length": chunk.length,
-            "file-name": fileName,
-            "file-size": ev.target.result.byteLength,
-            "first-chunk": firstChunk,
-            title: title,
-            description: description,
-          },
-          body: chunk,
-        });
-
-        console.log(await response.text());
-
-        divOutput.textContent = `${Math.round((sent / ev.target.result.byteLength) * 100, 0)} %`;
-
-        const progress = Math.round((sent / ev.target.result.byteLength) * 100);
+
+        const progress = Math.round((sent / fileSize) * 100);
         progressBar.style.width = `${progress}%`;
         divOutput.textContent = `${progress}%`;
       }
 
-      if (chunkID >= chunkCount + 1) {
+      if (failed) {
+        uploadInProgress = false;
+        window.removeEventListener("beforeunload", handleBeforeUnload);
+        uploadVideoButton.disabled = false;
+      } else {
         progressBar.style.width = "100%";
         uploadInProgress = false;
         window.removeEventListener("beforeunload", handleBeforeUnload);
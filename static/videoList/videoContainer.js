@@ -156,6 +156,9 @@ class VideoList extends HTMLElement {
 
         // TODO: status should be validated (keep a set of allowed statuses, I guess?)
         videoItem.setAttribute("status", video.status); // Pass the status here
+        if (video.failure_reason) {
+          videoItem.setAttribute("failure-reason", video.failure_reason);
+        }
 
         videoItem.classList.add(this.viewMode === "grid" ? "grid-mode-item" : "list-mode-item");
 
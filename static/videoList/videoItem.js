@@ -389,6 +389,7 @@ class VideoItem extends HTMLElement {
               <div class="status-message" style="display: none;"></div>
           </div>
           <div class="actions">
+              <button class="action-button cancel-processing" title="Cancel Processing" style="display: none;">Cancel</button>
               <button class="action-button update-modal" title="Update Video">Edit</button>
               <button class="action-button delete-modal" title="Delete Video">Delete</button>
           </div>
@@ -493,6 +494,12 @@ class VideoItem extends HTMLElement {
       });
     }
 
+    this.cancelProcessingButton = this.shadow.querySelector(".cancel-processing");
+    this.cancelProcessingButton.addEventListener("click", (e) => {
+      e.stopPropagation();
+      this.handleCancelProcessing();
+    });
+
     const updateModalButton = this.shadow.querySelector(".update-modal");
     if (updateModalButton) {
       updateModalButton.addEventListener("click", (e) => {
@@ -553,9 +560,9 @@ class VideoItem extends HTMLElement {
   handlePlay() {
     // Only allow playing if the video is not in a processing state
     const status = parseInt(this.getAttribute("status")); // Parse status as integer
-    if (status === 1 || status === -1) {
-      // 1 for UploadedOnServer/Processing, -1 for ProcessingFailed
-      return; // Prevent playback if still processing or failed
+    if (status !== 2) {
+      // only videos that finished processing can be played
+      return;
     }
 
     const videoId = this.getAttribute("video-id");
@@ -634,6 +641,25 @@ class VideoItem extends HTMLElement {
       });
   }
 
+  handleCancelProcessing() {
+    const videoId = this.getAttribute("video-id");
+    this.cancelProcessingButton.textContent = "Cancelling...";
+    this.cancelProcessingButton.disabled = true;
+
+    // the final status arrives as a video_status event
+    fetch(`${window.ENV.API_URL}/video/${videoId}/cancel`, { method: "POST" })
+      .then((response) => {
+        if (!response.ok) {
+          throw new Error(`HTTP ${response.status} ${response.statusText}`);
+        }
+      })
+      .catch((error) => {
+        console.error("Error cancelling video processing:", error);
+        this.cancelProcessingButton.textContent = "Cancel";
+        this.cancelProcessingButton.disabled = false;
+      });
+  }
+
   handleUpdate() {
     const videoId = this.getAttribute("video-id");
     const updateButton = this.shadowRoot.querySelector(".update");
@@ -688,7 +714,7 @@ class VideoItem extends HTMLElement {
   }
 
   static get observedAttributes() {
-    return ["name", "description", "thumbnail", "video-id", "status"];
+    return ["name", "description", "thumbnail", "video-id", "status", "progress", "failure-reason"];
   }
 
   attributeChangedCallback(name, oldValue, newValue) {
@@ -709,32 +735,53 @@ class VideoItem extends HTMLElement {
       }
     } else if (name === "status") {
       this.updateStatusDisplay(newValue);
+    } else if (name === "failure-reason") {
+      if (parseInt(this.getAttribute("status")) === -1) {
+        this.updateStatusDisplay(-1);
+      }
+    } else if (name === "progress") {
+      const status = parseInt(this.getAttribute("status"));
+      if (status === 0 || status === 1) {
+        this.updateStatusDisplay(status);
+      }
     }
   }
 
   updateStatusDisplay(status) {
     this.statusMessageElement.style.display = "none";
     this.statusMessageElement.innerHTML = "";
+    this.statusMessageElement.title = "";
     this.statusMessageElement.classList.remove("status-failed", "status-processing");
     this.playButton.style.display = "block";
+    this.cancelProcessingButton.style.display = "none";
 
     switch (parseInt(status)) {
+      case -2:
+        this.statusMessageElement.textContent = "Cancelled";
+        this.statusMessageElement.classList.add("status-failed");
+        this.statusMessageElement.style.display = "block";
+        this.playButton.style.display = "none";
+        break;
       case -1:
         this.statusMessageElement.textContent = "Processing Failed";
+        this.statusMessageElement.title = this.getAttribute("failure-reason") || "";
         this.statusMessageElement.classList.add("status-failed");
         this.statusMessageElement.style.display = "block";
         this.playButton.style.display = "none";
         break;
       case 1:
-        this.statusMessageElement.innerHTML = 'Processing <div class="loader"></div>';
+        this.statusMessageElement.textContent = this.getAttribute("progress") || "Processing";
+        this.statusMessageElement.insertAdjacentHTML("beforeend", '<div class="loader"></div>');
         this.statusMessageElement.classList.add("status-processing");
         this.statusMessageElement.style.display = "flex";
         this.playButton.style.display = "none";
+        this.cancelProcessingButton.style.display = "block";
         break;
       case 0:
-        this.statusMessageElement.textContent = "Upload Pending";
+        this.statusMessageElement.textContent = this.getAttribute("progress") || "Upload Pending";
         this.statusMessageElement.style.display = "block";
         this.playButton.style.display = "none";
+        this.cancelProcessingButton.style.display = "block";
         break;
       case 2:
         break;
@@ -0,0 +1,344 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Appwrite rejects single requests larger than this, bigger files have to
+// be sent in chunks carrying a Content-Range header.
+const appwriteChunkSize = 5 * 1024 * 1024
+
+var errAppwriteConflict = errors.New("appwrite file already exists")
+
+type appwriteStore struct {
+	endpoint       string
+	bucketID       string
+	projectID      string
+	key            string
+	responseFormat string
+	client         *http.Client
+}
+
+type appwriteFile struct {
+	ID           string `json:"$id"`
+	BucketID     string `json:"bucketId"`
+	Name         string `json:"name"`
+	Signature    string `json:"signature"`
+	MimeType     string `json:"mimeType"`
+	SizeOriginal int64  `json:"sizeOriginal"`
+	UpdatedAt    string `json:"$updatedAt"`
+}
+
+type appwriteFileList struct {
+	Total int            `json:"total"`
+	Files []appwriteFile `json:"files"`
+}
+
+func NewAppwriteStore(endpoint, bucketID, projectID, key, responseFormat string) ObjectStore {
+	if endpoint == "" {
+		endpoint = "https://cloud.appwrite.io/v1"
+	}
+	return &appwriteStore{
+		endpoint:       strings.TrimSuffix(endpoint, "/"),
+		bucketID:       bucketID,
+		projectID:      projectID,
+		key:            key,
+		responseFormat: responseFormat,
+		client:         &http.Client{},
+	}
+}
+
+// GetFileId maps a file name to an Appwrite file ID, which is limited to
+// 36 characters.
+func GetFileId(fileName string) string {
+	hashChecksum := sha1.New()
+	hashChecksum.Write([]byte(fileName))
+	fileId := fmt.Sprintf("%x", hashChecksum.Sum(nil))[:36]
+
+	return fileId
+}
+
+// fileID derives the Appwrite file ID of a key. Files that sit directly
+// under the video folder keep the IDs they had before the storage package
+// existed: the manifest is stored under the video ID and everything else
+// under the hash of its bare file name. Deeper keys hash the whole key.
+func (s *appwriteStore) fileID(key string) string {
+	dir, base := path.Split(key)
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" || strings.Contains(dir, "/") {
+		return GetFileId(key)
+	}
+	name := strings.TrimSuffix(base, path.Ext(base))
+	if path.Ext(base) == ".m3u8" && name == dir {
+		return name
+	}
+	return GetFileId(name)
+}
+
+func (s *appwriteStore) filesURL() string {
+	return s.endpoint + "/storage/buckets/" + s.bucketID + "/files"
+}
+
+func (s *appwriteStore) newRequest(ctx context.Context, method string, url string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Appwrite-Response-Format", s.responseFormat)
+	request.Header.Set("X-Appwrite-Project", s.projectID)
+	request.Header.Set("X-Appwrite-Key", s.key)
+	return request, nil
+}
+
+func (s *appwriteStore) do(request *http.Request) (*http.Response, error) {
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request to Appwrite: %w", err)
+	}
+
+	if response.StatusCode == http.StatusNotFound {
+		response.Body.Close()
+		return nil, ErrNotFound
+	}
+
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return nil, fmt.Errorf("appwrite returned status %d: %s", response.StatusCode, string(body))
+	}
+
+	return response, nil
+}
+
+func (s *appwriteStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	fileID := s.fileID(key)
+
+	err := s.upload(ctx, fileID, key, body, size)
+	if err == errAppwriteConflict {
+		// files are immutable in Appwrite, so an overwrite is a delete
+		// followed by a fresh upload
+		if err := s.Delete(ctx, key); err != nil && err != ErrNotFound {
+			return fmt.Errorf("error replacing existing file: %w", err)
+		}
+		if seeker, ok := body.(io.Seeker); ok {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("error rewinding file for upload: %w", err)
+			}
+			return s.upload(ctx, fileID, key, body, size)
+		}
+		return fmt.Errorf("file %s already exists", key)
+	}
+	return err
+}
+
+func (s *appwriteStore) upload(ctx context.Context, fileID string, key string, body io.Reader, size int64) error {
+	chunk := make([]byte, appwriteChunkSize)
+	var offset int64
+
+	for {
+		n, err := io.ReadFull(body, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return fmt.Errorf("error reading file content: %w", err)
+		}
+		if n == 0 && offset > 0 {
+			return nil
+		}
+
+		var requestBody bytes.Buffer
+		writer := multipart.NewWriter(&requestBody)
+
+		if err := writer.WriteField("fileId", fileID); err != nil {
+			return fmt.Errorf("error writing fileId field: %w", err)
+		}
+
+		part, err := writer.CreateFormFile("file", key)
+		if err != nil {
+			return fmt.Errorf("error creating form file part: %w", err)
+		}
+
+		if _, err := part.Write(chunk[:n]); err != nil {
+			return fmt.Errorf("error writing file content to form part: %w", err)
+		}
+
+		if err := writer.Close(); err != nil {
+			return fmt.Errorf("error closing multipart writer: %w", err)
+		}
+
+		request, err := s.newRequest(ctx, http.MethodPost, s.filesURL(), &requestBody)
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Content-Type", writer.FormDataContentType())
+
+		if size > appwriteChunkSize {
+			request.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(n)-1, size))
+			if offset > 0 {
+				request.Header.Set("X-Appwrite-ID", fileID)
+			}
+		}
+
+		response, err := s.client.Do(request)
+		if err != nil {
+			return fmt.Errorf("error sending request to Appwrite: %w", err)
+		}
+		responseBody, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+
+		if response.StatusCode == http.StatusConflict {
+			return errAppwriteConflict
+		}
+		if response.StatusCode != http.StatusCreated && response.StatusCode != http.StatusOK {
+			return fmt.Errorf("error uploading %s to Appwrite, status %d: %s", key, response.StatusCode, string(responseBody))
+		}
+
+		offset += int64(n)
+		if offset >= size || n < appwriteChunkSize {
+			return nil
+		}
+	}
+}
+
+func (s *appwriteStore) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	request, err := s.newRequest(ctx, http.MethodGet, s.filesURL()+"/"+s.fileID(key)+"/view", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	response, err := s.do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info := &ObjectInfo{
+		Key:         key,
+		Size:        response.ContentLength,
+		ContentType: response.Header.Get("Content-Type"),
+		ETag:        response.Header.Get("ETag"),
+	}
+	if lastModified, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+		info.LastModified = lastModified
+	}
+
+	return response.Body, info, nil
+}
+
+func (s *appwriteStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	request, err := s.newRequest(ctx, http.MethodGet, s.filesURL()+"/"+s.fileID(key)+"/view", nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	response, err := s.do(request)
+	if err != nil {
+		return nil, err
+	}
+	return rangeBody(response, offset, length)
+}
+
+func (s *appwriteStore) Delete(ctx context.Context, key string) error {
+	request, err := s.newRequest(ctx, http.MethodDelete, s.filesURL()+"/"+s.fileID(key), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := s.do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// List only sees files uploaded through this store, files uploaded before
+// it existed were named after their bare file name instead of their key.
+func (s *appwriteStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := make([]ObjectInfo, 0)
+	cursor := ""
+
+	for {
+		query := url.Values{}
+		query.Add("queries[]", fmt.Sprintf(`startsWith("name", [%q])`, prefix))
+		query.Add("queries[]", "limit(100)")
+		if cursor != "" {
+			query.Add("queries[]", fmt.Sprintf("cursorAfter(%q)", cursor))
+		}
+
+		request, err := s.newRequest(ctx, http.MethodGet, s.filesURL()+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := s.do(request)
+		if err != nil {
+			return nil, err
+		}
+
+		var list appwriteFileList
+		err = json.NewDecoder(response.Body).Decode(&list)
+		response.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding file list: %w", err)
+		}
+
+		for _, file := range list.Files {
+			objects = append(objects, *file.objectInfo(file.Name))
+		}
+
+		if len(list.Files) < 100 {
+			return objects, nil
+		}
+		cursor = list.Files[len(list.Files)-1].ID
+	}
+}
+
+func (s *appwriteStore) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	request, err := s.newRequest(ctx, http.MethodGet, s.filesURL()+"/"+s.fileID(key), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := s.do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var file appwriteFile
+	if err := json.NewDecoder(response.Body).Decode(&file); err != nil {
+		return nil, fmt.Errorf("error decoding file metadata: %w", err)
+	}
+
+	return file.objectInfo(key), nil
+}
+
+func (s *appwriteStore) PublicURL(key string) string {
+	return fmt.Sprintf("%s/view?project=%s", s.filesURL()+"/"+s.fileID(key), s.projectID)
+}
+
+func (f *appwriteFile) objectInfo(key string) *ObjectInfo {
+	info := &ObjectInfo{
+		Key:         key,
+		Size:        f.SizeOriginal,
+		ContentType: f.MimeType,
+		ETag:        f.Signature,
+	}
+	if updatedAt, err := time.Parse(time.RFC3339Nano, f.UpdatedAt); err == nil {
+		info.LastModified = updatedAt
+	}
+	return info
+}
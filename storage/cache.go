@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"video-streaming-server/config"
+	"video-streaming-server/shared/logger"
+)
+
+// errTooLargeToCache is returned for objects larger than the whole cache,
+// which are served straight from the store
+var errTooLargeToCache = errors.New("object is larger than the cache")
+
+// CacheStats counts how the object cache served objects since the server
+// started, along with what it holds now
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Collapsed int64 `json:"collapsed"`
+	Evictions int64 `json:"evictions"`
+	Bytes     int64 `json:"bytes"`
+	Entries   int64 `json:"entries"`
+}
+
+var cacheCounters struct {
+	hits, misses, collapsed, evictions atomic.Int64
+}
+
+// DiskCache keeps recently served objects of a remote store on local disk,
+// evicting the least recently used ones once it holds more than its size.
+// Concurrent misses for the same object wait for a single fetch.
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	order    *list.List
+	size     int64
+	inflight map[string]*cacheFill
+}
+
+type cacheEntry struct {
+	key       string
+	path      string
+	info      ObjectInfo
+	fetchedAt time.Time
+}
+
+// cacheFill is a fetch other requests for the same object wait for
+type cacheFill struct {
+	done chan struct{}
+	err  error
+}
+
+var (
+	cache     *DiskCache
+	cacheOnce sync.Once
+)
+
+// GetCache returns the object cache, or nil when OBJECT_CACHE_SIZE is 0
+// or objects are stored on local disk already
+func GetCache() *DiskCache {
+	cacheOnce.Do(func() {
+		switch config.AppConfig.StorageBackend {
+		case "local", "memory":
+			return
+		}
+		if config.AppConfig.ObjectCacheSize == 0 {
+			return
+		}
+
+		dir := config.AppConfig.ObjectCacheDir
+		if dir == "" {
+			dir = filepath.Join(config.AppConfig.RootPath, "cache")
+		}
+
+		var err error
+		cache, err = NewDiskCache(dir, config.AppConfig.ObjectCacheSize)
+		if err != nil {
+			logger.Log.Error("failed to create object cache, serving objects from the store", "error", err)
+			return
+		}
+		logger.Log.Info("object cache initialized", "dir", dir, "max_bytes", config.AppConfig.ObjectCacheSize)
+	})
+	return cache
+}
+
+// NewDiskCache creates a cache in dir. What a previous run left there is
+// removed, since which objects the files hold is only known in memory.
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating cache directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cache directory: %w", err)
+	}
+	for _, entry := range entries {
+		// only files named like the cache names them, in case the
+		// directory is shared with something else
+		name := strings.TrimSuffix(entry.Name(), ".tmp")
+		if _, err := hex.DecodeString(name); err == nil && len(name) == sha256.Size*2 {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	return &DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		inflight: make(map[string]*cacheFill),
+	}, nil
+}
+
+// Get returns an object from the cache, fetching it from the store on a
+// miss. Entries older than maxAge are fetched again, 0 keeps them until
+// they are evicted. The body is a file, so it is seekable.
+func (c *DiskCache) Get(ctx context.Context, store ObjectStore, key string, maxAge time.Duration) (io.ReadCloser, *ObjectInfo, error) {
+	if body, info, ok := c.open(key, maxAge); ok {
+		cacheCounters.hits.Add(1)
+		return body, info, nil
+	}
+
+	for {
+		c.mu.Lock()
+		fill, waiting := c.inflight[key]
+		if !waiting {
+			fill = &cacheFill{done: make(chan struct{})}
+			c.inflight[key] = fill
+		}
+		c.mu.Unlock()
+
+		if waiting {
+			cacheCounters.collapsed.Add(1)
+			select {
+			case <-fill.done:
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		} else {
+			cacheCounters.misses.Add(1)
+			// the fetch is shared, so the request that started it going
+			// away must not stop it
+			fill.err = c.fill(context.WithoutCancel(ctx), store, key)
+
+			c.mu.Lock()
+			delete(c.inflight, key)
+			c.mu.Unlock()
+			close(fill.done)
+		}
+
+		if errors.Is(fill.err, errTooLargeToCache) {
+			return store.Get(ctx, key)
+		}
+		if fill.err != nil {
+			return nil, nil, fill.err
+		}
+		// the object was just fetched, so it is fresh however old it may
+		// be allowed to get, but it may have been evicted again already
+		if body, info, ok := c.open(key, 0); ok {
+			return body, info, nil
+		}
+	}
+}
+
+// Forget drops the cached objects whose keys start with prefix, e.g. the
+// objects of a deleted video
+func (c *DiskCache) Forget(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, element := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(element)
+		}
+	}
+}
+
+// open returns the cached copy of an object, if there is a fresh one
+func (c *DiskCache) open(key string, maxAge time.Duration) (io.ReadCloser, *ObjectInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if maxAge > 0 && time.Since(entry.fetchedAt) > maxAge {
+		c.remove(element)
+		return nil, nil, false
+	}
+
+	// an evicted file stays readable for as long as it is open
+	file, err := os.Open(entry.path)
+	if err != nil {
+		c.remove(element)
+		return nil, nil, false
+	}
+
+	c.order.MoveToFront(element)
+	info := entry.info
+	return file, &info, true
+}
+
+// fill fetches an object into the cache and evicts the least recently
+// used objects until the cache is back within its size
+func (c *DiskCache) fill(ctx context.Context, store ObjectStore, key string) error {
+	body, info, err := store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if info.Size > c.maxBytes {
+		return errTooLargeToCache
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	cachePath := filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+
+	file, err := os.Create(cachePath + ".tmp")
+	if err != nil {
+		return fmt.Errorf("error creating cache file: %w", err)
+	}
+	written, err := io.Copy(file, io.LimitReader(body, c.maxBytes+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && written > c.maxBytes {
+		err = errTooLargeToCache
+	}
+	if err == nil {
+		err = os.Rename(cachePath+".tmp", cachePath)
+	}
+	if err != nil {
+		os.Remove(cachePath + ".tmp")
+		if errors.Is(err, errTooLargeToCache) {
+			return err
+		}
+		return fmt.Errorf("error caching object %s: %w", key, err)
+	}
+
+	info.Size = written
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		// a stale copy, replaced by the rename already
+		c.size -= element.Value.(*cacheEntry).info.Size
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, path: cachePath, info: *info, fetchedAt: time.Now()})
+	c.size += written
+
+	for c.size > c.maxBytes {
+		c.remove(c.order.Back())
+		cacheCounters.evictions.Add(1)
+	}
+	return nil
+}
+
+// remove drops an entry and its file, the caller holds the lock
+func (c *DiskCache) remove(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	c.order.Remove(element)
+	delete(c.entries, entry.key)
+	c.size -= entry.info.Size
+	os.Remove(entry.path)
+}
+
+// GetCacheStats returns the counters of the object cache, which are all
+// zero when the cache is off
+func GetCacheStats() CacheStats {
+	stats := CacheStats{
+		Hits:      cacheCounters.hits.Load(),
+		Misses:    cacheCounters.misses.Load(),
+		Collapsed: cacheCounters.collapsed.Load(),
+		Evictions: cacheCounters.evictions.Load(),
+	}
+
+	if c := GetCache(); c != nil {
+		c.mu.Lock()
+		stats.Bytes = c.size
+		stats.Entries = int64(len(c.entries))
+		c.mu.Unlock()
+	}
+	return stats
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// localStore keeps objects as plain files under a root directory, for
+// deployments that have no object storage to talk to.
+type localStore struct {
+	root string
+}
+
+func NewLocalStore(root string) (ObjectStore, error) {
+	if root == "" {
+		return nil, fmt.Errorf("local storage root is not set")
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving local storage root: %w", err)
+	}
+
+	if err := os.MkdirAll(absRoot, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating local storage root: %w", err)
+	}
+
+	return &localStore{root: absRoot}, nil
+}
+
+// path maps a key to a file under the root, refusing keys that would
+// escape it.
+func (s *localStore) path(key string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(key))
+	if cleaned == "." || filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid object key: %s", key)
+	}
+	return filepath.Join(s.root, cleaned), nil
+}
+
+func (s *localStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	objectPath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(objectPath), os.ModePerm); err != nil {
+		return fmt.Errorf("error creating object directory: %w", err)
+	}
+
+	// write next to the destination and rename, so readers never see a
+	// half written object
+	tmpFile, err := os.CreateTemp(filepath.Dir(objectPath), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary object file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := io.Copy(tmpFile, body); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("error writing object %s: %w", key, err)
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("error closing object %s: %w", key, err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), objectPath); err != nil {
+		return fmt.Errorf("error moving object %s into place: %w", key, err)
+	}
+
+	return nil
+}
+
+func (s *localStore) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	objectPath, err := s.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(objectPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, fmt.Errorf("error opening object %s: %w", key, err)
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("error getting object info of %s: %w", key, err)
+	}
+
+	return file, fileObjectInfo(key, fileInfo), nil
+}
+
+func (s *localStore) Delete(ctx context.Context, key string) error {
+	objectPath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(objectPath); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("error removing object %s: %w", key, err)
+	}
+
+	// drop the video folder once its last object is gone, this fails
+	// harmlessly while it still has files in it
+	if dir := filepath.Dir(objectPath); dir != s.root {
+		os.Remove(dir)
+	}
+
+	return nil
+}
+
+func (s *localStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := make([]ObjectInfo, 0)
+
+	// only walk the folder the prefix points into
+	walkRoot := s.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir, err := s.path(prefix[:i])
+		if err != nil {
+			return nil, err
+		}
+		walkRoot = dir
+	}
+
+	if _, err := os.Stat(walkRoot); os.IsNotExist(err) {
+		return objects, nil
+	}
+
+	err := filepath.WalkDir(walkRoot, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".upload-") {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(s.root, filePath)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(relPath)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, *fileObjectInfo(key, fileInfo))
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("error listing objects: %w", err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *localStore) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	objectPath, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := os.Stat(objectPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("error getting object info of %s: %w", key, err)
+	}
+
+	return fileObjectInfo(key, fileInfo), nil
+}
+
+func fileObjectInfo(key string, fileInfo fs.FileInfo) *ObjectInfo {
+	return &ObjectInfo{
+		Key:          key,
+		Size:         fileInfo.Size(),
+		ETag:         fmt.Sprintf("%x-%x", fileInfo.ModTime().UnixNano(), fileInfo.Size()),
+		LastModified: fileInfo.ModTime(),
+	}
+}
@@ -0,0 +1,367 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// objects above this size are sent with a multipart upload
+	s3MultipartThreshold = 16 * 1024 * 1024
+	// S3 rejects parts smaller than 5 MiB, except for the last one
+	s3PartSize = 8 * 1024 * 1024
+)
+
+type S3Options struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses the bucket as endpoint/bucket instead of
+	// bucket.endpoint, which is what MinIO expects
+	PathStyle bool
+}
+
+// Presigner is implemented by stores that can hand out time limited URLs
+// for reading an object directly.
+type Presigner interface {
+	PresignGet(key string, expiry time.Duration) (string, error)
+}
+
+type s3Store struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	pathStyle bool
+	signer    *sigV4Signer
+	client    *http.Client
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		ETag         string    `xml:"ETag"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+type s3InitiateMultipartResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+func NewS3Store(options S3Options) (ObjectStore, error) {
+	if options.Endpoint == "" || options.Bucket == "" {
+		return nil, fmt.Errorf("s3 endpoint and bucket must be set")
+	}
+
+	endpoint, err := url.Parse(options.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing s3 endpoint: %w", err)
+	}
+
+	if options.Region == "" {
+		options.Region = "us-east-1"
+	}
+
+	prefix := strings.Trim(options.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &s3Store{
+		endpoint:  endpoint,
+		bucket:    options.Bucket,
+		prefix:    prefix,
+		pathStyle: options.PathStyle,
+		signer: &sigV4Signer{
+			accessKey: options.AccessKey,
+			secretKey: options.SecretKey,
+			region:    options.Region,
+		},
+		client: &http.Client{},
+	}, nil
+}
+
+func (s *s3Store) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+
+	objectPath := ""
+	if s.pathStyle {
+		objectPath = "/" + s.bucket
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	if key != "" {
+		objectPath += "/" + s.prefix + key
+	} else if objectPath == "" {
+		objectPath = "/"
+	}
+
+	u.Path = strings.TrimSuffix(s.endpoint.Path, "/") + objectPath
+	u.RawPath = uriEncode(u.Path, false)
+	if query != nil {
+		u.RawQuery = canonicalQuery(query)
+	}
+	return &u
+}
+
+func (s *s3Store) do(ctx context.Context, method string, u *url.URL, body io.Reader, size int64, headers map[string]string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	if body != nil {
+		request.ContentLength = size
+		if size == 0 {
+			// a non nil body with no length would be sent chunked, which
+			// S3 refuses
+			request.Body = http.NoBody
+		}
+	}
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	s.signer.sign(request, time.Now())
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request to s3: %w", err)
+	}
+
+	if response.StatusCode == http.StatusNotFound {
+		response.Body.Close()
+		return nil, ErrNotFound
+	}
+
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+		var s3Err s3Error
+		responseBody, _ := io.ReadAll(response.Body)
+		if xml.Unmarshal(responseBody, &s3Err) == nil && s3Err.Code != "" {
+			return nil, fmt.Errorf("s3 returned status %d: %s: %s", response.StatusCode, s3Err.Code, s3Err.Message)
+		}
+		return nil, fmt.Errorf("s3 returned status %d: %s", response.StatusCode, string(responseBody))
+	}
+
+	return response, nil
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	if size > s3MultipartThreshold {
+		return s.putMultipart(ctx, key, body, contentType)
+	}
+
+	response, err := s.do(ctx, http.MethodPut, s.objectURL(key, nil), body, size, map[string]string{
+		"Content-Type": contentType,
+	})
+	if err != nil {
+		return fmt.Errorf("error uploading %s: %w", key, err)
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (s *s3Store) putMultipart(ctx context.Context, key string, body io.Reader, contentType string) error {
+	response, err := s.do(ctx, http.MethodPost, s.objectURL(key, url.Values{"uploads": {""}}), nil, 0, map[string]string{
+		"Content-Type": contentType,
+	})
+	if err != nil {
+		return fmt.Errorf("error starting multipart upload of %s: %w", key, err)
+	}
+
+	var initiated s3InitiateMultipartResult
+	err = xml.NewDecoder(response.Body).Decode(&initiated)
+	response.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error decoding multipart upload response: %w", err)
+	}
+
+	parts, err := s.uploadParts(ctx, key, initiated.UploadID, body)
+	if err != nil {
+		abortURL := s.objectURL(key, url.Values{"uploadId": {initiated.UploadID}})
+		if response, abortErr := s.do(context.Background(), http.MethodDelete, abortURL, nil, 0, nil); abortErr == nil {
+			response.Body.Close()
+		}
+		return err
+	}
+
+	completeBody, err := xml.Marshal(s3CompleteMultipartUpload{Parts: parts})
+	if err != nil {
+		return fmt.Errorf("error encoding multipart completion: %w", err)
+	}
+
+	completeURL := s.objectURL(key, url.Values{"uploadId": {initiated.UploadID}})
+	response, err = s.do(ctx, http.MethodPost, completeURL, bytes.NewReader(completeBody), int64(len(completeBody)), map[string]string{
+		"Content-Type": "application/xml",
+	})
+	if err != nil {
+		return fmt.Errorf("error completing multipart upload of %s: %w", key, err)
+	}
+	defer response.Body.Close()
+
+	// S3 may report a failed completion with a 200 status and an error body
+	completeResponse, _ := io.ReadAll(response.Body)
+	var s3Err s3Error
+	if xml.Unmarshal(completeResponse, &s3Err) == nil && s3Err.Code != "" {
+		return fmt.Errorf("error completing multipart upload of %s: %s: %s", key, s3Err.Code, s3Err.Message)
+	}
+
+	return nil
+}
+
+func (s *s3Store) uploadParts(ctx context.Context, key string, uploadID string, body io.Reader) ([]s3CompletedPart, error) {
+	parts := make([]s3CompletedPart, 0)
+	buffer := make([]byte, s3PartSize)
+
+	for partNumber := 1; ; partNumber++ {
+		n, err := io.ReadFull(body, buffer)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, fmt.Errorf("error reading part %d of %s: %w", partNumber, key, err)
+		}
+		if n == 0 {
+			return parts, nil
+		}
+
+		partURL := s.objectURL(key, url.Values{
+			"partNumber": {strconv.Itoa(partNumber)},
+			"uploadId":   {uploadID},
+		})
+		response, err := s.do(ctx, http.MethodPut, partURL, bytes.NewReader(buffer[:n]), int64(n), nil)
+		if err != nil {
+			return nil, fmt.Errorf("error uploading part %d of %s: %w", partNumber, key, err)
+		}
+		response.Body.Close()
+
+		parts = append(parts, s3CompletedPart{PartNumber: partNumber, ETag: response.Header.Get("ETag")})
+
+		if n < s3PartSize {
+			return parts, nil
+		}
+	}
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	response, err := s.do(ctx, http.MethodGet, s.objectURL(key, nil), nil, 0, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return response.Body, s.headerObjectInfo(key, response), nil
+}
+
+func (s *s3Store) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	response, err := s.do(ctx, http.MethodGet, s.objectURL(key, nil), nil, 0, map[string]string{
+		"Range": fmt.Sprintf("bytes=%d-%d", offset, offset+length-1),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rangeBody(response, offset, length)
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	response, err := s.do(ctx, http.MethodDelete, s.objectURL(key, nil), nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (s *s3Store) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := make([]ObjectInfo, 0)
+	continuationToken := ""
+
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.prefix + prefix},
+		}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		response, err := s.do(ctx, http.MethodGet, s.objectURL("", query), nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding object list: %w", err)
+		}
+
+		for _, content := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          strings.TrimPrefix(content.Key, s.prefix),
+				Size:         content.Size,
+				ETag:         content.ETag,
+				LastModified: content.LastModified,
+			})
+		}
+
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+func (s *s3Store) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	response, err := s.do(ctx, http.MethodHead, s.objectURL(key, nil), nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	return s.headerObjectInfo(key, response), nil
+}
+
+func (s *s3Store) PresignGet(key string, expiry time.Duration) (string, error) {
+	if expiry <= 0 || expiry > 7*24*time.Hour {
+		return "", fmt.Errorf("presign expiry must be between 1 second and 7 days")
+	}
+	return s.signer.presign(http.MethodGet, s.objectURL(key, nil), expiry, time.Now()), nil
+}
+
+func (s *s3Store) headerObjectInfo(key string, response *http.Response) *ObjectInfo {
+	info := &ObjectInfo{
+		Key:         key,
+		Size:        response.ContentLength,
+		ContentType: response.Header.Get("Content-Type"),
+		ETag:        response.Header.Get("ETag"),
+	}
+	if lastModified, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+		info.LastModified = lastModified
+	}
+	return info
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4, as described in
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+const (
+	sigV4Algorithm   = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat  = "20060102T150405Z"
+	sigV4DateFormat  = "20060102"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	sigV4ServiceName = "s3"
+)
+
+type sigV4Signer struct {
+	accessKey string
+	secretKey string
+	region    string
+}
+
+// sign adds the authorization headers to a request. Bodies are sent
+// unsigned so they can be streamed.
+func (s *sigV4Signer) sign(request *http.Request, now time.Time) {
+	amzDate := now.UTC().Format(sigV4TimeFormat)
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	headerNames := []string{"host"}
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		lowerName := strings.ToLower(name)
+		if lowerName == "content-type" || strings.HasPrefix(lowerName, "x-amz-") {
+			headerNames = append(headerNames, lowerName)
+			headers[lowerName] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		canonicalURI(request.URL),
+		canonicalQuery(request.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+
+	scope := s.scope(now)
+	signature := s.signature(now, s.stringToSign(amzDate, scope, canonicalRequest))
+
+	request.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, s.accessKey, scope, signedHeaders, signature))
+}
+
+// presign returns a copy of the URL that can be fetched with a plain GET
+// until it expires.
+func (s *sigV4Signer) presign(method string, u *url.URL, expiry time.Duration, now time.Time) string {
+	amzDate := now.UTC().Format(sigV4TimeFormat)
+	scope := s.scope(now)
+
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", sigV4Algorithm)
+	query.Set("X-Amz-Credential", s.accessKey+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", fmt.Sprintf("%d", int(expiry.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalURI(u),
+		canonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+
+	signature := s.signature(now, s.stringToSign(amzDate, scope, canonicalRequest))
+
+	presigned := *u
+	presigned.RawQuery = canonicalQuery(query) + "&X-Amz-Signature=" + signature
+	return presigned.String()
+}
+
+func (s *sigV4Signer) scope(now time.Time) string {
+	return now.UTC().Format(sigV4DateFormat) + "/" + s.region + "/" + sigV4ServiceName + "/aws4_request"
+}
+
+func (s *sigV4Signer) stringToSign(amzDate string, scope string, canonicalRequest string) string {
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	return strings.Join([]string{
+		sigV4Algorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(hashedRequest[:]),
+	}, "\n")
+}
+
+func (s *sigV4Signer) signature(now time.Time, stringToSign string) string {
+	dateKey := hmacSHA256([]byte("AWS4"+s.secretKey), now.UTC().Format(sigV4DateFormat))
+	regionKey := hmacSHA256(dateKey, s.region)
+	serviceKey := hmacSHA256(regionKey, sigV4ServiceName)
+	signingKey := hmacSHA256(serviceKey, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func canonicalURI(u *url.URL) string {
+	uri := u.EscapedPath()
+	if uri == "" {
+		return "/"
+	}
+	return uri
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode escapes everything except the unreserved characters, which is
+// stricter than url.QueryEscape and what SigV4 expects.
+func uriEncode(value string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z', b >= '0' && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			encoded.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"time"
+	"video-streaming-server/config"
+	"video-streaming-server/shared/logger"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+}
+
+// ObjectStore is implemented by every storage backend the server can
+// keep segments, manifests and thumbnails in. Keys are slash separated
+// and always start with the ID of the video they belong to.
+type ObjectStore interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+}
+
+// PublicURLer is implemented by stores whose objects can be fetched by
+// the browser directly, without going through the server.
+type PublicURLer interface {
+	PublicURL(key string) string
+}
+
+// RangeGetter is implemented by stores that can fetch part of an object,
+// so range requests are answered without downloading all of it. Objects
+// of stores that do not implement it are served from seekable bodies.
+type RangeGetter interface {
+	GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error)
+}
+
+var Store ObjectStore
+
+// New creates the store selected by STORAGE_BACKEND
+func New(cfg *config.Config) (ObjectStore, error) {
+	switch cfg.StorageBackend {
+	case "", "appwrite":
+		return NewAppwriteStore(cfg.AppwriteEndpoint, cfg.AppwriteBucketID, cfg.AppwriteProjectID, cfg.AppwriteKey, cfg.AppwriteResponseFormat), nil
+	case "local":
+		root := cfg.StorageLocalRoot
+		if root == "" {
+			root = filepath.Join(cfg.RootPath, "media")
+		}
+		return NewLocalStore(root)
+	case "s3":
+		return NewS3Store(S3Options{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			Prefix:    cfg.S3Prefix,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			PathStyle: cfg.S3PathStyle,
+		})
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", cfg.StorageBackend)
+	}
+}
+
+func GetStore() (ObjectStore, error) {
+	if Store == nil {
+		store, err := New(config.AppConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create object store: %w", err)
+		}
+		logger.Log.Info("object store initialized", "backend", config.AppConfig.StorageBackend)
+		Store = store
+	}
+	return Store, nil
+}
+
+func ManifestKey(videoID string) string {
+	return videoID + "/" + videoID + ".m3u8"
+}
+
+func DashManifestKey(videoID string) string {
+	return videoID + "/" + videoID + ".mpd"
+}
+
+func ThumbnailKey(videoID string) string {
+	return videoID + "/" + videoID + "_thumbnail.png"
+}
+
+// ObjectKey returns the key of a file produced while processing a video,
+// e.g. one of its segments.
+func ObjectKey(videoID string, fileName string) string {
+	return videoID + "/" + fileName
+}
+
+// rangeBody returns length bytes from offset of a response to a range
+// request. Backends that ignore the range answer with the whole object,
+// which is skipped to the range.
+func rangeBody(response *http.Response, offset int64, length int64) (io.ReadCloser, error) {
+	if response.StatusCode != http.StatusPartialContent {
+		if _, err := io.CopyN(io.Discard, response.Body, offset); err != nil {
+			response.Body.Close()
+			return nil, fmt.Errorf("error skipping to range: %w", err)
+		}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(response.Body, length), response.Body}, nil
+}
@@ -12,6 +12,23 @@ type HomePageData struct {
 	Username   string
 }
 
+type ImportRequest struct {
+	URL         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+type LiveRequest struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// LiveResponseType tells the publisher of a live stream where to send it
+type LiveResponseType struct {
+	ID        string `json:"id"`
+	IngestURL string `json:"ingest_url"`
+}
+
 type UpdateRequest struct {
 	Title       string `json:"title"`
 	Description string `json:"description"`
@@ -20,6 +37,8 @@ type UpdateRequest struct {
 type Stream struct {
 	CodecName string `json:"codec_name"`
 	CodecType string `json:"codec_type"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
 }
 
 type Format struct {
@@ -40,6 +59,7 @@ type Video struct {
 	Description string         `json:"description"`
 	Thumbnail   sql.NullString `json:"thumbnail"`
 	Status      VideoStatus    `json:"status"`
+	Tags        []string       `json:"tags"`
 }
 
 type SessionID string
@@ -69,11 +89,14 @@ type ThumbnailUploadResponse struct {
 }
 
 type VideoResponseType struct {
-	ID          string      `json:"id"`
-	Title       string      `json:"title"`
-	Description string      `json:"description"`
-	Thumbnail   string      `json:"thumbnail"`
-	Status      VideoStatus `json:"status"`
+	ID            string      `json:"id"`
+	Title         string      `json:"title"`
+	Description   string      `json:"description"`
+	Thumbnail     string      `json:"thumbnail"`
+	Status        VideoStatus `json:"status"`
+	FailureReason string      `json:"failure_reason,omitempty"`
+	Tags          []string    `json:"tags,omitempty"`
+	LiveStatus    LiveStatus  `json:"live_status,omitempty"`
 }
 
 func NewUser(username, email, password string) (*User, error) {
@@ -125,13 +148,167 @@ func (u *User) GetEmail() string {
 type VideoStatus int
 
 const (
+	Cancelled           VideoStatus = -2
 	ProcessingFailed    VideoStatus = -1
 	UploadPending       VideoStatus = 0
 	UploadedOnServer    VideoStatus = 1
 	ProcessingCompleted VideoStatus = 2
 )
 
+// LiveStatus is where a video streamed live is at, its recording goes
+// through the usual statuses once the stream has ended
+type LiveStatus string
+
+const (
+	LiveWaiting LiveStatus = "waiting"
+	LiveOn      LiveStatus = "live"
+	LiveEnded   LiveStatus = "ended"
+)
+
+// UploadSession tracks a video uploaded in chunks from the upload page,
+// the checksums are hex encoded SHA-256 sums
+type UploadSession struct {
+	VideoID      string
+	UserID       string
+	ExpectedSize int64
+	ReceivedSize int64
+	FileSHA256   string
+	// HashState is the SHA-256 of the chunks received so far, see
+	// utils.ResumeSHA256
+	HashState []byte
+}
+
+type UploadChunk struct {
+	Offset int64
+	Size   int64
+	SHA256 string
+}
+
+// TusUpload is an upload made with the tus protocol, its ID is the ID of
+// the video it creates
+type TusUpload struct {
+	ID        string
+	UserID    string
+	Length    int64
+	Offset    int64
+	Metadata  string
+	ExpiresAt time.Time
+}
+
+type ProcessingStage string
+
+const (
+	StageDownloading  ProcessingStage = "downloading"
+	StageThumbnailing ProcessingStage = "thumbnailing"
+	StageSegmenting   ProcessingStage = "segmenting"
+	StagePackaging    ProcessingStage = "packaging"
+	StageUploading    ProcessingStage = "uploading"
+)
+
+// VideoProgressType is the payload of video_progress events. ETASeconds is
+// -1 while the remaining time is not known yet.
+type VideoProgressType struct {
+	ID         string          `json:"id"`
+	Stage      ProcessingStage `json:"stage"`
+	Percent    int             `json:"percent"`
+	ETASeconds int             `json:"eta_seconds"`
+}
+
+type JobKind string
+
+const (
+	TranscodeJob JobKind = "transcode"
+	ImportJob    JobKind = "import"
+	BundleJob    JobKind = "bundle"
+	ExtractJob   JobKind = "extract"
+)
+
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobCompleted JobState = "completed"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// Job is a row of the processing_jobs table together with the video it
+// processes
+type Job struct {
+	ID          int64
+	VideoID     string
+	Kind        JobKind
+	State       JobState
+	Attempts    int
+	MaxAttempts int
+	LastError   sql.NullString
+	VideoTitle  string
+	UserID      UserID
+}
+
 type SSEType struct {
 	Event string `json:"event"`
 	Data  any    `json:"data"`
 }
+
+// Quota is what a user may store, a nil limit is unlimited
+type Quota struct {
+	MaxBytes   *int64 `json:"max_bytes"`
+	MaxVideos  *int64 `json:"max_videos"`
+	MaxMinutes *int64 `json:"max_minutes"`
+}
+
+// Usage is what a user stores. Bytes counts the processed output of their
+// videos, PendingBytes the size of the uploads not processed yet.
+type Usage struct {
+	Bytes        int64   `json:"bytes"`
+	PendingBytes int64   `json:"pending_bytes"`
+	Videos       int64   `json:"videos"`
+	Minutes      float64 `json:"minutes"`
+}
+
+type UsageResponseType struct {
+	Role   string `json:"role"`
+	Usage  Usage  `json:"usage"`
+	Limits Quota  `json:"limits"`
+}
+
+// StoredContent is the processed output of a video in the store, which
+// videos with the same content share
+type StoredContent struct {
+	StorageID       string
+	Thumbnail       sql.NullString
+	OutputBytes     int64
+	DurationSeconds float64
+}
+
+// BatchEntry is a video of a bulk upload. File is its path in the archive,
+// the rest comes from the archive's metadata file when it lists the video.
+type BatchEntry struct {
+	VideoID     string   `json:"id"`
+	File        string   `json:"file"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+	Size        int64    `json:"-"`
+}
+
+type BatchResponseType struct {
+	ID     string       `json:"id"`
+	Videos []BatchEntry `json:"videos"`
+}
+
+// BatchProgressType is the payload of batch_progress events. Extracting
+// counts the videos still being taken out of the archive, Failed the ones
+// that failed or were cancelled and Percent the share that is done either
+// way.
+type BatchProgressType struct {
+	ID         string `json:"id"`
+	Total      int    `json:"total"`
+	Extracting int    `json:"extracting"`
+	Processing int    `json:"processing"`
+	Completed  int    `json:"completed"`
+	Failed     int    `json:"failed"`
+	Percent    int    `json:"percent"`
+}
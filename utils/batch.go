@@ -0,0 +1,329 @@
+package utils
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"video-streaming-server/config"
+	"video-streaming-server/repositories"
+	"video-streaming-server/shared"
+	"video-streaming-server/types"
+)
+
+// the metadata of a bulk upload is read from a file with one of these
+// names, paths in it are relative to the directory it is in
+var batchManifestNames = []string{"metadata.json", "metadata.csv"}
+
+// BatchArchivePath is where the archive of a bulk upload is kept while its
+// videos are extracted. The reaper removes it once none of them are left
+// to extract.
+func BatchArchivePath(batchID string) string {
+	return "./video/" + batchID + ".zip"
+}
+
+// PlanBatch lists the videos in the archive of a bulk upload with their
+// metadata. Videos are the files with a supported extension and the ones
+// the metadata file lists, those it does not list are titled after their
+// file name. Problems with the archive are returned as a
+// *MediaValidationError.
+func PlanBatch(archive *zip.Reader) ([]types.BatchEntry, error) {
+	manifest, manifestName, err := readBatchManifest(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	supported := make([]string, 0, len(config.SupportedFileTypes))
+	for _, fileType := range config.SupportedFileTypes {
+		supported = append(supported, fileType.FileExtension)
+	}
+	sizeLimit, _ := strconv.ParseInt(config.AppConfig.FileSizeLimit, 10, 64)
+
+	entries := make([]types.BatchEntry, 0)
+	for _, file := range archive.File {
+		name := path.Clean(file.Name)
+		if file.FileInfo().IsDir() || isHiddenArchivePath(name) {
+			continue
+		}
+
+		metadata, listed := manifest[name]
+		delete(manifest, name)
+		if !listed && !slices.Contains(supported, strings.ToLower(path.Ext(name))) {
+			continue
+		}
+
+		if int64(file.UncompressedSize64) > sizeLimit {
+			return nil, &MediaValidationError{
+				Reason: fmt.Sprintf("%s is larger than the limit of %d MB", name, sizeLimit/(1024*1024)),
+			}
+		}
+
+		entry := types.BatchEntry{
+			File:  name,
+			Title: strings.TrimSuffix(path.Base(name), path.Ext(name)),
+			Tags:  []string{},
+			Size:  int64(file.UncompressedSize64),
+		}
+		if listed {
+			if metadata.Title != "" {
+				entry.Title = metadata.Title
+			}
+			entry.Description = metadata.Description
+			entry.Tags = metadata.Tags
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(manifest) > 0 {
+		missing := slices.Sorted(maps.Keys(manifest))[0]
+		return nil, &MediaValidationError{
+			Reason: fmt.Sprintf("%s lists %s, which is not in the archive", manifestName, manifest[missing].File),
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, &MediaValidationError{Reason: "The archive has no videos"}
+	}
+	return entries, nil
+}
+
+// ExtractBatchVideo takes a video of a bulk upload out of the archive it
+// came with, checks it like an upload and marks it uploaded. A video an
+// earlier attempt extracted is not extracted again. Problems with the
+// archive or the video are returned as a *MediaValidationError since
+// trying again does not help. It returns false when the video was
+// cancelled or deleted in the meantime, which leaves nothing to process.
+func ExtractBatchVideo(ctx context.Context, db *sql.DB, videoID string, userID types.UserID) (bool, error) {
+	repository := repositories.NewBatchRepository(db)
+
+	batchID, entry, err := repository.GetEntry(videoID)
+	if err != nil {
+		return false, fmt.Errorf("error getting batch entry: %w", err)
+	}
+	if entry == nil {
+		return false, &MediaValidationError{Reason: "The video has nothing to extract"}
+	}
+
+	if _, err := FindSourceVideo(videoID); err == nil {
+		processingLogger(videoID).Info("video already extracted from batch")
+	} else {
+		archive, err := zip.OpenReader(BatchArchivePath(batchID))
+		if errors.Is(err, os.ErrNotExist) {
+			return false, &MediaValidationError{Reason: "The archive of the batch is gone"}
+		}
+		if err != nil {
+			return false, fmt.Errorf("error opening batch archive: %w", err)
+		}
+		err = ExtractBatchEntry(ctx, &archive.Reader, *entry)
+		archive.Close()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	extracted, err := repository.MarkExtracted(videoID)
+	if err != nil {
+		return false, fmt.Errorf("error updating upload status for video in DB: %w", err)
+	}
+	if !extracted {
+		// cancelled or deleted while it was being extracted
+		if sourcePath, err := FindSourceVideo(videoID); err == nil {
+			os.Remove(sourcePath)
+		}
+		return false, nil
+	}
+
+	shared.SendEventToUser(userID, "video_status", types.VideoResponseType{
+		ID:     videoID,
+		Title:  entry.Title,
+		Status: types.UploadedOnServer,
+	})
+	return true, nil
+}
+
+// ExtractBatchEntry takes a video of a bulk upload out of its archive and
+// checks it like an upload. A video that is larger than the archive
+// claims is turned down.
+func ExtractBatchEntry(ctx context.Context, archive *zip.Reader, entry types.BatchEntry) error {
+	index := slices.IndexFunc(archive.File, func(file *zip.File) bool {
+		return path.Clean(file.Name) == entry.File
+	})
+	if index < 0 {
+		return &MediaValidationError{Reason: fmt.Sprintf("%s is not in the archive", entry.File)}
+	}
+
+	if err := extractFile(archive.File[index], PartialVideoPath(entry.VideoID), entry.Size); err != nil {
+		os.Remove(PartialVideoPath(entry.VideoID))
+		return err
+	}
+
+	if _, err := FinishUpload(ctx, entry.VideoID, entry.File); err != nil {
+		os.Remove(PartialVideoPath(entry.VideoID))
+		return err
+	}
+	return nil
+}
+
+func extractFile(file *zip.File, filePath string, size int64) error {
+	reader, err := file.Open()
+	if err != nil {
+		return &MediaValidationError{Reason: fmt.Sprintf("%s could not be read from the archive", file.Name)}
+	}
+	defer reader.Close()
+
+	output, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("error creating file: %w", err)
+	}
+	defer output.Close()
+
+	// one byte past the size tells an entry of the size it claims from one
+	// that is larger
+	written, err := io.Copy(output, io.LimitReader(reader, size+1))
+	var corrupt flate.CorruptInputError
+	if errors.Is(err, zip.ErrChecksum) || errors.Is(err, zip.ErrFormat) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &corrupt) {
+		return &MediaValidationError{Reason: fmt.Sprintf("%s is damaged in the archive", file.Name)}
+	}
+	if err != nil {
+		return fmt.Errorf("error extracting %s: %w", file.Name, err)
+	}
+	if written > size {
+		return &MediaValidationError{Reason: fmt.Sprintf("%s is larger than the archive claims", file.Name)}
+	}
+	return nil
+}
+
+// readBatchManifest reads the metadata file of a bulk upload, keyed by the
+// paths of the videos in the archive, and returns its name. The
+// shallowest metadata file is used, so an archive of a folder works like
+// one of its contents.
+func readBatchManifest(archive *zip.Reader) (map[string]types.BatchEntry, string, error) {
+	var manifestFile *zip.File
+	for _, file := range archive.File {
+		name := path.Clean(file.Name)
+		if file.FileInfo().IsDir() || isHiddenArchivePath(name) || !slices.Contains(batchManifestNames, strings.ToLower(path.Base(name))) {
+			continue
+		}
+		if manifestFile == nil || strings.Count(name, "/") < strings.Count(path.Clean(manifestFile.Name), "/") {
+			manifestFile = file
+		}
+	}
+
+	manifest := make(map[string]types.BatchEntry)
+	if manifestFile == nil {
+		return manifest, "", nil
+	}
+
+	name := path.Clean(manifestFile.Name)
+	dir := path.Dir(name)
+	invalid := func(reason string) error {
+		return &MediaValidationError{Reason: fmt.Sprintf("%s is not valid, %s", name, reason)}
+	}
+
+	reader, err := manifestFile.Open()
+	if err != nil {
+		return nil, "", invalid("it could not be read from the archive")
+	}
+	defer reader.Close()
+
+	var entries []types.BatchEntry
+	if strings.ToLower(path.Ext(name)) == ".json" {
+		if err := json.NewDecoder(reader).Decode(&entries); err != nil {
+			return nil, "", invalid("expected a list of objects with file, title, description and tags")
+		}
+	} else {
+		entries, err = readBatchCSV(reader)
+		if err != nil {
+			return nil, "", invalid(err.Error())
+		}
+	}
+
+	for _, entry := range entries {
+		if strings.TrimSpace(entry.File) == "" {
+			return nil, "", invalid("every video needs a file")
+		}
+		entry.Title = strings.TrimSpace(entry.Title)
+		entry.Tags = cleanTags(entry.Tags)
+
+		file := path.Join(dir, entry.File)
+		if _, exists := manifest[file]; exists {
+			return nil, "", invalid(fmt.Sprintf("%s is listed twice", entry.File))
+		}
+		manifest[file] = entry
+	}
+	return manifest, name, nil
+}
+
+// readBatchCSV reads a metadata file with a header row naming its
+// columns, file is required and title, description and tags are optional.
+// Tags are separated by commas or semicolons.
+func readBatchCSV(reader io.Reader) ([]types.BatchEntry, error) {
+	records, err := csv.NewReader(reader).ReadAll()
+	if err != nil {
+		return nil, errors.New("it could not be read as CSV")
+	}
+	if len(records) == 0 {
+		return nil, errors.New("it has no header row")
+	}
+
+	columns := make(map[string]int)
+	for i, column := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(column))] = i
+	}
+	if _, ok := columns["file"]; !ok {
+		return nil, errors.New("it has no file column")
+	}
+
+	field := func(record []string, column string) string {
+		if i, ok := columns[column]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	entries := make([]types.BatchEntry, 0, len(records)-1)
+	for _, record := range records[1:] {
+		entries = append(entries, types.BatchEntry{
+			File:        field(record, "file"),
+			Title:       field(record, "title"),
+			Description: field(record, "description"),
+			Tags: strings.FieldsFunc(field(record, "tags"), func(r rune) bool {
+				return r == ',' || r == ';'
+			}),
+		})
+	}
+	return entries, nil
+}
+
+func cleanTags(tags []string) []string {
+	cleaned := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !slices.Contains(cleaned, tag) {
+			cleaned = append(cleaned, tag)
+		}
+	}
+	return cleaned
+}
+
+// isHiddenArchivePath tells files archivers add, like the __MACOSX folder
+// and dot files, from the ones that were meant to be uploaded
+func isHiddenArchivePath(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,585 @@
+package utils
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"video-streaming-server/config"
+	"video-streaming-server/repositories"
+	"video-streaming-server/storage"
+	"video-streaming-server/types"
+)
+
+// playlistSizeLimit is how large a playlist in a bundle may be, real ones
+// are a few hundred kilobytes at most
+const playlistSizeLimit = 4 * 1024 * 1024
+
+// bundleSegmentExtensions are the files the media playlists of a bundle may
+// list, MPEG-TS or fragmented MP4 segments and the init segments of the
+// latter
+var bundleSegmentExtensions = []string{".ts", ".m4s", ".mp4"}
+
+// BundleArchivePath is where the archive of an HLS bundle is kept until it
+// is imported. It counts as the upload of the video, so it is cleaned up
+// like one.
+func BundleArchivePath(videoID string) string {
+	return SourceVideoPath(videoID, ".zip")
+}
+
+// bundlePlaylist is a playlist of an HLS bundle. Files it refers to are
+// kept by their path in the archive.
+type bundlePlaylist struct {
+	name   string
+	lines  []string
+	master bool
+	ended  bool
+	// files lists what the playlist refers to in order, paths maps its
+	// URIs to them
+	files []string
+	paths map[string]string
+	// inits are the files named by EXT-X-MAP
+	inits    map[string]bool
+	duration float64
+}
+
+// hlsBundle is the playlist an HLS bundle is played from and the media
+// playlists it leads to. A bundle of a single media playlist has no master
+// playlist, one is written for it.
+type hlsBundle struct {
+	master *bundlePlaylist
+	media  []*bundlePlaylist
+	files  map[string]*zip.File
+	size   int64
+}
+
+// CheckBundle checks that an archive is an HLS bundle whose playlists
+// parse and whose segments are all there, and returns the size of its
+// contents. The segments themselves are checked when it is imported.
+// Problems with the bundle are returned as a *MediaValidationError.
+func CheckBundle(archive *zip.Reader) (int64, error) {
+	bundle, err := planBundle(archive)
+	if err != nil {
+		return 0, err
+	}
+	return bundle.size, nil
+}
+
+// ImportBundle stores a pre-packaged HLS bundle as the output of a video
+// without encoding it again. The segments are checked to be H.264 video
+// with AAC audio, and the files are renamed the way processing names
+// them. The segments are stored as they are, so bundles are turned down
+// while HLS_ENCRYPTION or DASH_ENABLED is on. It runs as a job and may be retried, so
+// output left behind by an earlier attempt is cleared first and the
+// archive is only removed once everything is stored.
+func ImportBundle(ctx context.Context, db *sql.DB, videoID string, videoTitle string, userID types.UserID) error {
+	bundleLogger := processingLogger(videoID)
+	bundleLogger.Info("importing HLS bundle")
+
+	if config.AppConfig.HLSEncryption {
+		return &MediaValidationError{Reason: "HLS bundles cannot be imported while HLS encryption is on"}
+	}
+	if config.AppConfig.DashEnabled {
+		return &MediaValidationError{Reason: "HLS bundles cannot be imported while DASH output is on"}
+	}
+
+	archive, err := zip.OpenReader(BundleArchivePath(videoID))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &MediaValidationError{Reason: "The bundle has nothing to import"}
+		}
+		return fmt.Errorf("error opening bundle: %w", err)
+	}
+	defer archive.Close()
+
+	bundle, err := planBundle(&archive.Reader)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range []string{"thumbnails/" + videoID, "segments/" + videoID} {
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("error removing output of a previous attempt: %w", err)
+		}
+	}
+	segmentsDir := "segments/" + videoID + "/"
+	if err := os.MkdirAll(segmentsDir, os.ModePerm); err != nil {
+		return fmt.Errorf("error creating segments directory: %w", err)
+	}
+
+	// every media playlist gets the names ffmpeg gives a rendition
+	names := make([]map[string]string, len(bundle.media))
+	for i, media := range bundle.media {
+		names[i] = bundleFileNames(videoID, i, media)
+		for _, file := range media.files {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := extractFile(bundle.files[file], segmentsDir+names[i][file], int64(bundle.files[file].UncompressedSize64)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// every segment is probed, since any of them could hold something
+	// else than the first. The first rendition with video sets the length
+	// and thumbnail.
+	var video *bundlePlaylist
+	var videoMetadata *types.FFProbeOutput
+	var videoSample string
+	for i, media := range bundle.media {
+		init := ""
+		for _, file := range media.files {
+			if media.inits[file] {
+				init = file
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			sample, err := bundleSample(segmentsDir, names[i], init, file)
+			if err != nil {
+				return err
+			}
+			metadata, err := checkBundleCodecs(ctx, sample, file)
+			if err != nil {
+				os.Remove(sample)
+				return err
+			}
+
+			if video == nil && slices.ContainsFunc(metadata.Streams, func(stream types.Stream) bool {
+				return stream.CodecType == "video"
+			}) {
+				video, videoMetadata, videoSample = media, metadata, sample
+				defer os.Remove(sample)
+			} else {
+				os.Remove(sample)
+			}
+		}
+	}
+	if video == nil {
+		return &MediaValidationError{Reason: "The bundle has no video"}
+	}
+	if time.Duration(video.duration*float64(time.Second)) > maxSourceDuration {
+		return &MediaValidationError{Reason: fmt.Sprintf("The video is longer than %d hours", int(maxSourceDuration.Hours()))}
+	}
+
+	for i, media := range bundle.media {
+		playlist := rewriteBundlePlaylist(media, names[i])
+		if err := os.WriteFile(segmentsDir+bundlePlaylistName(videoID, i), playlist, 0644); err != nil {
+			return fmt.Errorf("error writing playlist: %w", err)
+		}
+	}
+
+	var master []byte
+	if bundle.master != nil {
+		mediaNames := make(map[string]string, len(bundle.media))
+		for i, media := range bundle.media {
+			mediaNames[media.name] = bundlePlaylistName(videoID, i)
+		}
+		master = rewriteBundlePlaylist(bundle.master, mediaNames)
+	} else {
+		master = bundleMasterPlaylist(videoID, bundle, videoMetadata)
+	}
+	if err := os.WriteFile(segmentsDir+videoID+".m3u8", master, 0644); err != nil {
+		return fmt.Errorf("error writing master playlist: %w", err)
+	}
+
+	store, err := storage.GetStore()
+	if err != nil {
+		return fmt.Errorf("error getting object store: %w", err)
+	}
+
+	progress := newProgressReporter(userID, videoID)
+
+	progress.startStage(types.StageThumbnailing)
+	thumbnailURL := ""
+	if _, err := extractThumbnail(ctx, videoSample, videoID); err != nil {
+		bundleLogger.Error("error extracting thumbnail for video", "error", err)
+	} else {
+		thumbnailURL, err = uploadThumbnail(ctx, store, videoID, db)
+		if err != nil {
+			bundleLogger.Error("error uploading thumbnail to storage", "error", err)
+		}
+	}
+	progress.finishStage()
+
+	progress.startStage(types.StageUploading)
+	outputSize, err := uploadSegments(ctx, store, videoID, progress)
+	if err != nil {
+		return fmt.Errorf("error uploading segments to storage: %w", err)
+	}
+	progress.finishStage()
+	bundleLogger.Info("uploaded HLS bundle to storage", "renditions", len(bundle.media))
+
+	if err := repositories.NewVideoRepository(db).RecordOutput(videoID, outputSize, video.duration); err != nil {
+		return fmt.Errorf("error recording output size for video in DB: %w", err)
+	}
+
+	return finishProcessing(db, BundleArchivePath(videoID), videoID, videoTitle, userID, thumbnailURL)
+}
+
+// planBundle finds the playlist a bundle is played from, the shallowest
+// master playlist or else its only media playlist, and checks that the
+// media playlists it leads to are complete and all their segments are in
+// the archive
+func planBundle(archive *zip.Reader) (*hlsBundle, error) {
+	bundle := &hlsBundle{files: make(map[string]*zip.File)}
+	for _, file := range archive.File {
+		name := path.Clean(file.Name)
+		if file.FileInfo().IsDir() || isHiddenArchivePath(name) {
+			continue
+		}
+		bundle.files[name] = file
+		bundle.size += int64(file.UncompressedSize64)
+	}
+
+	if bundle.size > config.AppConfig.BatchSizeLimit {
+		return nil, &MediaValidationError{
+			Reason: fmt.Sprintf("The bundle is larger than the limit of %d MB", config.AppConfig.BatchSizeLimit/(1024*1024)),
+		}
+	}
+
+	playlists := make(map[string]*bundlePlaylist)
+	for _, name := range slices.Sorted(maps.Keys(bundle.files)) {
+		if strings.ToLower(path.Ext(name)) != ".m3u8" {
+			continue
+		}
+		playlist, err := readBundlePlaylist(bundle.files[name], name)
+		if err != nil {
+			return nil, err
+		}
+		playlists[name] = playlist
+	}
+
+	root, err := bundleRoot(playlists)
+	if err != nil {
+		return nil, err
+	}
+
+	if root.master {
+		bundle.master = root
+		for _, file := range root.files {
+			media, ok := playlists[file]
+			switch {
+			case ok && media.master:
+				return nil, &MediaValidationError{Reason: fmt.Sprintf("%s refers to %s, which is another master playlist", root.name, file)}
+			case ok:
+				bundle.media = append(bundle.media, media)
+			case bundle.files[file] != nil:
+				return nil, &MediaValidationError{Reason: fmt.Sprintf("%s refers to %s, which is not a playlist", root.name, file)}
+			default:
+				return nil, &MediaValidationError{Reason: fmt.Sprintf("%s refers to %s, which is not in the archive", root.name, file)}
+			}
+		}
+		if len(bundle.media) == 0 {
+			return nil, &MediaValidationError{Reason: fmt.Sprintf("%s lists no media playlists", root.name)}
+		}
+	} else {
+		bundle.media = []*bundlePlaylist{root}
+	}
+
+	for _, media := range bundle.media {
+		if !media.ended {
+			return nil, &MediaValidationError{Reason: fmt.Sprintf("%s is not a complete video, it has no #EXT-X-ENDLIST", media.name)}
+		}
+		if len(media.files) == len(media.inits) {
+			return nil, &MediaValidationError{Reason: fmt.Sprintf("%s lists no segments", media.name)}
+		}
+		for _, file := range media.files {
+			if bundle.files[file] == nil {
+				return nil, &MediaValidationError{Reason: fmt.Sprintf("%s refers to %s, which is not in the archive", media.name, file)}
+			}
+			if !slices.Contains(bundleSegmentExtensions, strings.ToLower(path.Ext(file))) {
+				return nil, &MediaValidationError{
+					Reason: fmt.Sprintf("%s refers to %s, only %s segments are supported", media.name, file, strings.Join(bundleSegmentExtensions, ", ")),
+				}
+			}
+		}
+	}
+	return bundle, nil
+}
+
+// bundleRoot picks the playlist a bundle is played from, so an archive of
+// a folder works like one of its contents
+func bundleRoot(playlists map[string]*bundlePlaylist) (*bundlePlaylist, error) {
+	if len(playlists) == 0 {
+		return nil, &MediaValidationError{Reason: "The archive has no .m3u8 playlist"}
+	}
+
+	candidates := make([]*bundlePlaylist, 0)
+	for _, playlist := range playlists {
+		if playlist.master {
+			candidates = append(candidates, playlist)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = slices.Collect(maps.Values(playlists))
+	}
+
+	slices.SortFunc(candidates, func(a, b *bundlePlaylist) int {
+		if depth := strings.Count(a.name, "/") - strings.Count(b.name, "/"); depth != 0 {
+			return depth
+		}
+		return strings.Compare(a.name, b.name)
+	})
+	if len(candidates) > 1 && strings.Count(candidates[0].name, "/") == strings.Count(candidates[1].name, "/") {
+		return nil, &MediaValidationError{
+			Reason: fmt.Sprintf("The archive has more than one playlist to play, %s and %s", candidates[0].name, candidates[1].name),
+		}
+	}
+	return candidates[0], nil
+}
+
+// readBundlePlaylist parses a playlist of a bundle. Encrypted and byte
+// range playlists are turned down, the segments of a video are stored and
+// served as whole, unencrypted files.
+func readBundlePlaylist(file *zip.File, name string) (*bundlePlaylist, error) {
+	invalid := func(reason string) error {
+		return &MediaValidationError{Reason: fmt.Sprintf("%s is not valid, %s", name, reason)}
+	}
+
+	reader, err := file.Open()
+	if err != nil {
+		return nil, invalid("it could not be read from the archive")
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, playlistSizeLimit+1))
+	if err != nil {
+		return nil, invalid("it could not be read from the archive")
+	}
+	if len(data) > playlistSizeLimit {
+		return nil, invalid("it is too large")
+	}
+
+	text := strings.TrimPrefix(strings.ReplaceAll(string(data), "\r\n", "\n"), "\ufeff")
+	playlist := &bundlePlaylist{
+		name:  name,
+		lines: strings.Split(text, "\n"),
+		paths: make(map[string]string),
+		inits: make(map[string]bool),
+	}
+	if strings.TrimSpace(playlist.lines[0]) != "#EXTM3U" {
+		return nil, invalid("it does not start with #EXTM3U")
+	}
+
+	// I-frame playlists only help seeking and point into the segments
+	// with byte ranges, they are left out
+	playlist.lines = slices.DeleteFunc(playlist.lines, func(line string) bool {
+		return strings.HasPrefix(strings.TrimSpace(line), "#EXT-X-I-FRAME-STREAM-INF")
+	})
+
+	for _, line := range playlist.lines {
+		line = strings.TrimSpace(line)
+		tag, attributes, _ := strings.Cut(line, ":")
+		switch tag {
+		case "#EXT-X-STREAM-INF", "#EXT-X-MEDIA":
+			playlist.master = true
+		case "#EXT-X-KEY", "#EXT-X-SESSION-KEY":
+			if !strings.Contains(attributes, "METHOD=NONE") {
+				return nil, invalid("encrypted playlists are not supported")
+			}
+		case "#EXT-X-BYTERANGE":
+			return nil, invalid("byte range playlists are not supported")
+		case "#EXT-X-ENDLIST":
+			playlist.ended = true
+		case "#EXTINF":
+			seconds, _, _ := strings.Cut(attributes, ",")
+			duration, err := strconv.ParseFloat(strings.TrimSpace(seconds), 64)
+			if err != nil || duration < 0 {
+				return nil, invalid(fmt.Sprintf("%s has no valid duration", line))
+			}
+			playlist.duration += duration
+		case "#EXT-X-MAP":
+			if uri := tagAttribute(line, "URI"); uri != "" {
+				if file, err := resolveBundleURI(name, uri); err == nil {
+					playlist.inits[file] = true
+				}
+			}
+		}
+	}
+
+	var uriErr error
+	mapPlaylistURIs(playlist.lines, func(uri string) string {
+		file, err := resolveBundleURI(name, uri)
+		if err != nil {
+			uriErr = err
+			return uri
+		}
+		if _, seen := playlist.paths[uri]; !seen {
+			playlist.paths[uri] = file
+			if !slices.Contains(playlist.files, file) {
+				playlist.files = append(playlist.files, file)
+			}
+		}
+		return uri
+	})
+	if uriErr != nil {
+		return nil, uriErr
+	}
+	return playlist, nil
+}
+
+// resolveBundleURI returns the path in the archive a URI of a playlist
+// refers to, which has to be inside of it
+func resolveBundleURI(playlistName string, uri string) (string, error) {
+	notInArchive := &MediaValidationError{Reason: fmt.Sprintf("%s refers to %s, which is not in the archive", playlistName, uri)}
+
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.IsAbs() || parsed.Host != "" || strings.HasPrefix(parsed.Path, "/") {
+		return "", notInArchive
+	}
+
+	file := path.Join(path.Dir(playlistName), parsed.Path)
+	if file == ".." || strings.HasPrefix(file, "../") {
+		return "", notInArchive
+	}
+	return file, nil
+}
+
+// bundlePlaylistName is the name of the media playlist of a rendition,
+// the bundle's playlists are numbered since their own names may clash
+func bundlePlaylistName(videoID string, index int) string {
+	return fmt.Sprintf("%s_%d.m3u8", videoID, index)
+}
+
+// bundleFileNames names the files of a media playlist like the segments
+// and init segments of a transcoded rendition
+func bundleFileNames(videoID string, index int, media *bundlePlaylist) map[string]string {
+	names := make(map[string]string, len(media.files))
+	segments, inits := 0, 0
+	for _, file := range media.files {
+		if media.inits[file] {
+			if inits == 0 {
+				names[file] = fmt.Sprintf("%s_%d_init.mp4", videoID, index)
+			} else {
+				names[file] = fmt.Sprintf("%s_%d_init_%d.mp4", videoID, index, inits)
+			}
+			inits++
+			continue
+		}
+		names[file] = fmt.Sprintf("%s_%d_segment_no_%d%s", videoID, index, segments, strings.ToLower(path.Ext(file)))
+		segments++
+	}
+	return names
+}
+
+// rewriteBundlePlaylist points the URIs of a playlist at the new names of
+// the files they refer to
+func rewriteBundlePlaylist(playlist *bundlePlaylist, names map[string]string) []byte {
+	lines := mapPlaylistURIs(playlist.lines, func(uri string) string {
+		if name, ok := names[playlist.paths[uri]]; ok {
+			return name
+		}
+		return uri
+	})
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// bundleMasterPlaylist writes the master playlist of a bundle of a single
+// media playlist, with its bandwidth worked out from its size
+func bundleMasterPlaylist(videoID string, bundle *hlsBundle, metadata *types.FFProbeOutput) []byte {
+	media := bundle.media[0]
+
+	var size int64
+	for _, file := range media.files {
+		size += int64(bundle.files[file].UncompressedSize64)
+	}
+	bandwidth := 0
+	if media.duration > 0 {
+		bandwidth = int(float64(size*8) / media.duration)
+	}
+
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n")
+	// EXT-X-MAP outside of I-frame playlists needs protocol version 6
+	if len(media.inits) > 0 {
+		playlist.WriteString("#EXT-X-VERSION:7\n")
+	} else {
+		playlist.WriteString("#EXT-X-VERSION:3\n")
+	}
+
+	fmt.Fprintf(&playlist, "#EXT-X-STREAM-INF:BANDWIDTH=%d", bandwidth)
+	for _, stream := range metadata.Streams {
+		if stream.CodecType == "video" && stream.Width > 0 && stream.Height > 0 {
+			fmt.Fprintf(&playlist, ",RESOLUTION=%dx%d", stream.Width, stream.Height)
+			break
+		}
+	}
+	fmt.Fprintf(&playlist, "\n%s\n", bundlePlaylistName(videoID, 0))
+
+	return []byte(playlist.String())
+}
+
+// bundleSample returns a copy of a segment of a bundle that ffprobe and
+// ffmpeg can read on its own, preceded by its init segment in fragmented
+// MP4 playlists
+func bundleSample(segmentsDir string, names map[string]string, init string, segment string) (string, error) {
+	sample, err := os.CreateTemp("", "sample-*"+path.Ext(names[segment]))
+	if err != nil {
+		return "", fmt.Errorf("error creating sample file: %w", err)
+	}
+	defer sample.Close()
+
+	for _, file := range []string{init, segment} {
+		if file == "" {
+			continue
+		}
+		if err := appendFile(sample, segmentsDir+names[file]); err != nil {
+			os.Remove(sample.Name())
+			return "", fmt.Errorf("error writing sample file: %w", err)
+		}
+	}
+	return sample.Name(), sample.Close()
+}
+
+func appendFile(output *os.File, filePath string) error {
+	input, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	_, err = io.Copy(output, input)
+	return err
+}
+
+// checkBundleCodecs makes sure a segment of a bundle is H.264 video and
+// AAC audio, what every player the site supports can play
+func checkBundleCodecs(ctx context.Context, sample string, segmentName string) (*types.FFProbeOutput, error) {
+	damaged := &MediaValidationError{Reason: fmt.Sprintf("%s could not be read, it may be damaged", segmentName)}
+
+	metadata, err := extractMetaData(ctx, sample)
+	if err != nil {
+		if ctx.Err() != nil || errors.Is(err, exec.ErrNotFound) {
+			return nil, err
+		}
+		return nil, damaged
+	}
+	if len(metadata.Streams) == 0 {
+		return nil, damaged
+	}
+
+	for _, stream := range metadata.Streams {
+		switch {
+		case stream.CodecType == "video" && stream.CodecName != "h264":
+			return nil, &MediaValidationError{Reason: fmt.Sprintf("%s has %s video, only H.264 is supported", segmentName, stream.CodecName)}
+		case stream.CodecType == "audio" && stream.CodecName != "aac":
+			return nil, &MediaValidationError{Reason: fmt.Sprintf("%s has %s audio, only AAC is supported", segmentName, stream.CodecName)}
+		}
+	}
+	return metadata, nil
+}
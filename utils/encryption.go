@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// keyURI is where players fetch a key from, relative to the playlists in
+// /video/[id]/stream/, so videos sharing stored output each use their own
+// ID
+const keyURI = "../key?n=%d"
+
+// hlsKeys are the AES-128 keys the segments of a video are encrypted with.
+// ffmpeg reads the current one from a key info file, which is replaced
+// with one for a new key every HLS_KEY_ROTATION segments. The files are
+// kept outside of the segments directory so they are never uploaded.
+type hlsKeys struct {
+	fileName string
+	dir      string
+	// rotateAfter is how many seconds of output a key is used for, 0 for
+	// the whole video
+	rotateAfter float64
+	keys        [][]byte
+}
+
+func newHLSKeys(fileName string, rotateEvery int) (*hlsKeys, error) {
+	dir, err := os.MkdirTemp("", "keys-"+fileName+"-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating key directory: %w", err)
+	}
+
+	k := &hlsKeys{fileName: fileName, dir: dir, rotateAfter: float64(rotateEvery * segmentDuration)}
+	if err := k.rotate(); err != nil {
+		k.remove()
+		return nil, err
+	}
+	return k, nil
+}
+
+// infoFile is the key info file to pass to ffmpeg as -hls_key_info_file
+func (k *hlsKeys) infoFile() string {
+	return filepath.Join(k.dir, "key_info")
+}
+
+// rotate generates the next key and points the key info file at it. The
+// file is replaced by a rename, since ffmpeg may read it at any time.
+func (k *hlsKeys) rotate() error {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("error generating key: %w", err)
+	}
+
+	index := len(k.keys)
+	keyFile := filepath.Join(k.dir, fmt.Sprintf("key_%d", index))
+	if err := os.WriteFile(keyFile, key, 0600); err != nil {
+		return fmt.Errorf("error writing key: %w", err)
+	}
+
+	// without an IV line, ffmpeg uses the sequence number of each segment
+	info := fmt.Sprintf(keyURI+"\n%s\n", index, keyFile)
+	if err := os.WriteFile(k.infoFile()+".tmp", []byte(info), 0600); err != nil {
+		return fmt.Errorf("error writing key info file: %w", err)
+	}
+	if err := os.Rename(k.infoFile()+".tmp", k.infoFile()); err != nil {
+		return fmt.Errorf("error replacing key info file: %w", err)
+	}
+
+	k.keys = append(k.keys, key)
+	return nil
+}
+
+// advance rotates the key once ffmpeg has written the given seconds of
+// output past the point the current key took over
+func (k *hlsKeys) advance(outTime float64) {
+	if k.rotateAfter <= 0 || outTime < float64(len(k.keys))*k.rotateAfter {
+		return
+	}
+	if err := k.rotate(); err != nil {
+		// the current key simply stays in use for longer
+		processingLogger(k.fileName).Warn("error rotating encryption key", "error", err)
+	}
+}
+
+func (k *hlsKeys) remove() {
+	os.RemoveAll(k.dir)
+}
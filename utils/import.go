@@ -0,0 +1,198 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+	"video-streaming-server/config"
+	"video-streaming-server/repositories"
+	"video-streaming-server/shared"
+	"video-streaming-server/types"
+)
+
+// errPrivateAddress is returned when an import URL resolves to an address
+// on the server's own network, which is refused unless
+// IMPORT_ALLOW_PRIVATE is set
+var errPrivateAddress = errors.New("address is not public")
+
+// importClient downloads imports. Its dialer checks every address it
+// connects to, including the ones redirects lead to, so a URL cannot be
+// used to reach services behind the server. It never goes through a proxy
+// from the environment, the dialer would only see the proxy's address.
+var importClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: checkImportAddress,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+		}
+		return nil
+	},
+}
+
+func checkImportAddress(network string, address string, _ syscall.RawConn) error {
+	if config.AppConfig.ImportAllowPrivate {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return fmt.Errorf("%s: %w", host, errPrivateAddress)
+	}
+	return nil
+}
+
+// ValidateImportURL checks that a URL can be imported from
+func ValidateImportURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errors.New("the URL must be an absolute http or https URL")
+	}
+	return nil
+}
+
+// ImportVideo downloads an imported video to the server, checks it like
+// an upload and marks it uploaded. A download an earlier attempt finished
+// is not repeated. Problems with the source, like it not existing or being
+// too large, are returned as a *MediaValidationError since trying again
+// does not help.
+func ImportVideo(ctx context.Context, db *sql.DB, videoID string, userID types.UserID) error {
+	importLogger := processingLogger(videoID)
+
+	if _, err := FindSourceVideo(videoID); err == nil {
+		importLogger.Info("import already downloaded")
+		return UpdateVideoStatus(db, videoID, types.UploadedOnServer)
+	}
+
+	sourceURL, err := repositories.NewImportRepository(db).GetSourceURL(videoID)
+	if err != nil {
+		return fmt.Errorf("error getting import URL: %w", err)
+	}
+	if sourceURL == "" {
+		return &MediaValidationError{Reason: "The video has nothing to import"}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.AppConfig.ImportTimeout)
+	defer cancel()
+
+	progress := newProgressReporter(userID, videoID)
+	progress.startStage(types.StageDownloading)
+
+	if err := download(ctx, sourceURL, PartialVideoPath(videoID), progress); err != nil {
+		os.Remove(PartialVideoPath(videoID))
+		return err
+	}
+	progress.finishStage()
+	importLogger.Info("import downloaded", "url", sourceURL)
+
+	// the extension of the URL's file name is kept like that of an upload
+	parsed, _ := url.Parse(sourceURL)
+	if _, err := FinishUpload(ctx, videoID, path.Base(parsed.Path)); err != nil {
+		os.Remove(PartialVideoPath(videoID))
+		return err
+	}
+
+	if err := UpdateVideoStatus(db, videoID, types.UploadedOnServer); err != nil {
+		return err
+	}
+	shared.SendEventToUser(userID, "video_status", types.VideoResponseType{
+		ID:     videoID,
+		Status: types.UploadedOnServer,
+	})
+	return nil
+}
+
+func download(ctx context.Context, sourceURL string, filePath string, progress *progressReporter) error {
+	sizeLimit, _ := strconv.ParseInt(config.AppConfig.FileSizeLimit, 10, 64)
+	tooLarge := &MediaValidationError{Reason: fmt.Sprintf("The video is larger than the limit of %d MB", sizeLimit/(1024*1024))}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceURL, nil)
+	if err != nil {
+		return &MediaValidationError{Reason: "The URL is not valid"}
+	}
+
+	response, err := importClient.Do(request)
+	if errors.Is(err, errPrivateAddress) {
+		return &MediaValidationError{Reason: "The URL points to an address that cannot be imported from"}
+	}
+	if err != nil {
+		return fmt.Errorf("error requesting %s: %w", sourceURL, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 400 && response.StatusCode < 500 {
+		return &MediaValidationError{Reason: fmt.Sprintf("The URL answered with %s", response.Status)}
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("error requesting %s: %s", sourceURL, response.Status)
+	}
+
+	if response.ContentLength > sizeLimit {
+		return tooLarge
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("error creating file: %w", err)
+	}
+	defer file.Close()
+
+	// one byte past the limit tells a file of exactly the limit from one
+	// that is larger
+	body := io.LimitReader(response.Body, sizeLimit+1)
+	buffer := make([]byte, 256*1024)
+	var written int64
+	for {
+		n, readErr := body.Read(buffer)
+		if n > 0 {
+			if _, err := file.Write(buffer[:n]); err != nil {
+				return fmt.Errorf("error writing file: %w", err)
+			}
+			written += int64(n)
+			if response.ContentLength > 0 {
+				progress.update(float64(written) / float64(response.ContentLength))
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return &MediaValidationError{Reason: fmt.Sprintf("The download took longer than %v", config.AppConfig.ImportTimeout)}
+			}
+			return fmt.Errorf("error downloading %s: %w", sourceURL, readErr)
+		}
+	}
+
+	if written > sizeLimit {
+		return tooLarge
+	}
+	if response.ContentLength > 0 && written != response.ContentLength {
+		return fmt.Errorf("download of %s ended after %d of %d bytes", sourceURL, written, response.ContentLength)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"video-streaming-server/config"
+)
+
+// liveSegmentDuration is the target length of a live segment in seconds,
+// short so players stay close behind the publisher
+const liveSegmentDuration = 2
+
+// liveListSize is how many segments the rolling live playlist lists, older
+// ones are deleted
+const liveListSize = 6
+
+// LivePlaylist is the media playlist ffmpeg keeps up to date while a video
+// is streamed live, players get it in place of a master playlist
+const LivePlaylist = "live.m3u8"
+
+// LiveDir is where the rolling HLS output of a live stream is written
+func LiveDir(videoID string) string {
+	return filepath.Join(config.AppConfig.RootPath, "live", videoID)
+}
+
+// LiveIngestURLs returns the SRT URL ffmpeg listens on for the publisher
+// of a live stream and the one the publisher sends it to. The key is the
+// passphrase the stream is encrypted with, the listener turns away
+// publishers that do not have it. RTMP is not offered since ffmpeg
+// listening for it accepts any stream key.
+func LiveIngestURLs(port int, key string) (string, string) {
+	bindAddr := config.AppConfig.Addr
+	if bindAddr == "" {
+		bindAddr = "0.0.0.0"
+	}
+	host := config.AppConfig.LiveHost
+
+	return fmt.Sprintf("srt://%s:%d?mode=listener&passphrase=%s", bindAddr, port, key),
+		fmt.Sprintf("srt://%s:%d?passphrase=%s", host, port, key)
+}
+
+// RunLiveIngest waits for the publisher of a live stream and writes it to
+// a rolling HLS playlist in LiveDir, encoded so that every segment starts
+// with a keyframe, and as it was sent to a recording that is processed
+// like an upload afterwards. onStart is called once media arrives. It
+// returns when the publisher disconnects or ctx is done, in which case
+// ffmpeg is interrupted so it finishes the recording.
+func RunLiveIngest(ctx context.Context, videoID string, listenURL string, onStart func()) error {
+	liveDir := LiveDir(videoID)
+	if err := os.MkdirAll(liveDir, os.ModePerm); err != nil {
+		return fmt.Errorf("error creating live directory: %w", err)
+	}
+
+	args := []string{"-progress", "pipe:1", "-nostats", "-loglevel", "error", "-y",
+		"-i", listenURL,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency",
+		"-crf", "23", "-maxrate", "4500k", "-bufsize", "9000k",
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", liveSegmentDuration),
+		"-sc_threshold", "0",
+		"-c:a", "aac", "-b:a", "128k", "-ar", "48000",
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(liveSegmentDuration),
+		"-hls_list_size", strconv.Itoa(liveListSize),
+		"-hls_flags", "delete_segments+independent_segments+temp_file",
+		"-hls_segment_filename", filepath.Join(liveDir, "live_%d.ts"),
+		filepath.Join(liveDir, LivePlaylist),
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-c", "copy",
+		"-f", "matroska", PartialVideoPath(videoID),
+	}
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = 10 * time.Second
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("error creating ffmpeg progress pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting ffmpeg: %w", err)
+	}
+
+	started := false
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		if key != "out_time_us" || started {
+			continue
+		}
+		if microseconds, err := strconv.ParseInt(value, 10, 64); err == nil && microseconds > 0 {
+			started = true
+			onStart()
+		}
+	}
+
+	if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("%w, output: %s", err, stderr.String())
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"video-streaming-server/config"
+	"video-streaming-server/types"
+
+	"github.com/google/uuid"
+)
+
+// SniffLength is how much of the start of a file SourceExtension looks at
+const SniffLength = 12
+
+// maxSourceDuration is the longest video that is accepted
+const maxSourceDuration = 12 * time.Hour
+
+// MediaValidationError is returned for uploads that are not a video the
+// server can process. Its reason is shown to the user as is.
+type MediaValidationError struct {
+	Reason string
+}
+
+func (e *MediaValidationError) Error() string {
+	return e.Reason
+}
+
+// containerExtensions are the extensions files of each container uploads
+// are accepted in go by, the first one is used when the original name of
+// a file has none of them
+var containerExtensions = map[string][]string{
+	"mp4":       {".mp4", ".mov"},
+	"quicktime": {".mov", ".mp4"},
+	"matroska":  {".mkv"},
+}
+
+// sniffContainer tells the container of a video from its first bytes
+func sniffContainer(header []byte) string {
+	if len(header) < SniffLength {
+		return ""
+	}
+
+	if bytes.HasPrefix(header, []byte{0x1a, 0x45, 0xdf, 0xa3}) {
+		return "matroska"
+	}
+
+	// ISO base media files are a list of boxes, a 4 byte size followed by
+	// a 4 byte type, starting with ftyp and its major brand. Old QuickTime
+	// files start with other boxes.
+	switch string(header[4:8]) {
+	case "ftyp":
+		if string(header[8:12]) == "qt  " {
+			return "quicktime"
+		}
+		return "mp4"
+	case "moov", "mdat", "wide", "free", "skip":
+		return "quicktime"
+	}
+	return ""
+}
+
+// SourceExtension checks the first bytes of an upload against the
+// supported containers and returns the extension it is stored with. The
+// extension of the original file name is kept when it fits the content.
+func SourceExtension(header []byte, originalName string) (string, error) {
+	supported := make([]string, 0, len(config.SupportedFileTypes))
+	for _, fileType := range config.SupportedFileTypes {
+		supported = append(supported, fileType.FileExtension)
+	}
+
+	original := strings.ToLower(filepath.Ext(originalName))
+
+	candidates := containerExtensions[sniffContainer(header)]
+	if slices.Contains(candidates, original) && slices.Contains(supported, original) {
+		return original, nil
+	}
+	for _, extension := range candidates {
+		if slices.Contains(supported, extension) {
+			return extension, nil
+		}
+	}
+
+	return "", &MediaValidationError{
+		Reason: fmt.Sprintf("The file is not a supported video, only %s files are accepted", strings.Join(supported, ", ")),
+	}
+}
+
+// PartialVideoPath is where an upload is assembled until it is complete
+// and its container is known
+func PartialVideoPath(videoID string) string {
+	return "./video/" + videoID + ".part"
+}
+
+// SourceVideoPath is where a complete upload is kept until it has been
+// processed
+func SourceVideoPath(videoID string, extension string) string {
+	return "./video/" + videoID + extension
+}
+
+// FindSourceVideo returns the path of a complete upload, whatever its
+// extension
+func FindSourceVideo(videoID string) (string, error) {
+	for _, localPath := range uploadedFiles(videoID) {
+		if filepath.Ext(localPath) != ".part" {
+			return localPath, nil
+		}
+	}
+	return "", fmt.Errorf("no uploaded file for video %s: %w", videoID, os.ErrNotExist)
+}
+
+// uploadedFiles lists the files of an upload, complete or not. They are
+// looked up by name rather than with a pattern, since the ID of an upload
+// comes from the client.
+func uploadedFiles(videoID string) []string {
+	if !IsVideoID(videoID) {
+		return nil
+	}
+
+	extensions := []string{".part", ".zip"}
+	for _, fileType := range config.SupportedFileTypes {
+		extensions = append(extensions, fileType.FileExtension)
+	}
+
+	matches := make([]string, 0)
+	for _, extension := range extensions {
+		localPath := SourceVideoPath(videoID, extension)
+		if _, err := os.Stat(localPath); err == nil {
+			matches = append(matches, localPath)
+		}
+	}
+	return matches
+}
+
+// IsVideoID reports whether an ID a client sent is a UUID in its canonical
+// form, the only IDs videos get, so it is safe to use in file paths
+func IsVideoID(id string) bool {
+	parsed, err := uuid.Parse(id)
+	return err == nil && parsed.String() == id
+}
+
+// SniffUpload checks the start of an upload that is still being received,
+// so one that is not a video can be turned down before all of it is sent
+func SniffUpload(videoID string, originalName string) error {
+	header, err := readHeader(PartialVideoPath(videoID))
+	if err != nil {
+		return fmt.Errorf("error reading uploaded file: %w", err)
+	}
+
+	_, err = SourceExtension(header, originalName)
+	return err
+}
+
+// FinishUpload checks that a completely received upload is a video that
+// can be processed and moves it to its source path. It returns a
+// *MediaValidationError when it is not, leaving the file in place.
+func FinishUpload(ctx context.Context, videoID string, originalName string) (string, error) {
+	partialPath := PartialVideoPath(videoID)
+
+	header, err := readHeader(partialPath)
+	if err != nil {
+		return "", fmt.Errorf("error reading uploaded file: %w", err)
+	}
+
+	extension, err := SourceExtension(header, originalName)
+	if err != nil {
+		return "", err
+	}
+
+	if extension != ".mkv" {
+		if err := checkBoxes(partialPath); err != nil {
+			return "", err
+		}
+	}
+
+	if err := probeSourceVideo(ctx, partialPath); err != nil {
+		return "", err
+	}
+
+	sourcePath := SourceVideoPath(videoID, extension)
+	if err := os.Rename(partialPath, sourcePath); err != nil {
+		return "", fmt.Errorf("error moving uploaded file: %w", err)
+	}
+	return sourcePath, nil
+}
+
+// FileSHA256 returns the hex encoded SHA-256 of a file
+func FileSHA256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ResumeSHA256 continues a SHA-256 from the state SHA256State saved, or
+// starts a new one when there is none
+func ResumeSHA256(state []byte) (hash.Hash, error) {
+	sum := sha256.New()
+	if len(state) == 0 {
+		return sum, nil
+	}
+	if err := sum.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil, fmt.Errorf("error restoring hash state: %w", err)
+	}
+	return sum, nil
+}
+
+// SHA256State saves the state of a SHA-256 so more data can be added to
+// it later, e.g. by another request
+func SHA256State(sum hash.Hash) ([]byte, error) {
+	return sum.(encoding.BinaryMarshaler).MarshalBinary()
+}
+
+func readHeader(filePath string) ([]byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header := make([]byte, SniffLength)
+	n, err := io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return header[:n], nil
+}
+
+// checkBoxes walks the top level boxes of an ISO base media file, the
+// last one running past the end of the file means the upload was cut off
+func checkBoxes(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("error reading uploaded file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading uploaded file: %w", err)
+	}
+
+	truncated := &MediaValidationError{Reason: "The file is incomplete, please upload the video again"}
+	header := make([]byte, 16)
+	var offset int64
+	for offset < info.Size() {
+		if info.Size()-offset < 8 {
+			return truncated
+		}
+		if _, err := file.ReadAt(header[:8], offset); err != nil {
+			return fmt.Errorf("error reading uploaded file: %w", err)
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		switch size {
+		case 0:
+			// the box runs to the end of the file
+			return nil
+		case 1:
+			if _, err := file.ReadAt(header[8:16], offset+8); err != nil {
+				return truncated
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+		}
+
+		if size < 8 || offset+size > info.Size() {
+			return truncated
+		}
+		offset += size
+	}
+	return nil
+}
+
+// probeSourceVideo runs a quick ffprobe over an upload to make sure it
+// has a video stream and a sane duration
+func probeSourceVideo(ctx context.Context, filePath string) error {
+	metadata, err := extractMetaData(ctx, filePath)
+	if err != nil {
+		if ctx.Err() != nil || errors.Is(err, exec.ErrNotFound) {
+			return err
+		}
+		return &MediaValidationError{Reason: "The file could not be read as a video, it may be damaged or incomplete"}
+	}
+
+	hasVideo := slices.ContainsFunc(metadata.Streams, func(stream types.Stream) bool {
+		return stream.CodecType == "video"
+	})
+	if !hasVideo {
+		return &MediaValidationError{Reason: "The file has no video stream"}
+	}
+
+	seconds, err := strconv.ParseFloat(metadata.Format.Duration, 64)
+	if err != nil || seconds <= 0 {
+		return &MediaValidationError{Reason: "The video has no duration"}
+	}
+	if time.Duration(seconds*float64(time.Second)) > maxSourceDuration {
+		return &MediaValidationError{Reason: fmt.Sprintf("The video is longer than %d hours", int(maxSourceDuration.Hours()))}
+	}
+	return nil
+}
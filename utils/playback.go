@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"video-streaming-server/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// playbackAudience keeps playback tokens and logins apart even if both are
+// signed with the same key
+const playbackAudience = "playback"
+
+// PlaybackClaims are what a playback token grants: streaming one video,
+// whose output is stored under StorageID, until the token expires. Tokens
+// issued with PLAYBACK_TOKEN_BIND_IP only work from the address in IP.
+type PlaybackClaims struct {
+	VideoID   string `json:"video_id"`
+	StorageID string `json:"storage_id"`
+	UserID    string `json:"user_id"`
+	IP        string `json:"ip,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// playlistURIAttribute matches the URI attribute of tags like EXT-X-MAP
+// and EXT-X-MEDIA
+var playlistURIAttribute = regexp.MustCompile(`URI="([^"]*)"`)
+
+// GeneratePlaybackToken issues a token for streaming a video to the user
+// the request came from
+func GeneratePlaybackToken(r *http.Request, videoID string, storageID string, userID string) (string, error) {
+	claims := PlaybackClaims{
+		VideoID:   videoID,
+		StorageID: storageID,
+		UserID:    userID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{playbackAudience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(config.AppConfig.PlaybackTokenExpiry)),
+		},
+	}
+	if config.AppConfig.PlaybackTokenBindIP {
+		claims.IP = ClientIP(r)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(config.AppConfig.PlaybackTokenSecret))
+}
+
+// VerifyPlaybackToken checks that a token grants the request streaming the
+// video, without looking anything up
+func VerifyPlaybackToken(r *http.Request, tokenString string, videoID string) (*PlaybackClaims, error) {
+	var claims PlaybackClaims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(config.AppConfig.PlaybackTokenSecret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience(playbackAudience), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("error verifying playback token: %w", err)
+	}
+
+	if claims.VideoID != videoID || claims.StorageID == "" {
+		return nil, errors.New("playback token is for another video")
+	}
+	if claims.IP != "" && claims.IP != ClientIP(r) {
+		return nil, errors.New("playback token was issued to another address")
+	}
+	return &claims, nil
+}
+
+// ClientIP returns the address a request came from
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// SignPlaylist adds a playback token to the URIs of an HLS playlist, so
+// players without the login cookie can follow them. URIs of other servers
+// are left alone.
+func SignPlaylist(playlist []byte, token string) []byte {
+	lines := mapPlaylistURIs(strings.Split(string(playlist), "\n"), func(uri string) string {
+		return signURI(uri, token)
+	})
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// mapPlaylistURIs replaces every URI of a playlist, both the lines naming
+// playlists and segments and the URI attributes of tags, with what fn
+// returns for it
+func mapPlaylistURIs(lines []string, fn func(uri string) string) []string {
+	mapped := make([]string, len(lines))
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			mapped[i] = line
+		case strings.HasPrefix(trimmed, "#"):
+			mapped[i] = playlistURIAttribute.ReplaceAllStringFunc(line, func(attribute string) string {
+				uri := playlistURIAttribute.FindStringSubmatch(attribute)[1]
+				return `URI="` + fn(uri) + `"`
+			})
+		default:
+			mapped[i] = fn(trimmed)
+		}
+	}
+	return mapped
+}
+
+func signURI(uri string, token string) string {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.IsAbs() || parsed.Host != "" {
+		return uri
+	}
+
+	query := parsed.Query()
+	query.Set("token", token)
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
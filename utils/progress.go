@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+	"video-streaming-server/shared"
+	"video-streaming-server/types"
+)
+
+// progressInterval is the least time between two video_progress events of
+// the same stage, ffmpeg reports its progress twice a second
+const progressInterval = time.Second
+
+// progressReporter sends the progress of each processing stage of a video
+// to its owner as video_progress events
+type progressReporter struct {
+	userID  types.UserID
+	videoID string
+	stage   types.ProcessingStage
+	started time.Time
+	sentAt  time.Time
+}
+
+func newProgressReporter(userID types.UserID, videoID string) *progressReporter {
+	return &progressReporter{userID: userID, videoID: videoID}
+}
+
+// startStage announces a stage at 0%
+func (p *progressReporter) startStage(stage types.ProcessingStage) {
+	p.stage = stage
+	p.started = time.Now()
+	p.send(0, -1)
+}
+
+// update reports the fraction of the current stage that is done, with the
+// remaining time estimated from how long the stage has taken so far
+func (p *progressReporter) update(done float64) {
+	if done <= 0 || time.Since(p.sentAt) < progressInterval {
+		return
+	}
+	elapsed := time.Since(p.started).Seconds()
+	p.send(done, int(math.Ceil(elapsed/done-elapsed)))
+}
+
+// updateWithETA reports progress when the caller knows the remaining time
+// better, like ffmpeg does from its encoding speed
+func (p *progressReporter) updateWithETA(done float64, eta time.Duration) {
+	if time.Since(p.sentAt) < progressInterval {
+		return
+	}
+	p.send(done, int(math.Ceil(math.Max(eta.Seconds(), 0))))
+}
+
+func (p *progressReporter) finishStage() {
+	p.send(1, 0)
+}
+
+func (p *progressReporter) send(done float64, etaSeconds int) {
+	p.sentAt = time.Now()
+	shared.SendEventToUser(p.userID, "video_progress", types.VideoProgressType{
+		ID:         p.videoID,
+		Stage:      p.stage,
+		Percent:    int(math.Min(done, 1) * 100),
+		ETASeconds: etaSeconds,
+	})
+}
+
+// runFFmpegWithProgress runs ffmpeg with -progress written to its stdout
+// and reports how far it got through an input of the given duration in
+// seconds. Progress is not reported when the duration is unknown.
+func runFFmpegWithProgress(ctx context.Context, args []string, duration float64, progress *progressReporter, onOutTime func(float64)) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", append([]string{"-progress", "pipe:1", "-nostats"}, args...)...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("error creating ffmpeg progress pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting ffmpeg: %w", err)
+	}
+
+	// ffmpeg writes a block of key=value lines per update, ending with
+	// progress=continue, or progress=end after the last one
+	var outTime, speed float64
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		switch key {
+		case "out_time_us":
+			if microseconds, err := strconv.ParseFloat(value, 64); err == nil {
+				outTime = microseconds / 1e6
+				if onOutTime != nil {
+					onOutTime(outTime)
+				}
+			}
+		case "speed":
+			if parsed, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "x"), 64); err == nil {
+				speed = parsed
+			}
+		case "progress":
+			if duration <= 0 || outTime <= 0 {
+				continue
+			}
+			if speed > 0 {
+				progress.updateWithETA(outTime/duration, time.Duration((duration-outTime)/speed*float64(time.Second)))
+			} else {
+				progress.update(outTime / duration)
+			}
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%w, output: %s", err, stderr.String())
+	}
+	return nil
+}
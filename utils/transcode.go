@@ -0,0 +1,338 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"video-streaming-server/config"
+	"video-streaming-server/types"
+)
+
+// segmentDuration is the target length of a segment in seconds, every
+// rendition gets a keyframe at the same multiples of it so players can
+// switch between renditions at any segment boundary.
+const segmentDuration = 4
+
+// outputRendition is a rendition of the ladder scaled to the aspect ratio
+// of the video being processed
+type outputRendition struct {
+	config.Rendition
+	OutputWidth  int
+	OutputHeight int
+}
+
+// breakFile transcodes a video into the HLS renditions of the ladder, and
+// DASH when enabled, returning its duration in seconds. Segments are
+// encrypted with keys when they are given.
+func breakFile(ctx context.Context, videoPath string, fileName string, keys *hlsKeys, progress *progressReporter) (float64, error) {
+	videoProcessing := processingLogger(fileName)
+	videoProcessing.Debug("Breaking file into segments", "video_path", videoPath)
+
+	if err := os.Mkdir(fmt.Sprintf("segments/%s", fileName), os.ModePerm); err != nil {
+		return 0, fmt.Errorf("error creating segments directory: %w", err)
+	}
+
+	metaData, err := extractMetaData(ctx, videoPath)
+	if err != nil {
+		return 0, fmt.Errorf("error extracting metadata: %w", err)
+	}
+
+	sourceWidth, sourceHeight, hasAudio := 0, 0, false
+	for _, stream := range metaData.Streams {
+		switch stream.CodecType {
+		case "video":
+			if sourceWidth == 0 {
+				sourceWidth, sourceHeight = stream.Width, stream.Height
+			}
+		case "audio":
+			hasAudio = true
+		}
+	}
+
+	if sourceWidth == 0 || sourceHeight == 0 {
+		return 0, fmt.Errorf("no video stream found in %s", videoPath)
+	}
+
+	renditions := selectRenditions(config.AppConfig.RenditionLadder, sourceWidth, sourceHeight)
+	videoProcessing.Info("transcoding renditions", "source_resolution", fmt.Sprintf("%dx%d", sourceWidth, sourceHeight), "renditions", len(renditions))
+
+	segmentsDir := config.AppConfig.RootPath + "/segments/" + fileName + "/"
+	args := ladderArgs(videoPath, renditions, hasAudio)
+	hlsFlags := "independent_segments"
+	var onOutTime func(float64)
+	if keys != nil {
+		args = append(args, "-hls_key_info_file", keys.infoFile())
+		if keys.rotateAfter > 0 {
+			// ffmpeg reads the key info file again for every segment
+			hlsFlags += "+periodic_rekey"
+			onOutTime = keys.advance
+		}
+	}
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(segmentDuration),
+		"-hls_playlist_type", "vod",
+		"-hls_flags", hlsFlags,
+	)
+	args = append(args, segmentArgs(segmentsDir, fileName)...)
+	args = append(args,
+		"-var_stream_map", varStreamMap(renditions, hasAudio),
+		segmentsDir+fileName+"_%v.m3u8",
+	)
+
+	// a missing duration only means no progress is reported
+	duration, _ := strconv.ParseFloat(metaData.Format.Duration, 64)
+
+	progress.startStage(types.StageSegmenting)
+	if err := runFFmpegWithProgress(ctx, args, duration, progress, onOutTime); err != nil {
+		return 0, fmt.Errorf("error breaking file into segments: %w", err)
+	}
+	progress.finishStage()
+
+	masterPlaylist := masterPlaylist(fileName, renditions, hasAudio)
+	if err := os.WriteFile(segmentsDir+fileName+".m3u8", []byte(masterPlaylist), 0644); err != nil {
+		return 0, fmt.Errorf("error writing master playlist: %w", err)
+	}
+
+	if config.AppConfig.DashEnabled {
+		progress.startStage(types.StagePackaging)
+		if err := packageDash(ctx, fileName, renditions, hasAudio, duration, progress); err != nil {
+			return 0, fmt.Errorf("error packaging DASH output: %w", err)
+		}
+		progress.finishStage()
+	}
+
+	return duration, nil
+}
+
+// segmentArgs selects the HLS segment container. MPEG-TS works with every
+// player, fragmented MP4 has less overhead per segment and is required for
+// codecs other than H.264. In that mode ffmpeg writes an init segment per
+// rendition, which the media playlists point to with EXT-X-MAP.
+func segmentArgs(segmentsDir string, fileName string) []string {
+	if config.AppConfig.HLSSegmentType == "fmp4" {
+		return []string{
+			"-hls_segment_type", "fmp4",
+			"-hls_fmp4_init_filename", fileName + "_%v_init.mp4",
+			"-hls_segment_filename", segmentsDir + fileName + "_%v_segment_no_%d.m4s",
+		}
+	}
+
+	return []string{
+		"-hls_segment_type", "mpegts",
+		"-hls_segment_filename", segmentsDir + fileName + "_%v_segment_no_%d.ts",
+	}
+}
+
+// packageDash remuxes the encoded renditions into fragmented MP4 segments
+// with an MPD manifest next to them. The streams are copied, so this costs
+// storage but no second encode, and since the renditions share keyframes
+// the DASH segments line up with the HLS ones.
+func packageDash(ctx context.Context, fileName string, renditions []outputRendition, hasAudio bool, duration float64, progress *progressReporter) error {
+	processingLogger(fileName).Debug("packaging DASH output")
+
+	segmentsDir := config.AppConfig.RootPath + "/segments/" + fileName + "/"
+	args := []string{"-y"}
+	for _, rendition := range renditions {
+		args = append(args, "-i", segmentsDir+fileName+"_"+rendition.Name+".m3u8")
+	}
+
+	for i := range renditions {
+		args = append(args, "-map", fmt.Sprintf("%d:v:0", i))
+		if hasAudio {
+			args = append(args, "-map", fmt.Sprintf("%d:a:0", i))
+		}
+	}
+
+	adaptationSets := "id=0,streams=v"
+	if hasAudio {
+		adaptationSets += " id=1,streams=a"
+	}
+
+	args = append(args,
+		"-c", "copy",
+		"-f", "dash",
+		"-seg_duration", strconv.Itoa(segmentDuration),
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-adaptation_sets", adaptationSets,
+		"-init_seg_name", fileName+"_dash_$RepresentationID$_init.m4s",
+		"-media_seg_name", fileName+"_dash_$RepresentationID$_$Number%05d$.m4s",
+		segmentsDir+fileName+".mpd",
+	)
+
+	if err := runFFmpegWithProgress(ctx, args, duration, progress, nil); err != nil {
+		return fmt.Errorf("error remuxing renditions: %w", err)
+	}
+
+	return nil
+}
+
+// selectRenditions drops the renditions that would upscale the source. A
+// source smaller than every rendition is kept at its own resolution with
+// the bitrates of the smallest one.
+func selectRenditions(ladder []config.Rendition, sourceWidth int, sourceHeight int) []outputRendition {
+	renditions := make([]outputRendition, 0)
+	var smallest *config.Rendition
+
+	for i, rendition := range ladder {
+		if smallest == nil || rendition.Height < smallest.Height {
+			smallest = &ladder[i]
+		}
+
+		if rendition.Height > sourceHeight && rendition.Width > sourceWidth {
+			continue
+		}
+
+		width, height := fitInside(sourceWidth, sourceHeight, rendition.Width, rendition.Height)
+		renditions = append(renditions, outputRendition{
+			Rendition:    rendition,
+			OutputWidth:  width,
+			OutputHeight: height,
+		})
+	}
+
+	if len(renditions) == 0 && smallest != nil {
+		renditions = append(renditions, outputRendition{
+			Rendition:    *smallest,
+			OutputWidth:  sourceWidth - sourceWidth%2,
+			OutputHeight: sourceHeight - sourceHeight%2,
+		})
+	}
+
+	return renditions
+}
+
+// fitInside scales a resolution down to fit a box while keeping its aspect
+// ratio, rounding to the even sizes libx264 requires.
+func fitInside(width int, height int, boxWidth int, boxHeight int) (int, int) {
+	if width <= boxWidth && height <= boxHeight {
+		return width - width%2, height - height%2
+	}
+
+	scaledWidth, scaledHeight := boxWidth, height*boxWidth/width
+	if scaledHeight > boxHeight {
+		scaledWidth, scaledHeight = width*boxHeight/height, boxHeight
+	}
+	return scaledWidth - scaledWidth%2, scaledHeight - scaledHeight%2
+}
+
+// ladderArgs builds the input, filter and encoder arguments producing one
+// video (and audio) output stream per rendition.
+func ladderArgs(videoPath string, renditions []outputRendition, hasAudio bool) []string {
+	args := []string{"-y", "-i", videoPath}
+
+	var filter strings.Builder
+	fmt.Fprintf(&filter, "[0:v:0]split=%d", len(renditions))
+	for i := range renditions {
+		fmt.Fprintf(&filter, "[v%d]", i)
+	}
+	for i, rendition := range renditions {
+		fmt.Fprintf(&filter, ";[v%d]scale=%d:%d[v%dout]", i, rendition.OutputWidth, rendition.OutputHeight, i)
+	}
+	args = append(args, "-filter_complex", filter.String())
+
+	for i, rendition := range renditions {
+		stream := strconv.Itoa(i)
+		args = append(args,
+			"-map", "[v"+stream+"out]",
+			"-c:v:"+stream, "libx264",
+			"-profile:v:"+stream, "high",
+			"-level:v:"+stream, h264Level(rendition.OutputHeight),
+			"-b:v:"+stream, fmt.Sprintf("%dk", rendition.VideoBitrate),
+			"-maxrate:v:"+stream, fmt.Sprintf("%dk", peakBitrate(rendition.VideoBitrate)),
+			"-bufsize:v:"+stream, fmt.Sprintf("%dk", rendition.VideoBitrate*2),
+		)
+	}
+
+	if hasAudio {
+		for i, rendition := range renditions {
+			stream := strconv.Itoa(i)
+			args = append(args,
+				"-map", "0:a:0",
+				"-c:a:"+stream, "aac",
+				"-b:a:"+stream, fmt.Sprintf("%dk", rendition.AudioBitrate),
+				"-ac:a:"+stream, "2",
+			)
+		}
+	}
+
+	return append(args,
+		"-preset", "veryfast",
+		"-sc_threshold", "0",
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", segmentDuration),
+	)
+}
+
+func varStreamMap(renditions []outputRendition, hasAudio bool) string {
+	streams := make([]string, 0, len(renditions))
+	for i, rendition := range renditions {
+		stream := fmt.Sprintf("v:%d", i)
+		if hasAudio {
+			stream += fmt.Sprintf(",a:%d", i)
+		}
+		streams = append(streams, stream+",name:"+rendition.Name)
+	}
+	return strings.Join(streams, " ")
+}
+
+// masterPlaylist lists the media playlist of every rendition ffmpeg wrote
+func masterPlaylist(fileName string, renditions []outputRendition, hasAudio bool) string {
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n")
+	// EXT-X-MAP outside of I-frame playlists needs protocol version 6
+	if config.AppConfig.HLSSegmentType == "fmp4" {
+		playlist.WriteString("#EXT-X-VERSION:7\n")
+	} else {
+		playlist.WriteString("#EXT-X-VERSION:3\n")
+	}
+	playlist.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+
+	for _, rendition := range renditions {
+		averageBandwidth := rendition.VideoBitrate * 1000
+		bandwidth := peakBitrate(rendition.VideoBitrate) * 1000
+		codecs := h264Codec(rendition.OutputHeight)
+		if hasAudio {
+			averageBandwidth += rendition.AudioBitrate * 1000
+			bandwidth += rendition.AudioBitrate * 1000
+			codecs += ",mp4a.40.2"
+		}
+
+		fmt.Fprintf(&playlist, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"%s\"\n",
+			bandwidth, averageBandwidth, rendition.OutputWidth, rendition.OutputHeight, codecs)
+		fmt.Fprintf(&playlist, "%s_%s.m3u8\n", fileName, rendition.Name)
+	}
+
+	return playlist.String()
+}
+
+// peakBitrate is the maxrate the encoder is held to, 7% above the target
+func peakBitrate(bitrate int) int {
+	return bitrate * 107 / 100
+}
+
+// h264Level picks an H.264 level that allows the given height at up to
+// 60 frames per second
+func h264Level(height int) string {
+	switch {
+	case height <= 480:
+		return "3.1"
+	case height <= 720:
+		return "3.2"
+	case height <= 1080:
+		return "4.2"
+	case height <= 1440:
+		return "5.1"
+	default:
+		return "5.2"
+	}
+}
+
+// h264Codec is the RFC 6381 codec string of a high profile stream encoded
+// at h264Level
+func h264Codec(height int) string {
+	levels := map[string]string{"3.1": "1f", "3.2": "20", "4.2": "2a", "5.1": "33", "5.2": "34"}
+	return "avc1.6400" + levels[h264Level(height)]
+}
@@ -1,8 +1,7 @@
 package utils
 
 import (
-	"bytes"
-	"crypto/sha1"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -10,11 +9,12 @@ import (
 	"io"
 	"log"
 	"log/slog"
-	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
+	"sort"
 	"strings"
 	"time"
 	"video-streaming-server/config"
@@ -22,20 +22,23 @@ import (
 	"video-streaming-server/repositories"
 	"video-streaming-server/shared"
 	"video-streaming-server/shared/logger"
+	"video-streaming-server/storage"
 	"video-streaming-server/types"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var videoProcessing *slog.Logger
+func processingLogger(videoID string) *slog.Logger {
+	return logger.Log.With("video_id", videoID)
+}
 
-func extractThumbnail(videoPath string, fileName string) (string, error) {
+func extractThumbnail(ctx context.Context, videoPath string, fileName string) (string, error) {
 
 	if err := os.Mkdir(fmt.Sprintf("thumbnails/%s", fileName), os.ModePerm); err != nil {
 		return "", fmt.Errorf("error creating thumbnail directory: %w", err)
 	}
 
-	cmd := exec.Command("ffmpeg", "-y", "-i", videoPath, "-frames:v", "1", config.AppConfig.RootPath+"/thumbnails/"+fileName+"/"+fileName+"_thumbnail.png")
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-y", "-i", videoPath, "-frames:v", "1", config.AppConfig.RootPath+"/thumbnails/"+fileName+"/"+fileName+"_thumbnail.png")
 
 	output, err := cmd.CombinedOutput()
 
@@ -46,8 +49,9 @@ func extractThumbnail(videoPath string, fileName string) (string, error) {
 	return config.AppConfig.RootPath + "/thumbnails/" + fileName + "/" + fileName + "_thumbnail.png", nil
 }
 
-func uploadThumbnailToAppwrite(folderName string, db *sql.DB) (string, error) {
-	videoProcessing.Debug("Uploading thumbnail of to Appwrite", "video_id", folderName)
+func uploadThumbnail(ctx context.Context, store storage.ObjectStore, folderName string, db *sql.DB) (string, error) {
+	videoProcessing := processingLogger(folderName)
+	videoProcessing.Debug("Uploading thumbnail to storage")
 	files, err := os.ReadDir(fmt.Sprintf("thumbnails/%s", folderName))
 
 	if err != nil {
@@ -59,533 +63,529 @@ func uploadThumbnailToAppwrite(folderName string, db *sql.DB) (string, error) {
 		if err != nil {
 			return "", fmt.Errorf("error removing empty thumbnail directory: %w", err)
 		}
+		return "", fmt.Errorf("no thumbnail found for video %s", folderName)
 	}
 
-	fileToUpload, err := os.ReadFile(fmt.Sprintf("thumbnails/%s/%s", folderName, files[0].Name()))
-
-	if err != nil {
-		return "", fmt.Errorf("error reading thumbnail file: %w", err)
-	}
-
-	uploadRequestURL := "https://cloud.appwrite.io/v1/storage/buckets/" + config.AppConfig.AppwriteBucketID + "/files"
-
-	var requestBody bytes.Buffer
-	writer := multipart.NewWriter(&requestBody)
-	fileComps := strings.Split(files[0].Name(), ".")
-	fileId := GetFileId(fileComps[0])
-
-	err = writer.WriteField("fileId", fileId)
-	if err != nil {
-		return "", fmt.Errorf("error writing fileId field: %w", err)
-	}
-
-	part, err := writer.CreateFormFile("file", files[0].Name())
+	thumbnailPath := fmt.Sprintf("thumbnails/%s/%s", folderName, files[0].Name())
+	key := storage.ThumbnailKey(folderName)
 
-	if err != nil {
-		return "", fmt.Errorf("error creating form file part: %w", err)
+	if err := putFile(ctx, store, key, thumbnailPath); err != nil {
+		return "", fmt.Errorf("error uploading thumbnail: %w", err)
 	}
 
-	_, err = part.Write(fileToUpload)
-
+	err = os.Remove(thumbnailPath)
 	if err != nil {
-		return "", fmt.Errorf("error writing file content to form part: %w", err)
+		return "", fmt.Errorf("error removing thumbnail file after upload: %w", err)
 	}
 
-	err = writer.Close()
+	thumbnailURL := ThumbnailURL(store, folderName)
+	videoProcessing.Debug("thumbnail URL", "thumbnail_url", thumbnailURL)
 
-	if err != nil {
-		return "", fmt.Errorf("error closing multipart writer: %w", err)
-	}
+	updateStatement, err := db.Prepare(`
+		UPDATE
+			videos
+		SET
+			thumbnail=$1
+		WHERE
+			video_id=$2;
+	`)
 
-	request, err := http.NewRequest(http.MethodPost, uploadRequestURL, &requestBody)
 	if err != nil {
-		return "", fmt.Errorf("error creating request: %w", err)
+		return "", fmt.Errorf("error preparing update statement: %w", err)
 	}
 
-	request.Header.Set("Content-Type", writer.FormDataContentType())
-	request.Header.Set("X-Appwrite-Response-Format", config.AppConfig.AppwriteResponseFormat)
-	request.Header.Set("X-Appwrite-Project", config.AppConfig.AppwriteProjectID)
-	request.Header.Set("X-Appwrite-Key", config.AppConfig.AppwriteKey)
-
-	client := &http.Client{}
-	response, err := client.Do(request)
+	_, err = updateStatement.Exec(thumbnailURL, folderName)
 	if err != nil {
-		return "", fmt.Errorf("error sending request to Appwrite: %w", err)
+		return "", fmt.Errorf("error updating database record: %w", err)
 	}
-	defer response.Body.Close()
-
-	thumbnailURL := ""
-
-	if response.StatusCode != 201 {
-		body, err := io.ReadAll(response.Body)
-		if err != nil {
-			return "", fmt.Errorf("error reading response body: %w", err)
-		}
-		videoProcessing.Error("error uploading thumbnail to Appwrite Storage",
-			"status_code", response.StatusCode,
-			"response_body", string(body),
-			"file_name", files[0].Name())
-	} else {
-		var uploadResponse types.ThumbnailUploadResponse
-		err := json.NewDecoder(response.Body).Decode(&uploadResponse)
-		if err != nil {
-			return "", fmt.Errorf("error decoding response body: %w", err)
-		}
-		err = os.Remove("thumbnails/" + folderName + "/" + files[0].Name())
-		if err != nil {
-			return "", fmt.Errorf("error removing thumbnail file after upload: %w", err)
-		}
 
-		updateStatement, err := db.Prepare(`
-			UPDATE
-				videos
-			SET
-				thumbnail=$1
-			WHERE
-				video_id=$2;
-		`)
-
-		if err != nil {
-			return "", fmt.Errorf("error preparing update statement: %w", err)
-		}
-
-		thumbnailURL = fmt.Sprintf("https://cloud.appwrite.io/v1/storage/buckets/%s/files/%s/view?project=%s", uploadResponse.BucketID, uploadResponse.ID, config.AppConfig.AppwriteProjectID)
-
-		videoProcessing.Debug("thumbnail URL", "thumbnail_url", thumbnailURL)
-
-		_, err = updateStatement.Exec(thumbnailURL, folderName)
-		if err != nil {
-			return "", fmt.Errorf("error updating database record: %w", err)
-		}
-
-		videoProcessing.Info("thumbnail URL updated in database", "thumbnail_url", thumbnailURL)
-	}
+	videoProcessing.Info("thumbnail URL updated in database", "thumbnail_url", thumbnailURL)
 
 	err = os.Remove("thumbnails/" + folderName)
 	if err != nil {
-		log.Println(err)
-		return "", err
+		return "", fmt.Errorf("error removing thumbnail directory after upload: %w", err)
 	}
 	return thumbnailURL, nil
 }
 
-func breakFile(videoPath string, fileName string) error {
-	videoProcessing.Debug("Breaking file into segments", "video_path", videoPath)
-
-	if err := os.Mkdir(fmt.Sprintf("segments/%s", fileName), os.ModePerm); err != nil {
-		return fmt.Errorf("error creating segments directory: %w", err)
+// ThumbnailURL returns the URL the browser should load the thumbnail of a
+// video from. Stores that cannot be reached directly are proxied through
+// the thumbnail route.
+func ThumbnailURL(store storage.ObjectStore, videoID string) string {
+	if urler, ok := store.(storage.PublicURLer); ok {
+		return urler.PublicURL(storage.ThumbnailKey(videoID))
 	}
+	return "/video/" + videoID + "/thumbnail"
+}
 
-	metaData, err := extractMetaData(videoPath)
-	videoCodec := ""
-	audioCodec := ""
+func putFile(ctx context.Context, store storage.ObjectStore, key string, filePath string) error {
+	file, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("error extracting metadata: %w", err)
-	} else {
-		for _, codecs := range metaData.Streams {
-			switch codecs.CodecType {
-			case "video":
-				videoCodec = codecs.CodecName
-			case "audio":
-				audioCodec = codecs.CodecName
-			}
-		}
-
-		videoProcessing.Debug("Extracted video and audio codecs", "video_codec", videoCodec, "audio_codec", audioCodec)
+		return fmt.Errorf("error opening %s: %w", filePath, err)
 	}
+	defer file.Close()
 
-	videoCodecAction := "copy"
-	audioCodecAction := "copy"
-
-	if videoCodec != "h264" {
-		videoProcessing.Info("Converting video codec", "old_video_codec", videoCodec, "new_video_codec", "h264")
-		videoCodecAction = "libx264"
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error getting file info of %s: %w", filePath, err)
 	}
 
-	if audioCodec != "aac" {
-		videoProcessing.Info("Converting audio codec", "old_audio_codec", audioCodec, "new_audio_codec", "aac")
-		audioCodecAction = "aac"
+	if err := store.Put(ctx, key, file, fileInfo.Size(), ContentTypeOf(filePath)); err != nil {
+		return err
 	}
 
-	cmd := exec.Command("ffmpeg", "-y", "-i", videoPath, "-c:v", videoCodecAction, "-preset", "veryfast", "-c:a", audioCodecAction, "-map", "0", "-f", "segment", "-segment_time", "4", "-segment_format", "mpegts", "-segment_list", config.AppConfig.RootPath+"/segments/"+fileName+"/"+fileName+".m3u8", "-segment_list_type", "m3u8", config.AppConfig.RootPath+"/segments/"+fileName+"/"+fileName+"_"+"segment_no_%d.ts")
-
-	output, err := cmd.CombinedOutput()
-
-	if err != nil {
-		return fmt.Errorf("error breaking file into segments: %w, output: %s", err, string(output))
+	// a video processed again replaces its objects
+	if cache := storage.GetCache(); cache != nil {
+		cache.Forget(key)
 	}
-
 	return nil
 }
 
-func uploadToAppwrite(folderName string) error {
-	// TODO: Add a deferred cleanup function
+// ContentTypeOf returns the content type a processed file is stored and
+// served with.
+func ContentTypeOf(fileName string) string {
+	switch path.Ext(fileName) {
+	case ".m3u8":
+		return "application/x-mpegURL"
+	case ".ts":
+		return "video/MP2T"
+	case ".mpd":
+		return "application/dash+xml"
+	case ".m4s":
+		return "video/iso.segment"
+	case ".mp4":
+		return "video/mp4"
+	case ".png":
+		return "image/png"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// uploadSegments uploads the processed output of a video and returns its
+// size in bytes
+func uploadSegments(ctx context.Context, store storage.ObjectStore, folderName string, progress *progressReporter) (int64, error) {
 	files, err := os.ReadDir(fmt.Sprintf("segments/%s", folderName))
 
 	if err != nil {
-		return fmt.Errorf("error reading segments directory: %w", err)
-	}
-
-	if len(files) == 0 {
-		err = os.Remove("segments/" + folderName)
-		if err != nil {
-			return fmt.Errorf("error removing empty segments directory: %w", err)
-		}
+		return 0, fmt.Errorf("error reading segments directory: %w", err)
 	}
 
-	videoProcessing.Debug("Now uploading segments to Appwrite Storage")
-	var count int = -1
-	for idx, file := range files {
-		fileToUpload, err := os.ReadFile(fmt.Sprintf("segments/%s/%s", folderName, file.Name()))
-
-		if err != nil {
-			return fmt.Errorf("error reading segment file: %w", err)
-		}
-
-		uploadRequestURL := "https://cloud.appwrite.io/v1/storage/buckets/" + config.AppConfig.AppwriteBucketID + "/files"
-
-		var requestBody bytes.Buffer
-		writer := multipart.NewWriter(&requestBody)
+	// playlists go up after the segments they list and the master
+	// playlist last, so a video is only playable once it is complete
+	masterPlaylist := folderName + ".m3u8"
+	sort.SliceStable(files, func(i, j int) bool {
+		return uploadOrder(files[i].Name(), masterPlaylist) < uploadOrder(files[j].Name(), masterPlaylist)
+	})
 
-		fileId := "nil"
-		fileComps := strings.Split(file.Name(), ".")
-		if fileComps[1] == "m3u8" {
-			fileId = fileComps[0]
-		} else {
-			fileId = GetFileId(fileComps[0])
+	var totalSize, uploadedSize int64
+	for _, file := range files {
+		if info, err := file.Info(); err == nil {
+			totalSize += info.Size()
 		}
+	}
 
-		err = writer.WriteField("fileId", fileId)
+	processingLogger(folderName).Debug("Now uploading segments to storage")
+	for _, file := range files {
+		filePath := fmt.Sprintf("segments/%s/%s", folderName, file.Name())
 
+		err := putFile(ctx, store, storage.ObjectKey(folderName, file.Name()), filePath)
 		if err != nil {
-			return fmt.Errorf("error writing fileId field: %w", err)
+			return 0, fmt.Errorf("error uploading segment %s: %w", file.Name(), err)
 		}
 
-		part, err := writer.CreateFormFile("file", file.Name())
-
-		if err != nil {
-			return fmt.Errorf("error creating form file part: %w", err)
+		if info, err := file.Info(); err == nil && totalSize > 0 {
+			uploadedSize += info.Size()
+			progress.update(float64(uploadedSize) / float64(totalSize))
 		}
 
-		_, err = part.Write(fileToUpload)
-
+		err = os.Remove(filePath)
 		if err != nil {
-			return fmt.Errorf("error writing file content to form part: %w", err)
+			return 0, fmt.Errorf("error removing segment file after upload: %w", err)
 		}
+	}
 
-		err = writer.Close()
+	err = os.Remove("segments/" + folderName)
+	if err != nil {
+		return 0, fmt.Errorf("error removing segments directory after upload: %w", err)
+	}
 
-		if err != nil {
-			return fmt.Errorf("error closing multipart writer: %w", err)
-		}
+	return totalSize, nil
+}
 
-		request, err := http.NewRequest(http.MethodPost, uploadRequestURL, &requestBody)
-		if err != nil {
-			return fmt.Errorf("error creating request: %w", err)
-		}
+func uploadOrder(fileName string, masterPlaylist string) int {
+	switch {
+	case fileName == masterPlaylist:
+		return 2
+	case path.Ext(fileName) == ".m3u8", path.Ext(fileName) == ".mpd":
+		return 1
+	default:
+		return 0
+	}
+}
 
-		request.Header.Set("Content-Type", writer.FormDataContentType())
-		request.Header.Set("X-Appwrite-Response-Format", config.AppConfig.AppwriteResponseFormat)
-		request.Header.Set("X-Appwrite-Project", config.AppConfig.AppwriteProjectID)
-		request.Header.Set("X-Appwrite-Key", config.AppConfig.AppwriteKey)
+// PostUploadProcessFile extracts the thumbnail of an uploaded video and
+// transcodes it into segments in the object store. It runs as a job and
+// may be retried, so output left behind by an earlier attempt is cleared
+// first and the upload is only removed once everything is stored.
+func PostUploadProcessFile(ctx context.Context, db *sql.DB, videoID string, videoTitle string, userID types.UserID) error {
+	videoProcessing := processingLogger(videoID)
 
-		client := &http.Client{}
+	videoProcessing.Info("processing video")
 
-		response, err := client.Do(request)
-		if err != nil {
-			return fmt.Errorf("error sending request to Appwrite: %w", err)
-		}
-		defer response.Body.Close()
+	videoPath, err := FindSourceVideo(videoID)
+	if err != nil {
+		return fmt.Errorf("error reading uploaded file: %w", err)
+	}
 
-		if response.StatusCode != 201 {
-			body, err := io.ReadAll(response.Body)
-			if err != nil {
-				return fmt.Errorf("error reading response body: %w", err)
-			}
-			videoProcessing.Error("error uploading segment to Appwrite Storage", "status_code", response.StatusCode, "response_body", string(body), "file_name", file.Name())
-		} else {
-			count = idx
-			err = os.Remove("segments/" + folderName + "/" + file.Name())
-			if err != nil {
-				return fmt.Errorf("error removing segment file after upload: %w", err)
-			}
-		}
+	store, err := storage.GetStore()
+	if err != nil {
+		return fmt.Errorf("error getting object store: %w", err)
 	}
 
-	if count == len(files)-1 {
-		err = os.Remove("segments/" + folderName)
-		if err != nil {
-			return fmt.Errorf("error removing segments directory after upload: %w", err)
+	for _, dir := range []string{"thumbnails/" + videoID, "segments/" + videoID} {
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("error removing output of a previous attempt: %w", err)
 		}
 	}
 
-	return nil
-}
-
-func closeAndRemoveTmpfile(tmpFile *os.File) (errClose, errRemove error) {
-	err := tmpFile.Close()
+	repository := repositories.NewVideoRepository(db)
 
+	// an earlier attempt may have pointed the video at the output of an
+	// identical one already, whose reference it holds
+	reused, err := repository.SharedStorage(videoID)
 	if err != nil {
-		return fmt.Errorf("error closing temporary file: %w", err), nil
+		return fmt.Errorf("error looking up stored output of video: %w", err)
+	}
+	if reused != nil {
+		videoProcessing.Info("reusing the processed output of an identical video", "storage_id", reused.StorageID)
+		return finishProcessing(db, videoPath, videoID, videoTitle, userID, reused.Thumbnail.String)
 	}
 
-	err = os.Remove(tmpFile.Name())
-
+	// chunked uploads are hashed, and checked against the hash, as they
+	// are received
+	contentHash, err := repository.ContentHash(videoID)
 	if err != nil {
-		return nil, fmt.Errorf("error removing temporary file: %w", err)
+		return fmt.Errorf("error getting content hash for video from DB: %w", err)
+	}
+	if contentHash == "" {
+		contentHash, err = FileSHA256(videoPath)
+		if err != nil {
+			return fmt.Errorf("error hashing uploaded file: %w", err)
+		}
+		if err := repository.SetContentHash(videoID, contentHash); err != nil {
+			return fmt.Errorf("error recording content hash for video in DB: %w", err)
+		}
 	}
-	return nil, nil
-}
 
-func PostUploadProcessFile(serverFileName string, fileName string, videoTitle string, tmpFile *os.File, db *sql.DB, userID types.UserID) {
-	videoProcessing = logger.Log.With("video_id", fileName)
+	content, err := reuseProcessedContent(repository, videoID, contentHash, userID)
+	if err != nil {
+		return fmt.Errorf("error looking for an identical video: %w", err)
+	}
+	if content != nil {
+		videoProcessing.Info("reusing the processed output of an identical video", "storage_id", content.StorageID)
+		return finishProcessing(db, videoPath, videoID, videoTitle, userID, content.Thumbnail.String)
+	}
 
-	videoProcessing.Info("processing video")
+	progress := newProgressReporter(userID, videoID)
 
-	extractedThumbnail, err := extractThumbnail(("./video/" + serverFileName), fileName)
+	progress.startStage(types.StageThumbnailing)
+	extractedThumbnail, err := extractThumbnail(ctx, videoPath, videoID)
 	thumbnailURL := ""
 
 	if err != nil {
 		videoProcessing.Error("error extracting thumbnail for video", "error", err)
 	} else {
 		videoProcessing.Debug("extracted thumbnail for video", "thumbnail", extractedThumbnail)
-		thumbnailURL, err = uploadThumbnailToAppwrite(fileName, db)
+		thumbnailURL, err = uploadThumbnail(ctx, store, videoID, db)
 		if err != nil {
-			videoProcessing.Error("error uploading thumbnail to appwrite Storage", "error", err)
+			videoProcessing.Error("error uploading thumbnail to storage", "error", err)
+		} else {
+			videoProcessing.Info("uploaded thumbnail to storage", "thumbnail_url", thumbnailURL)
 		}
-		videoProcessing.Info("uploaded thumbnail to appwrite Storage", "thumbnail_url", thumbnailURL)
 	}
+	progress.finishStage()
 
-	err = breakFile(("./video/" + serverFileName), fileName)
+	var keys *hlsKeys
+	if config.AppConfig.HLSEncryption {
+		keys, err = newHLSKeys(videoID, config.AppConfig.HLSKeyRotation)
+		if err != nil {
+			return fmt.Errorf("error generating encryption keys: %w", err)
+		}
+		defer keys.remove()
+	}
 
+	duration, err := breakFile(ctx, videoPath, videoID, keys, progress)
 	if err != nil {
-		videoProcessing.Error("error breaking file into segments", "error", err)
-		if err := UpdateVideoStatus(db, fileName, types.ProcessingFailed); err != nil {
-			videoProcessing.Error("error updating upload status for video in DB", "error", err)
-		}
-		shared.SendEventToUser(userID, "video_status", types.VideoResponseType{
-			ID:     fileName,
-			Title:  videoTitle,
-			Status: types.ProcessingFailed,
-		})
-		return
+		return fmt.Errorf("error breaking file into segments: %w", err)
 	}
 
 	videoProcessing.Info("broken file into segments")
 
-	errClose, errRemove := closeAndRemoveTmpfile(tmpFile)
-	if errClose != nil {
-		videoProcessing.Error("error closing temporary file", "error", err)
-		if err := UpdateVideoStatus(db, fileName, types.ProcessingFailed); err != nil {
-			log.Printf("Error updating upload status for video %s in DB: %v", fileName, err)
-		}
-		shared.SendEventToUser(userID, "video_status", types.VideoResponseType{
-			ID:     fileName,
-			Title:  videoTitle,
-			Status: types.ProcessingFailed,
-		})
-		return
+	progress.startStage(types.StageUploading)
+	outputSize, err := uploadSegments(ctx, store, videoID, progress)
+	if err != nil {
+		return fmt.Errorf("error uploading segments to storage: %w", err)
 	}
 
-	if errRemove != nil {
-		videoProcessing.Warn("error removing temporary file", "error", err)
+	progress.finishStage()
+	videoProcessing.Info("uploaded segments to storage")
+
+	// what a video takes up counts against its owner's quota
+	if err := repository.RecordOutput(videoID, outputSize, duration); err != nil {
+		return fmt.Errorf("error recording output size for video in DB: %w", err)
 	}
 
-	err = uploadToAppwrite(fileName)
-	if err != nil {
-		videoProcessing.Error("error uploading segments to Appwrite Storage", "error", err)
-		if err := UpdateVideoStatus(db, fileName, types.ProcessingFailed); err != nil {
-			videoProcessing.Error("error updating upload status for video in DB", "error", err)
+	if keys != nil {
+		if err := repositories.NewKeyRepository(db).Save(videoID, keys.keys); err != nil {
+			return fmt.Errorf("error storing encryption keys for video in DB: %w", err)
 		}
+		videoProcessing.Info("encrypted segments", "keys", len(keys.keys))
+	}
 
-		shared.SendEventToUser(userID, "video_status", types.VideoResponseType{
-			ID:     fileName,
-			Title:  videoTitle,
-			Status: types.ProcessingFailed,
-		})
-		return
+	return finishProcessing(db, videoPath, videoID, videoTitle, userID, thumbnailURL)
+}
+
+// reuseProcessedContent points a video at the stored output of a processed
+// video with the same content, within the scope set by DEDUP_SCOPE. It
+// returns nil when there is none.
+func reuseProcessedContent(repository repositories.VideoRepository, videoID string, contentHash string, userID types.UserID) (*types.StoredContent, error) {
+	owner := ""
+	switch config.AppConfig.DedupScope {
+	case "off":
+		return nil, nil
+	case "user":
+		owner = string(userID)
+	}
+
+	content, err := repository.FindProcessed(contentHash, owner, videoID)
+	if err != nil || content == nil {
+		return nil, err
+	}
+
+	reused, err := repository.ReuseStorage(videoID, content)
+	if err != nil || !reused {
+		return nil, err
+	}
+	return content, nil
+}
+
+// finishProcessing removes the upload of a processed video and tells its
+// owner it can be watched
+func finishProcessing(db *sql.DB, videoPath string, videoID string, videoTitle string, userID types.UserID, thumbnailURL string) error {
+	if err := os.Remove(videoPath); err != nil {
+		processingLogger(videoID).Warn("error removing uploaded file", "error", err)
 	}
 
-	videoProcessing.Info("uploaded segments to appwrite storage")
-	if err := UpdateVideoStatus(db, fileName, types.ProcessingCompleted); err != nil {
-		videoProcessing.Error("error updating upload status for video in DB", "error", err)
+	if err := UpdateVideoStatus(db, videoID, types.ProcessingCompleted); err != nil {
+		return fmt.Errorf("error updating upload status for video in DB: %w", err)
 	}
 	shared.SendEventToUser(userID, "video_status", types.VideoResponseType{
-		ID:        fileName,
+		ID:        videoID,
 		Title:     videoTitle,
 		Status:    types.ProcessingCompleted,
 		Thumbnail: thumbnailURL,
 	})
+	return nil
 }
 
-func GetManifestFile(w http.ResponseWriter, videoId string) ([]byte, error) {
+func GetManifestFile(ctx context.Context, store storage.ObjectStore, videoId string) ([]byte, error) {
+	return readObject(ctx, store, storage.ManifestKey(videoId))
+}
 
-	getManifestFile := "https://cloud.appwrite.io/v1/storage/buckets/" + config.AppConfig.AppwriteBucketID + "/files/" + videoId + "/view"
+// SegmentsOf lists the segment files referenced by a manifest, including
+// the init segment of fragmented MP4 playlists
+func SegmentsOf(manifest []byte) []string {
+	segments := make([]string, 0)
+	for _, line := range strings.Split(string(manifest), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#EXT-X-MAP:") {
+			if uri := tagAttribute(line, "URI"); uri != "" {
+				segments = append(segments, uri)
+			}
+		} else if line != "" && !strings.HasPrefix(line, "#") {
+			segments = append(segments, line)
+		}
+	}
+	return segments
+}
 
-	request, err := http.NewRequest(http.MethodGet, getManifestFile, nil)
+// tagAttribute returns the quoted value of an attribute of a playlist tag
+// like #EXT-X-MAP:URI="init.mp4"
+func tagAttribute(line string, name string) string {
+	for _, separator := range []string{":", ","} {
+		if _, value, found := strings.Cut(line, separator+name+"=\""); found {
+			value, _, _ = strings.Cut(value, "\"")
+			return value
+		}
+	}
+	return ""
+}
 
+// VideoObjectKeys lists the keys of every object stored for a processed
+// video, starting from its manifest and following the media playlists it
+// points to. Every playlist comes after the entries it lists and the
+// manifest comes last. The thumbnail is left out since videos without one
+// are still playable.
+func VideoObjectKeys(ctx context.Context, store storage.ObjectStore, videoId string) ([]string, error) {
+	manifest, err := GetManifestFile(ctx, store, videoId)
 	if err != nil {
-		return nil, fmt.Errorf("error creating request to get manifest file: %w", err)
+		return nil, err
 	}
 
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("X-Appwrite-Response-Format", config.AppConfig.AppwriteResponseFormat)
-	request.Header.Set("X-Appwrite-Project", config.AppConfig.AppwriteProjectID)
-	request.Header.Set("X-Appwrite-Key", config.AppConfig.AppwriteKey)
+	keys := make([]string, 0)
+	for _, entry := range SegmentsOf(manifest) {
+		key := storage.ObjectKey(videoId, entry)
 
-	client := &http.Client{}
+		if path.Ext(entry) == ".m3u8" {
+			playlist, err := readObject(ctx, store, key)
+			if err != nil {
+				return nil, err
+			}
+			for _, segment := range SegmentsOf(playlist) {
+				keys = append(keys, storage.ObjectKey(videoId, segment))
+			}
+		}
 
-	response, err := client.Do(request)
+		keys = append(keys, key)
+	}
 
+	// anything a playlist does not reference, like the DASH output, is
+	// found by listing the folder of the video
+	objects, err := store.List(ctx, videoId+"/")
 	if err != nil {
-		return nil, fmt.Errorf("error sending request to get manifest file: %w", err)
+		return nil, fmt.Errorf("error listing objects of video %s: %w", videoId, err)
 	}
 
-	defer response.Body.Close()
-
-	// TODO: util function should not handle HTTP status codes
-	if response.StatusCode == 404 {
-		SendError(w, http.StatusNotFound, "Manifest file not found")
-		return nil, fmt.Errorf("manifest file not found for video ID: %s", videoId)
+	listed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		listed[key] = true
 	}
+	listed[storage.ManifestKey(videoId)] = true
+	listed[storage.ThumbnailKey(videoId)] = true
 
-	bodyBytes, err := io.ReadAll(response.Body)
-
-	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %w", err)
+	for _, object := range objects {
+		if !listed[object.Key] {
+			keys = append(keys, object.Key)
+		}
 	}
 
-	return bodyBytes, nil
+	keys = append(keys, storage.ManifestKey(videoId))
+
+	return keys, nil
 }
 
-func GetFileId(fileName string) string {
-	hashChecksum := sha1.New()
-	hashChecksum.Write([]byte(fileName))
-	fileId := fmt.Sprintf("%x", hashChecksum.Sum(nil))[:36]
+func readObject(ctx context.Context, store storage.ObjectStore, key string) ([]byte, error) {
+	body, _, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("error getting %s: %w", key, err)
+	}
+	defer body.Close()
 
-	return fileId
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", key, err)
+	}
+	return data, nil
 }
 
-func DeleteVideo(w http.ResponseWriter, r *http.Request, db *sql.DB, videoId string) {
+func DeleteVideo(db *sql.DB, videoId string) {
 	// TODO: Use SSEs here
 	deleteLogger := logger.Log.With("video_id", videoId)
-	fileBytes, err := GetManifestFile(w, videoId)
+	ctx := context.Background()
 
+	store, err := storage.GetStore()
 	if err != nil {
-		deleteLogger.Error("Error getting manifest file", "error", err)
-		SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		deleteLogger.Error("error getting object store", "error", err)
 		return
 	}
 
-	file := string(fileBytes)
-	lines := strings.Split(file, "\n")
-
-	deleteUrl := "https://cloud.appwrite.io/v1/storage/buckets/" + config.AppConfig.AppwriteBucketID + "/files/"
-
-	thumbnailFile := videoId + "_thumbnail.png"
-
-	thumbnailFileName := strings.Split(thumbnailFile, ".")[0]
-
-	thumbnailFileId := GetFileId(thumbnailFileName)
-
-	request, err := http.NewRequest(http.MethodDelete, deleteUrl+thumbnailFileId, nil)
-
+	storageID, last, err := repositories.NewVideoRepository(db).ReleaseStorage(videoId)
 	if err != nil {
-		deleteLogger.Error("Error creating request to delete thumbnail", "error", err)
-		SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		deleteLogger.Error("error deleting database record", "error", err)
 		return
 	}
-
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("X-Appwrite-Response-Format", config.AppConfig.AppwriteResponseFormat)
-	request.Header.Set("X-Appwrite-Project", config.AppConfig.AppwriteProjectID)
-	request.Header.Set("X-Appwrite-Key", config.AppConfig.AppwriteKey)
-
-	client := &http.Client{}
-
-	response, err := client.Do(request)
-	if err != nil {
-		deleteLogger.Error("Error deleting thumbnail file", "error", err)
-		SendError(w, http.StatusInternalServerError, "Error Deleting Thumbnail")
+	if storageID == "" {
+		deleteLogger.Info("video already deleted")
 		return
 	}
-	defer response.Body.Close()
-
-	for i := 0; i < len(lines); i++ {
-		if strings.HasSuffix(lines[i], ".ts") {
-			fileName := strings.Split(lines[i], ".")[0]
-			fileId := GetFileId(fileName)
-
-			request, err := http.NewRequest(http.MethodDelete, deleteUrl+fileId, nil)
-
-			if err != nil {
-				deleteLogger.Error("Error creating request to delete chunk", "error", err)
-				SendError(w, http.StatusInternalServerError, "Internal Server Error")
-				return
-			}
 
-			request.Header.Set("Content-Type", "application/json")
-			request.Header.Set("X-Appwrite-Response-Format", config.AppConfig.AppwriteResponseFormat)
-			request.Header.Set("X-Appwrite-Project", config.AppConfig.AppwriteProjectID)
-			request.Header.Set("X-Appwrite-Key", config.AppConfig.AppwriteKey)
-
-			client := &http.Client{}
+	deleteLogger.Info("deleted database record")
 
-			response, err := client.Do(request)
-			if err != nil {
-				deleteLogger.Error("Error deleting chunk file", "error", err)
-				SendError(w, http.StatusInternalServerError, "Internal Server Error")
-				return
-			}
-			defer response.Body.Close()
-		}
+	// videos with the same content share their stored output, which goes
+	// with the last of them
+	if !last {
+		deleteLogger.Info("video deleted successfully, its files are still used by other videos", "storage_id", storageID)
+		return
 	}
 
-	deleteLogger.Info("deleted all .ts files")
-
-	request, err = http.NewRequest(http.MethodDelete, deleteUrl+videoId, nil)
+	keys, err := VideoObjectKeys(ctx, store, storageID)
 
 	if err != nil {
-		deleteLogger.Error("error creating request to delete manifest file", "error", err)
-		SendError(w, http.StatusInternalServerError, "Internal Server Error")
+		deleteLogger.Error("Error getting manifest file", "error", err)
 		return
 	}
 
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("X-Appwrite-Response-Format", config.AppConfig.AppwriteResponseFormat)
-	request.Header.Set("X-Appwrite-Project", config.AppConfig.AppwriteProjectID)
-	request.Header.Set("X-Appwrite-Key", config.AppConfig.AppwriteKey)
+	err = store.Delete(ctx, storage.ThumbnailKey(storageID))
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		deleteLogger.Error("Error deleting thumbnail file", "error", err)
+		return
+	}
 
-	client = &http.Client{}
+	for _, key := range keys {
+		err := store.Delete(ctx, key)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			deleteLogger.Error("Error deleting video file", "key", key, "error", err)
+			return
+		}
+	}
 
-	response, err = client.Do(request)
-	if err != nil {
-		deleteLogger.Error("error deleting manifest file", "error", err)
-		SendError(w, http.StatusInternalServerError, "Internal Server Error")
-		return
+	if cache := storage.GetCache(); cache != nil {
+		cache.Forget(storageID + "/")
 	}
-	defer response.Body.Close()
 
-	deleteLogger.Info("deleted .m3u8 file")
+	deleteLogger.Info("deleted all video files")
+	deleteLogger.Info("video deleted successfully", "video_id", videoId)
+}
 
-	query, err := db.Prepare(`DELETE FROM videos WHERE video_id=$1`)
+// DiscardVideoFiles removes everything processing a video has left behind,
+// on local disk and in the object store. It is used for videos that never
+// finished processing, so there is no manifest to go by.
+func DiscardVideoFiles(ctx context.Context, store storage.ObjectStore, videoId string) error {
+	if err := RemoveLocalFiles(videoId); err != nil {
+		return err
+	}
 
+	objects, err := store.List(ctx, videoId+"/")
 	if err != nil {
-		deleteLogger.Error("error preparing delete query", "error", err)
-		SendError(w, http.StatusInternalServerError, "Internal Server Error")
-		return
+		return fmt.Errorf("error listing objects of video %s: %w", videoId, err)
 	}
 
-	_, err = query.Exec(videoId)
+	keys := []string{storage.ThumbnailKey(videoId)}
+	for _, object := range objects {
+		if object.Key != storage.ThumbnailKey(videoId) {
+			keys = append(keys, object.Key)
+		}
+	}
 
-	if err != nil {
-		deleteLogger.Error("error executing delete query", "error", err)
-		SendError(w, http.StatusInternalServerError, "Internal Server Error")
-		return
+	for _, key := range keys {
+		err := store.Delete(ctx, key)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return fmt.Errorf("error deleting %s: %w", key, err)
+		}
 	}
+	return nil
+}
 
-	deleteLogger.Info("deleted database record")
-	deleteLogger.Info("video deleted successfully", "video_id", videoId)
+// RemoveLocalFiles removes the upload and the processing output of a
+// video kept on local disk
+func RemoveLocalFiles(videoId string) error {
+	for _, localPath := range append(uploadedFiles(videoId), "segments/"+videoId, "thumbnails/"+videoId) {
+		if err := os.RemoveAll(localPath); err != nil {
+			return fmt.Errorf("error removing %s: %w", localPath, err)
+		}
+	}
+	return nil
 }
 
 func GenerateJWT(userID string, username string) (string, error) {
@@ -656,10 +656,10 @@ func GetUserFromRequest(r *http.Request) (*types.User, error) {
 	return nil, nil
 }
 
-func extractMetaData(videoPath string) (*types.FFProbeOutput, error) {
-	cmd := exec.Command("ffprobe",
+func extractMetaData(ctx context.Context, videoPath string) (*types.FFProbeOutput, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe",
 		"-v", "error",
-		"-show_entries", "stream=codec_name,codec_type",
+		"-show_entries", "stream=codec_name,codec_type,width,height",
 		"-show_entries", "format=filename,duration,bit_rate,size",
 		"-of", "json",
 		videoPath,
@@ -703,9 +703,11 @@ func handleProcessingCompletedStatus(db *sql.DB, videoID string) error {
 	query = `
 			UPDATE videos
 			SET status = $1, upload_end_time = $2
-			WHERE video_id = $3;
+			WHERE video_id = $3 AND status <> $4;
 		`
-	result, err = db.Exec(query, types.ProcessingCompleted, time.Now(), videoID)
+	// a cancelled video stays cancelled, the job finishing it discards
+	// its files
+	result, err = db.Exec(query, types.ProcessingCompleted, time.Now(), videoID, types.Cancelled)
 
 	if err != nil {
 		return fmt.Errorf("failed to update upload status for video %s: %w", videoID, err)
@@ -717,7 +719,7 @@ func handleProcessingCompletedStatus(db *sql.DB, videoID string) error {
 	}
 
 	if rowsAffected == 0 {
-		return fmt.Errorf("no record found for video_id: %s", videoID)
+		return fmt.Errorf("no record found for video_id: %s, or it was cancelled", videoID)
 	}
 
 	return nil
@@ -751,6 +753,31 @@ func updateGenericVideoStatus(db *sql.DB, videoID string, status types.VideoStat
 	return nil
 }
 
+// FailVideo marks a video as failed, with the reason shown to its owner
+func FailVideo(db *sql.DB, videoID string, reason string) error {
+	logger.Log.Info("Updating video status", "video_id", videoID, "status", types.ProcessingFailed, "reason", reason)
+	result, err := db.Exec(`
+		UPDATE videos
+		SET status = $1, failure_reason = $2
+		WHERE video_id = $3 AND status <> $4;
+	`, types.ProcessingFailed, reason, videoID, types.Cancelled)
+
+	if err != nil {
+		return fmt.Errorf("failed to update upload status for video %s: %w", videoID, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows for video %s: %w", videoID, err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("no record found for video_id: %s, or it was cancelled", videoID)
+	}
+
+	return nil
+}
+
 func GetRefererPathFromRequest(r *http.Request) (string, error) {
 	referer := r.Referer()
 	if referer == "" {